@@ -0,0 +1,41 @@
+package main
+
+import (
+	"aliyun/serverless/webide-server/pkg/logging"
+	"flag"
+	"log/slog"
+	"os"
+
+	"github.com/spf13/viper"
+)
+
+// The flags of glog, which were used by the previous versions and still passed by the deployments,
+// e.g. -logtostderr=true in s.yaml. The logs are always written to stderr, -v=1 or above enables the debug logs.
+var (
+	_       = flag.Bool("logtostderr", true, "deprecated, the logs are always written to stderr")
+	_       = flag.Bool("alsologtostderr", false, "deprecated, the logs are always written to stderr")
+	_       = flag.String("log_dir", "", "deprecated, the logs are always written to stderr")
+	_       = flag.String("stderrthreshold", "", "deprecated, use log.level in the config file")
+	verbose = flag.Int("v", 0, "enables the debug logs if positive, which overrides log.level in the config file")
+)
+
+// newLogger creates the logger by the log config, which writes to stderr.
+func newLogger() (*slog.Logger, error) {
+	viper.SetDefault("log.format", logging.FormatJSON)
+	viper.SetDefault("log.level", "info")
+
+	level, err := logging.ParseLevel(viper.GetString("log.level"))
+	if err != nil {
+		return nil, err
+	}
+	if *verbose > 0 {
+		level = slog.LevelDebug
+	}
+	return logging.New(os.Stderr, viper.GetString("log.format"), level)
+}
+
+// fatal logs the error and exits, the logs are written synchronously so nothing is lost.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
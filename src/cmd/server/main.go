@@ -1,110 +1,339 @@
 package main
 
 import (
+	"aliyun/serverless/webide-server/pkg/auth"
 	"aliyun/serverless/webide-server/pkg/context"
+	"aliyun/serverless/webide-server/pkg/logging"
+	"aliyun/serverless/webide-server/pkg/metrics"
+	"aliyun/serverless/webide-server/pkg/storage"
 	"aliyun/serverless/webide-server/pkg/vscode"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
-	"github.com/golang/glog"
 	"github.com/spf13/viper"
 )
 
 type ServerManager struct {
 	VscodeServer *vscode.Server         // backend vscode server
 	Proxy        *httputil.ReverseProxy // frontend reverse proxy
+	Users        *UserRouter            // per-user vscode servers, only in multi-user mode
+	Auth         *auth.Authenticator    // authenticates the requests before they are proxied
+	Logger       *slog.Logger           // the logger without the request id, the handlers add the ones of the requests
+
+	// mu guards the servers above, which are set by init while the requests are served,
+	// and the init state reported by /status.
+	mu            sync.RWMutex
+	ctx           *context.Context
+	phase         string
+	initStartTime time.Time
+	initEndTime   time.Time
+	initErr       error
+
+	stopOnce sync.Once
+}
+
+// serverOptions returns the options of the vscode servers, which log by log.
+func (sm *ServerManager) serverOptions(log *slog.Logger) []vscode.ServerOption {
+	opts := []vscode.ServerOption{vscode.WithLogger(log)}
+	if sm.Auth.Mode == auth.ModeToken {
+		opts = append(opts, vscode.WithConnectionToken(sm.Auth.Token))
+	}
+	return opts
 }
 
 // init implements the FC initializer instance lifecycle callback, called by FC runtime before processing the request.
 func (sm *ServerManager) init() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		glog.Infof("Starting server manager init ...")
-
-		// Get contextSource option from config file.
-		// contextSource indicates where to get the context.
-		// In FC runtime, context should be parsed from the request headers.
-		// In VM or container, the context should be parsed from the environment variables.
-		viper.SetDefault("contextSource", "fc")
-		ctxSource := viper.GetString("contextSource")
-
-		var err error
-		var ctx *context.Context
-		if ctxSource == "env" {
-			ctx, err = context.NewFromEnvVars()
-		} else {
-			ctx, err = context.New(r)
+		log := logging.FromRequest(sm.Logger, r)
+		// A second vscode server on the same directories would orphan the first one.
+		if phase, ok := sm.startInit(); !ok {
+			log.Warn("Skip server manager init.", "phase", phase)
+			if phase == InitPhaseReady {
+				w.WriteHeader(http.StatusOK)
+				fmt.Fprint(w, "init handler success")
+			} else {
+				w.WriteHeader(http.StatusConflict)
+				fmt.Fprintf(w, "init %s", phase)
+			}
+			return
 		}
+		log.Info("Starting server manager init ...")
+
+		start := time.Now()
+		status, err := sm.initialize(r, log)
 		if err != nil {
-			glog.Errorf("Get context from %s failed. Error: %v", ctxSource, err)
-			// Context failed because of invalid ak id, ak secret and security token, then return 403 Forbidden error.
-			w.WriteHeader(http.StatusForbidden)
+			log.Error("Server manager init failed.", "status", status, logging.Duration(start), "error", err)
+			sm.setPhase(InitPhaseFailed, err)
+			w.WriteHeader(status)
 			fmt.Fprint(w, err.Error())
 			return
 		}
+		sm.setPhase(InitPhaseReady, nil)
 
-		// Create the vscode server.
-		sm.VscodeServer, err = vscode.NewServer(ctx)
-		if err != nil {
-			glog.Errorf("Create vscode server failed. Error: %v", err)
-			// Create vscode server failed because of invalid ak id, ak secret and security token, then return 403 Forbidden error.
-			w.WriteHeader(http.StatusForbidden)
-			fmt.Fprint(w, err.Error())
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "init handler success")
+		log.Info("Server manager init success.", logging.Duration(start))
+	}
+}
+
+// initialize creates the vscode server and the reverse proxy, or the user router in multi-user mode.
+// It returns the response status code if failed. The vscode servers created for the request log by log.
+func (sm *ServerManager) initialize(r *http.Request, log *slog.Logger) (int, error) {
+	// Get contextSource option from config file.
+	// contextSource indicates where to get the context.
+	// In FC runtime, context should be parsed from the request headers.
+	// In VM or container, the context should be parsed from the environment variables.
+	// In local development, no cloud service is used, and the data is saved to the local storage.
+	viper.SetDefault("contextSource", context.SourceFc)
+	ctxSource := viper.GetString("contextSource")
+
+	var err error
+	var ctx *context.Context
+	start := time.Now()
+	switch ctxSource {
+	case context.SourceEnv:
+		ctx, err = context.NewFromEnvVars()
+	case context.SourceLocal:
+		ctx = context.NewLocal()
+	default:
+		ctx, err = context.New(r)
+	}
+	if err != nil {
+		log.Error("Get context failed.", "phase", metrics.PhaseContext, "source", ctxSource, logging.Duration(start), "error", err)
+		// Context failed because of invalid ak id, ak secret and security token, then return 403 Forbidden error.
+		return http.StatusForbidden, err
+	}
+	metrics.ObserveInitPhase(metrics.PhaseContext, start)
+	log.Info("Get context succeeded.", "phase", metrics.PhaseContext, "source", ctxSource, logging.Duration(start))
+
+	// In multi-user mode, the vscode servers are started on the first requests of the users,
+	// which outlive the init request, so they log without its request id.
+	if viper.GetBool("multiUser.enabled") {
+		users := NewUserRouter(ctx,
+			viper.GetString("multiUser.userHeader"),
+			viper.GetInt("multiUser.basePort"),
+			viper.GetInt("multiUser.maxUsers"),
+			viper.GetDuration("multiUser.idleTimeout"),
+			sm.serverOptions(sm.Logger)...)
+		users.Logger = sm.Logger
+		log.Info("Create user router succeeded.", "userHeader", users.Header)
+
+		sm.mu.Lock()
+		sm.ctx, sm.Users = ctx, users
+		sm.mu.Unlock()
+		return http.StatusOK, nil
+	}
+
+	// Create the vscode server.
+	server, err := vscode.NewServer(ctx, sm.serverOptions(log)...)
+	if err != nil {
+		log.Error("Create vscode server failed.", "error", err)
+		// Create vscode server failed because of invalid ak id, ak secret and security token, then return 403 Forbidden error.
+		return http.StatusForbidden, err
+	}
+
+	// Create the reverse proxy.
+	url, err := url.Parse("http://" + server.Host + ":" + server.Port)
+	if err != nil {
+		log.Error("Parse url failed.", "host", server.Host, "error", err)
+		return http.StatusInternalServerError, err
+	}
+	proxy := httputil.NewSingleHostReverseProxy(url)
+	log.Info("Create reverse proxy succeeded.", "url", url.String())
+
+	sm.mu.Lock()
+	sm.ctx, sm.VscodeServer, sm.Proxy = ctx, server, proxy
+	sm.mu.Unlock()
+	return http.StatusOK, nil
+}
+
+// shutdown implements the FC pre-stop instance lifecycle callback.
+func (sm *ServerManager) shutdown() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The credentials of init may have expired, use the latest ones for the final save.
+		sm.updateCredentials(r)
+		sm.stop(logging.FromRequest(sm.Logger, r))
+
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "pre-stop handler success")
+	}
+}
+
+// stop saves the data and stops the vscode servers. It is called by the pre-stop callback or on the termination signals,
+// the later calls wait for the first one and do nothing.
+func (sm *ServerManager) stop(log *slog.Logger) {
+	sm.stopOnce.Do(func() {
+		log.Info("Starting server manager shutdown ...")
+		start := time.Now()
+
+		sm.mu.RLock()
+		users, server := sm.Users, sm.VscodeServer
+		sm.mu.RUnlock()
+		if users != nil {
+			users.Shutdown()
+		} else if server != nil {
+			server.Shutdown()
+		}
+
+		log.Info("Server manager shutdown success.", logging.Duration(start))
+	})
+}
+
+// progress reports the workspace loading progress in json, which continues after init returns.
+func (sm *ServerManager) progress() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		server, _, release, ok := sm.route(w, r)
+		if !ok {
 			return
 		}
+		defer release()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(server.WorkspaceProgress.Status())
+	}
+}
 
-		// Create the reverse proxy.
-		url, err := url.Parse("http://" + sm.VscodeServer.Host + ":" + sm.VscodeServer.Port)
+// snapshots lists the workspace snapshots in json, the latest first.
+func (sm *ServerManager) snapshots() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		server, _, release, ok := sm.route(w, r)
+		if !ok {
+			return
+		}
+		defer release()
+
+		snapshots, err := server.ListSnapshots()
 		if err != nil {
-			glog.Errorf("Parse url %s failed. Error: %v", sm.VscodeServer.Host, err)
+			logging.FromRequest(sm.Logger, r).Error("List snapshots failed.", "error", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprint(w, err.Error())
 			return
 		}
-		sm.Proxy = httputil.NewSingleHostReverseProxy(url)
-		glog.Infof("Create reverse proxy succeeded. Url: %s", url)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(snapshots)
+	}
+}
+
+// restoreSnapshot restores the snapshot specified by the id query parameter into the workspace directory.
+func (sm *ServerManager) restoreSnapshot() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprint(w, "only POST is allowed")
+			return
+		}
+		server, _, release, ok := sm.route(w, r)
+		if !ok {
+			return
+		}
+		defer release()
 
+		id := r.URL.Query().Get("id")
+		err := server.RestoreSnapshot(id)
+		if errors.Is(err, storage.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "snapshot %s not found", id)
+			return
+		} else if err != nil {
+			logging.FromRequest(sm.Logger, r).Error("Restore snapshot failed.", "snapshot", id, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, err.Error())
+			return
+		}
 		w.WriteHeader(http.StatusOK)
-		fmt.Fprint(w, "init handler success")
-		glog.Infof("Server manager init success.")
+		fmt.Fprintf(w, "restore snapshot %s success", id)
 	}
 }
 
-func (sm *ServerManager) shutdown() func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		glog.Infof("Starting server manager shutdown ...")
+// route returns the vscode server and the proxy serving the request, which is the server of the request user in multi-user mode.
+// If the server is not available, the error response is written and ok is false.
+// Otherwise release must be called when the request is finished, the server is not stopped as idle before that.
+func (sm *ServerManager) route(w http.ResponseWriter, r *http.Request) (server *vscode.Server, proxy *httputil.ReverseProxy, release func(), ok bool) {
+	sm.mu.RLock()
+	users, server, proxy := sm.Users, sm.VscodeServer, sm.Proxy
+	sm.mu.RUnlock()
 
-		sm.VscodeServer.Shutdown()
+	if users == nil {
+		if server == nil {
+			sm.unavailable(w, r)
+			return nil, nil, nil, false
+		}
+		return server, proxy, func() {}, true
+	}
 
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprint(w, "pre-stop handler success")
-		glog.Infof("Server manager shutdown success.")
+	user, err := users.User(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, err.Error())
+		return nil, nil, nil, false
+	}
+	us, release, err := users.Acquire(user)
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, err.Error())
+		return nil, nil, nil, false
+	}
+	return us.server, us.proxy, release, true
+}
+
+// updateCredentials updates the FC credentials by the request, FC passes the latest ones in every request.
+// The credentials headers are removed, so they are not passed to vscode server.
+func (sm *ServerManager) updateCredentials(r *http.Request) {
+	sm.mu.RLock()
+	ctx := sm.ctx
+	sm.mu.RUnlock()
+	if ctx != nil {
+		ctx.UpdateFc(r.Header)
 	}
+	for _, h := range []string{"x-fc-access-key-id", "x-fc-access-key-secret", "x-fc-security-token"} {
+		r.Header.Del(h)
+	}
+}
+
+// fcLifecycle reports whether r is the FC lifecycle callback /initialize or /pre-stop. FC runtime invokes them
+// with the header x-fc-control-path set to the callback path, which the HTTP trigger never passes from the clients.
+func fcLifecycle(r *http.Request) bool {
+	if r.URL.Path != "/initialize" && r.URL.Path != "/pre-stop" {
+		return false
+	}
+	return r.Header.Get("x-fc-control-path") == r.URL.Path && r.Header.Get(logging.RequestIdHeader) != ""
 }
 
 func (sm *ServerManager) process() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r != nil {
-			sm.Proxy.ServeHTTP(w, r)
+			sm.updateCredentials(r)
+			_, proxy, release, ok := sm.route(w, r)
+			if !ok {
+				return
+			}
+			// The proxy returns after the websocket connections are closed, so they keep the server active.
+			defer release()
+			proxy.ServeHTTP(w, r)
 		} else {
-			glog.Errorf("The input request parameter is nil!")
+			sm.Logger.Error("The input request parameter is nil!")
 		}
 	}
 }
 
 func main() {
 	flag.Parse()
-	defer glog.Flush()
 
 	// Get the directory of current running process.
 	ex, err := os.Executable()
 	if err != nil {
-		glog.Fatalf("Failed to get the directory of current running process. Error: %v", err)
+		fatal("Failed to get the directory of current running process.", "error", err)
 	}
 	configDir := filepath.Dir(ex)
 	configFile := filepath.Join(configDir, "config.yaml")
@@ -115,11 +344,47 @@ func main() {
 	// Read the configurations from the specified file.
 	err = viper.ReadInConfig()
 	if err != nil {
-		glog.Fatalf("Failed to read ide server config file. Error: %v", err)
+		fatal("Failed to read ide server config file.", "error", err)
 	}
-	glog.Infof("Reverse proxy read config file from directory: %s", configDir)
 
-	sm := &ServerManager{}
+	// The logs before are written by the default logger, which is replaced once the log config is read.
+	logger, err := newLogger()
+	if err != nil {
+		fatal("Failed to create logger.", "error", err)
+	}
+	slog.SetDefault(logger)
+	logger.Info("Reverse proxy read config file.", "dir", configDir)
+
+	viper.SetDefault("multiUser.enabled", false)
+	viper.SetDefault("multiUser.userHeader", "X-Webide-User")
+	viper.SetDefault("multiUser.basePort", viper.GetInt("vscode.port")+1)
+	viper.SetDefault("multiUser.maxUsers", 0)
+	viper.SetDefault("multiUser.idleTimeout", 30*time.Minute)
+
+	authenticator, err := auth.New()
+	if err != nil {
+		fatal("Failed to create authenticator.", "error", err)
+	}
+	// The probes are invoked by the load balancers without the credentials.
+	// The metrics carry no user data, and are scraped by the monitoring without the credentials as well.
+	authenticator.Exempt = []string{"/healthz", "/readyz", "/metrics"}
+	// The FC lifecycle callbacks are invoked by FC runtime without the credentials, while the same paths requested
+	// through the HTTP trigger, or outside FC where the proxy is exposed directly, would let anyone stop the vscode
+	// server, so they require the authentication.
+	viper.SetDefault("contextSource", context.SourceFc)
+	if viper.GetString("contextSource") == context.SourceFc {
+		authenticator.Trusted = fcLifecycle
+	}
+	if viper.GetBool("multiUser.enabled") {
+		// Only the oidc sessions carry the user id, in the other modes any client could claim to be any user.
+		if authenticator.Mode != auth.ModeOIDC {
+			fatal("Multi-user mode requires the oidc auth mode.", "mode", authenticator.Mode)
+		}
+		authenticator.UserHeader = viper.GetString("multiUser.userHeader")
+	}
+	logger.Info("Create authenticator succeeded.", "mode", authenticator.Mode)
+
+	sm := &ServerManager{Auth: authenticator, Logger: logger, phase: InitPhasePending}
 
 	// Register the initializer handler.
 	http.HandleFunc("/initialize", sm.init())
@@ -127,15 +392,29 @@ func main() {
 	// Register the shutdown handler.
 	http.HandleFunc("/pre-stop", sm.shutdown())
 
+	// Register the health check handlers.
+	http.HandleFunc("/healthz", sm.healthz())
+	http.HandleFunc("/readyz", sm.readyz())
+	http.HandleFunc("/status", sm.status())
+	http.Handle("/metrics", metrics.Handler())
+
+	// Register the workspace loading progress handler.
+	http.HandleFunc("/progress", sm.progress())
+
+	// Register the workspace snapshot handlers.
+	http.HandleFunc("/snapshots", sm.snapshots())
+	http.HandleFunc("/snapshots/restore", sm.restoreSnapshot())
+
 	// Handle all other requests to your server using the proxy.
-	http.HandleFunc("/", sm.process())
+	http.Handle("/", metrics.InstrumentProxy(http.HandlerFunc(sm.process())))
 
 	// Start the proxy server.
 	proxyServer := &http.Server{
 		Addr:        ":9000",
+		Handler:     authenticator.Handler(http.DefaultServeMux),
 		IdleTimeout: 5 * time.Minute,
 	}
 
-	glog.Infof("Reverse proxy listen at %s ...", proxyServer.Addr)
-	glog.Fatalf("Reverse proxy run. Error: %v", proxyServer.ListenAndServe())
+	viper.SetDefault("shutdownTimeout", "30s")
+	serve(proxyServer, sm, viper.GetDuration("shutdownTimeout"))
 }
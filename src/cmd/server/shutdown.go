@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// serve runs the proxy server until SIGTERM or SIGINT is received, then shuts down gracefully:
+// the in-flight requests are drained within timeout, the data is saved and the vscode servers are stopped,
+// the same as the pre-stop callback, which is not called outside FC, e.g. on docker stop.
+func serve(server *http.Server, sm *ServerManager, timeout time.Duration) {
+	errs := make(chan error, 1)
+	go func() {
+		sm.Logger.Info("Reverse proxy listen ...", "addr", server.Addr)
+		errs <- server.ListenAndServe()
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err := <-errs:
+		fatal("Reverse proxy run failed.", "error", err)
+	case sig := <-sigs:
+		sm.Logger.Info("Received signal, shutting down ...", "signal", sig.String())
+	}
+
+	// A second signal skips the graceful shutdown.
+	go func() {
+		sig := <-sigs
+		fatal("Received signal again, exit immediately.", "signal", sig.String())
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	// The hijacked connections, e.g. websockets, are not waited for, vscode server is stopped below anyway.
+	if err := server.Shutdown(ctx); err != nil {
+		sm.Logger.Warn("Reverse proxy did not drain the requests in time.", "timeout", timeout.String(), "error", err)
+	}
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+		sm.Logger.Error("Reverse proxy run failed.", "error", err)
+	}
+
+	sm.stop(sm.Logger)
+	sm.Logger.Info("Reverse proxy exited.")
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"aliyun/serverless/webide-server/pkg/vscode"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	InitPhasePending      = "pending"      // the initializer is not called yet
+	InitPhaseInitializing = "initializing" // the vscode server is being started
+	InitPhaseReady        = "ready"        // the requests are proxied to vscode server
+	InitPhaseFailed       = "failed"       // the initializer failed, see initError
+)
+
+// ManagerStatus is reported by /status.
+type ManagerStatus struct {
+	Phase               string                         `json:"phase"`
+	InitStartTime       time.Time                      `json:"initStartTime,omitempty"`
+	InitEndTime         time.Time                      `json:"initEndTime,omitempty"`
+	InitDurationSeconds float64                        `json:"initDurationSeconds"`
+	InitError           string                         `json:"initError,omitempty"`
+	Server              *vscode.ServerStatus           `json:"server,omitempty"` // single user mode
+	Users               map[string]vscode.ServerStatus `json:"users,omitempty"`  // multi-user mode
+}
+
+var unavailablePage = template.Must(template.New("unavailable").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="3">
+<title>Web IDE</title>
+<style>
+body { font-family: sans-serif; text-align: center; margin-top: 20vh; color: #444; }
+.error { color: #c62828; }
+</style>
+</head>
+<body>
+{{if .Error}}
+<h2>Web IDE failed to start</h2>
+<p class="error">{{.Error}}</p>
+{{else}}
+<h2>Web IDE is starting ...</h2>
+<p>This page refreshes automatically.</p>
+{{end}}
+</body>
+</html>
+`))
+
+// startInit enters the initializing phase unless the init is in progress or done, whose phase is returned.
+func (sm *ServerManager) startInit() (string, bool) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.phase == InitPhaseInitializing || sm.phase == InitPhaseReady {
+		return sm.phase, false
+	}
+	sm.phase = InitPhaseInitializing
+	sm.initErr = nil
+	sm.initStartTime = time.Now()
+	sm.initEndTime = time.Time{}
+	return sm.phase, true
+}
+
+// setPhase updates the init phase.
+func (sm *ServerManager) setPhase(phase string, err error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.phase = phase
+	sm.initErr = err
+	if phase == InitPhaseInitializing {
+		sm.initStartTime = time.Now()
+		sm.initEndTime = time.Time{}
+	} else {
+		sm.initEndTime = time.Now()
+	}
+}
+
+// unavailable responds 503 before init completes, with a page refreshing itself for the browsers.
+func (sm *ServerManager) unavailable(w http.ResponseWriter, r *http.Request) {
+	sm.mu.RLock()
+	initErr := sm.initErr
+	sm.mu.RUnlock()
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", "3")
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "vscode server is not initialized")
+		return
+	}
+
+	data := struct{ Error string }{}
+	if initErr != nil {
+		data.Error = initErr.Error()
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if err := unavailablePage.Execute(w, data); err != nil {
+		slog.Error("Render unavailable page failed.", "error", err)
+	}
+}
+
+// healthz reports the proxy server is alive.
+func (sm *ServerManager) healthz() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "ok")
+	}
+}
+
+// readyz reports whether the requests can be served, i.e. init completed and vscode server is running.
+func (sm *ServerManager) readyz() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sm.mu.RLock()
+		phase, server := sm.phase, sm.VscodeServer
+		sm.mu.RUnlock()
+
+		if phase != InitPhaseReady {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "init %s", phase)
+			return
+		}
+		if server != nil && !server.Running() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, "vscode server is not running")
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "ok")
+	}
+}
+
+// status reports the init phase and the states of the vscode servers in json.
+func (sm *ServerManager) status() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sm.mu.RLock()
+		status := ManagerStatus{
+			Phase:         sm.phase,
+			InitStartTime: sm.initStartTime,
+			InitEndTime:   sm.initEndTime,
+		}
+		if sm.initErr != nil {
+			status.InitError = sm.initErr.Error()
+		}
+		if !sm.initStartTime.IsZero() {
+			end := sm.initEndTime
+			if end.IsZero() {
+				end = time.Now()
+			}
+			status.InitDurationSeconds = end.Sub(sm.initStartTime).Seconds()
+		}
+		users, server := sm.Users, sm.VscodeServer
+		sm.mu.RUnlock()
+
+		if server != nil {
+			serverStatus := server.Status()
+			status.Server = &serverStatus
+		}
+		if users != nil {
+			status.Users = users.Status()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(status)
+	}
+}
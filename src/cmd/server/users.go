@@ -0,0 +1,262 @@
+package main
+
+import (
+	"aliyun/serverless/webide-server/pkg/context"
+	"aliyun/serverless/webide-server/pkg/vscode"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// validUserId restricts the user ids, which are used in the local directories and the storage paths.
+var validUserId = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// userServer is the vscode server of a user.
+type userServer struct {
+	user   string
+	port   int
+	ready  chan struct{} // closed when the server is started or failed to start
+	err    error         // the start error, valid after ready is closed
+	server *vscode.Server
+	proxy  *httputil.ReverseProxy
+
+	// stopped is created when the idle server is being stopped, and closed after it is stopped.
+	// The server is kept in the router meanwhile, so its port and directories are not reused. Guarded by UserRouter.mu.
+	stopped chan struct{}
+
+	active     int64 // number of the in-flight requests, including the websocket connections
+	lastActive int64 // unix nano time of the last finished request
+}
+
+// UserRouter routes the requests to the per-user vscode servers in multi-user mode.
+// The servers are started on the first request of the users, and stopped after idle for IdleTimeout.
+type UserRouter struct {
+	Header      string        // request header carrying the authenticated user id
+	BasePort    int           // the first port allocated to the vscode servers
+	MaxUsers    int           // max number of the concurrent running servers
+	IdleTimeout time.Duration // stop the server after no request for this duration
+	Logger      *slog.Logger
+
+	ctx     *context.Context
+	opts    []vscode.ServerOption // options applied to every server
+	mu      sync.Mutex
+	servers map[string]*userServer
+}
+
+// NewUserRouter creates the router. ctx and opts are used to create the vscode servers.
+func NewUserRouter(ctx *context.Context, header string, basePort int, maxUsers int, idleTimeout time.Duration, opts ...vscode.ServerOption) *UserRouter {
+	r := &UserRouter{
+		Header:      header,
+		BasePort:    basePort,
+		MaxUsers:    maxUsers,
+		IdleTimeout: idleTimeout,
+		Logger:      slog.Default(),
+		ctx:         ctx,
+		opts:        opts,
+		servers:     map[string]*userServer{},
+	}
+	if idleTimeout > 0 {
+		go r.reap()
+	}
+	return r
+}
+
+// User returns the user id of the request.
+func (r *UserRouter) User(req *http.Request) (string, error) {
+	user := req.Header.Get(r.Header)
+	if user == "" {
+		return "", fmt.Errorf("missing user identity header %s", r.Header)
+	}
+	if !validUserId.MatchString(user) {
+		return "", fmt.Errorf("invalid user id: %q", user)
+	}
+	return user, nil
+}
+
+// Acquire returns the started server of the user, starting it if necessary.
+// If the server of the user is being stopped, a new one is started after it is stopped.
+// The caller must call release when the request is finished, the server is not stopped before that.
+func (r *UserRouter) Acquire(user string) (us *userServer, release func(), err error) {
+	r.mu.Lock()
+	us, ok := r.servers[user]
+	for ok && us.stopped != nil {
+		stopped := us.stopped
+		r.mu.Unlock()
+		<-stopped
+		r.mu.Lock()
+		us, ok = r.servers[user]
+	}
+	if !ok {
+		port, err := r.allocatePort()
+		if err != nil {
+			r.mu.Unlock()
+			return nil, nil, err
+		}
+		us = &userServer{user: user, port: port, ready: make(chan struct{})}
+		r.servers[user] = us
+		go r.start(us)
+	}
+	// Mark the server active before releasing the lock, so the reaper does not stop it.
+	atomic.AddInt64(&us.active, 1)
+	r.mu.Unlock()
+
+	release = func() {
+		atomic.StoreInt64(&us.lastActive, time.Now().UnixNano())
+		atomic.AddInt64(&us.active, -1)
+	}
+
+	<-us.ready
+	if us.err != nil {
+		release()
+		return nil, nil, us.err
+	}
+	return us, release, nil
+}
+
+// allocatePort returns the lowest free port, r.mu must be held.
+func (r *UserRouter) allocatePort() (int, error) {
+	if r.MaxUsers > 0 && len(r.servers) >= r.MaxUsers {
+		return 0, fmt.Errorf("too many users, at most %d users are served", r.MaxUsers)
+	}
+	used := map[int]bool{}
+	for _, us := range r.servers {
+		used[us.port] = true
+	}
+	port := r.BasePort
+	for used[port] {
+		port++
+	}
+	return port, nil
+}
+
+// start starts the vscode server of the user.
+func (r *UserRouter) start(us *userServer) {
+	defer close(us.ready)
+	r.Logger.Info("Starting vscode server ...", "user", us.user, "port", us.port)
+
+	opts := append([]vscode.ServerOption{vscode.WithUser(us.user), vscode.WithPort(strconv.Itoa(us.port))}, r.opts...)
+	server, err := vscode.NewServer(r.ctx, opts...)
+	if err == nil {
+		var target *url.URL
+		if target, err = url.Parse("http://" + server.Host + ":" + server.Port); err == nil {
+			us.server = server
+			us.proxy = httputil.NewSingleHostReverseProxy(target)
+		}
+	}
+	if err != nil {
+		r.Logger.Error("Start vscode server failed.", "user", us.user, "error", err)
+		us.err = err
+		// Forget the failed server, so the next request retries.
+		r.mu.Lock()
+		delete(r.servers, us.user)
+		r.mu.Unlock()
+		return
+	}
+	r.Logger.Info("Start vscode server succeeded.", "user", us.user)
+}
+
+// reap stops the idle servers periodically.
+func (r *UserRouter) reap() {
+	interval := r.IdleTimeout / 4
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	for range time.Tick(interval) {
+		for _, us := range r.idleServers() {
+			r.Logger.Info("Stopping idle vscode server ...", "user", us.user)
+			us.server.Shutdown()
+
+			r.mu.Lock()
+			if r.servers[us.user] == us {
+				delete(r.servers, us.user)
+			}
+			close(us.stopped)
+			r.mu.Unlock()
+		}
+	}
+}
+
+// idleServers marks the idle servers stopping and returns them. They are removed from the router after stopped.
+func (r *UserRouter) idleServers() []*userServer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var idle []*userServer
+	for _, us := range r.servers {
+		select {
+		case <-us.ready:
+		default:
+			continue // still starting
+		}
+		if us.err != nil || us.stopped != nil || atomic.LoadInt64(&us.active) > 0 {
+			continue
+		}
+		if time.Since(time.Unix(0, atomic.LoadInt64(&us.lastActive))) < r.IdleTimeout {
+			continue
+		}
+		us.stopped = make(chan struct{})
+		idle = append(idle, us)
+	}
+	return idle
+}
+
+// Shutdown stops all the servers, and waits for the idle ones being stopped.
+func (r *UserRouter) Shutdown() {
+	r.mu.Lock()
+	servers := r.servers
+	r.servers = map[string]*userServer{}
+	stopping := map[*userServer]chan struct{}{}
+	for _, us := range servers {
+		if us.stopped != nil {
+			stopping[us] = us.stopped
+		}
+	}
+	r.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, us := range servers {
+		wg.Add(1)
+		go func(us *userServer) {
+			defer wg.Done()
+			if stopped, ok := stopping[us]; ok {
+				<-stopped
+				return
+			}
+			<-us.ready
+			if us.err == nil {
+				us.server.Shutdown()
+			}
+		}(us)
+	}
+	wg.Wait()
+}
+
+// Status returns the states of the started servers by the users.
+func (r *UserRouter) Status() map[string]vscode.ServerStatus {
+	r.mu.Lock()
+	servers := make([]*userServer, 0, len(r.servers))
+	for _, us := range r.servers {
+		servers = append(servers, us)
+	}
+	r.mu.Unlock()
+
+	status := map[string]vscode.ServerStatus{}
+	for _, us := range servers {
+		select {
+		case <-us.ready:
+			if us.err == nil {
+				status[us.user] = us.server.Status()
+			}
+		default:
+			// Still starting.
+		}
+	}
+	return status
+}
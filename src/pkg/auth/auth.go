@@ -0,0 +1,260 @@
+// Package auth authenticates the requests before they are forwarded to vscode server.
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	ModeNone     = "none"     // no authentication, e.g. behind a trusted authenticating proxy
+	ModeToken    = "token"    // vscode server connection token, also required by the webide-server endpoints
+	ModePassword = "password" // a shared password entered in the login page
+	ModeOIDC     = "oidc"     // OpenID Connect authorization code flow
+
+	TokenCookie   = "vscode-tkn" // the cookie used by vscode server for the connection token
+	TokenParam    = "tkn"        // the query parameter used by vscode server for the connection token
+	SessionCookie = "webide-session"
+
+	LoginPath    = "/login"
+	LogoutPath   = "/logout"
+	CallbackPath = "/oauth2/callback"
+)
+
+// Authenticator is a http middleware which rejects the unauthenticated requests.
+type Authenticator struct {
+	Mode       string
+	Token      string                     // connection token in token mode
+	Password   string                     // shared password in password mode
+	SessionTTL time.Duration              // lifetime of the session cookies
+	Exempt     []string                   // paths served without authentication, e.g. the probes
+	Trusted    func(r *http.Request) bool // reports whether r is served without authentication, e.g. the FC lifecycle callbacks
+	UserHeader string                     // in multi-user mode, the header set to the authenticated user id, which requires oidc mode
+
+	sessions *sessionCodec
+	oidc     *oidcProvider
+}
+
+// New creates the authenticator from the auth configurations.
+func New() (*Authenticator, error) {
+	viper.SetDefault("auth.mode", ModeNone)
+	viper.SetDefault("auth.token", "")
+	viper.SetDefault("auth.password", "")
+	viper.SetDefault("auth.sessionSecret", "")
+	viper.SetDefault("auth.sessionTtl", "12h")
+
+	a := &Authenticator{
+		Mode:       viper.GetString("auth.mode"),
+		Token:      viper.GetString("auth.token"),
+		Password:   viper.GetString("auth.password"),
+		SessionTTL: viper.GetDuration("auth.sessionTtl"),
+	}
+	// The secrets can be passed by the environment variables instead of the config file.
+	if token := os.Getenv("WEBIDE_TOKEN"); token != "" {
+		a.Token = token
+	}
+	if password := os.Getenv("WEBIDE_PASSWORD"); password != "" {
+		a.Password = password
+	}
+	secret := viper.GetString("auth.sessionSecret")
+	if s := os.Getenv("WEBIDE_SESSION_SECRET"); s != "" {
+		secret = s
+	}
+
+	switch a.Mode {
+	case ModeNone:
+		return a, nil
+	case ModeToken:
+		if a.Token == "" {
+			return nil, fmt.Errorf("auth.token is required in %s mode", a.Mode)
+		}
+		return a, nil
+	case ModePassword:
+		if a.Password == "" {
+			return nil, fmt.Errorf("auth.password is required in %s mode", a.Mode)
+		}
+	case ModeOIDC:
+		oidc, err := newOidcProvider()
+		if err != nil {
+			return nil, err
+		}
+		a.oidc = oidc
+	default:
+		return nil, fmt.Errorf("unsupported auth mode: %s", a.Mode)
+	}
+
+	key := []byte(secret)
+	if secret == "" {
+		// The sessions are invalidated when the process restarts, and not shared by the instances.
+		slog.Warn("auth.sessionSecret is not set, a random one is generated.")
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	a.sessions = &sessionCodec{key: key}
+	return a, nil
+}
+
+// Handler wraps next with the authentication.
+func (a *Authenticator) Handler(next http.Handler) http.Handler {
+	if a.Mode == ModeNone {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, p := range a.Exempt {
+			if r.URL.Path == p {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		if a.Trusted != nil && a.Trusted(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// The user header is only set from the session, never passed through from the client.
+		if a.UserHeader != "" {
+			r.Header.Del(a.UserHeader)
+		}
+
+		switch a.Mode {
+		case ModeToken:
+			a.serveToken(w, r, next)
+		case ModePassword, ModeOIDC:
+			a.serveSession(w, r, next)
+		}
+	})
+}
+
+// serveToken accepts the requests carrying the connection token in the query, the cookie or the bearer header.
+// The token is also checked by vscode server, it is checked here for the webide-server endpoints.
+func (a *Authenticator) serveToken(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	if token := r.URL.Query().Get(TokenParam); token != "" && equal(token, a.Token) {
+		http.SetCookie(w, &http.Cookie{
+			Name: TokenCookie, Value: token, Path: "/", HttpOnly: true, Secure: isHttps(r), SameSite: http.SameSiteLaxMode,
+		})
+		next.ServeHTTP(w, r)
+		return
+	}
+	if c, err := r.Cookie(TokenCookie); err == nil && equal(c.Value, a.Token) {
+		next.ServeHTTP(w, r)
+		return
+	}
+	if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); token != "" && equal(token, a.Token) {
+		next.ServeHTTP(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+	fmt.Fprint(w, "invalid or missing connection token")
+}
+
+// serveSession serves the login flow, and accepts the requests with a valid session cookie.
+func (a *Authenticator) serveSession(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	switch r.URL.Path {
+	case LoginPath:
+		if a.Mode == ModeOIDC {
+			a.oidcLogin(w, r)
+		} else {
+			a.passwordLogin(w, r)
+		}
+		return
+	case LogoutPath:
+		http.SetCookie(w, &http.Cookie{Name: SessionCookie, Value: "", Path: "/", MaxAge: -1})
+		http.Redirect(w, r, LoginPath, http.StatusFound)
+		return
+	case CallbackPath:
+		if a.Mode == ModeOIDC {
+			a.oidcCallback(w, r)
+			return
+		}
+	}
+
+	session, err := a.session(r)
+	if err != nil {
+		a.unauthorized(w, r)
+		return
+	}
+	if a.UserHeader != "" && session.User != "" {
+		// The user id comes from the identity provider, never from the client.
+		r.Header.Set(a.UserHeader, session.User)
+	}
+	next.ServeHTTP(w, r)
+}
+
+// session returns the valid session of the request. The sessions of oidc mode always have the user.
+func (a *Authenticator) session(r *http.Request) (*Session, error) {
+	c, err := r.Cookie(SessionCookie)
+	if err != nil {
+		return nil, err
+	}
+	session, err := a.sessions.decode(c.Value)
+	if err != nil {
+		return nil, err
+	}
+	if a.Mode == ModeOIDC && session.User == "" {
+		return nil, ErrInvalidCookie
+	}
+	return session, nil
+}
+
+// setSession issues the session cookie for the user.
+func (a *Authenticator) setSession(w http.ResponseWriter, r *http.Request, user string) error {
+	expiry := time.Now().Add(a.SessionTTL)
+	value, err := a.sessions.encode(&Session{User: user, Expiry: expiry.Unix()})
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name: SessionCookie, Value: value, Path: "/", Expires: expiry,
+		HttpOnly: true, Secure: isHttps(r), SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// unauthorized redirects the browser page loads to the login page, and rejects the others.
+func (a *Authenticator) unauthorized(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, LoginPath+"?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+		return
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+	fmt.Fprint(w, "unauthorized")
+}
+
+// redirectTarget returns the local path to redirect to after login, which must not point to other sites.
+func redirectTarget(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+func isHttps(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// equal compares the secrets in constant time.
+func equal(a, b string) bool {
+	ha, hb := sha256.Sum256([]byte(a)), sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
+
+// randomString returns a random hex string, used for the oauth2 state and nonce.
+func randomString() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
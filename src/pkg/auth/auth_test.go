@@ -0,0 +1,204 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionCodec(t *testing.T) {
+	c := &sessionCodec{key: []byte("secret")}
+	value, err := c.encode(&Session{User: "alice", Expiry: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatalf("unable to encode session: %v", err)
+	}
+	session, err := c.decode(value)
+	if err != nil || session.User != "alice" {
+		t.Fatalf("expected session of alice, but got %+v, error: %v", session, err)
+	}
+
+	// Signed by another key.
+	if _, err = (&sessionCodec{key: []byte("other")}).decode(value); err != ErrInvalidCookie {
+		t.Fatalf("expected %v, but got %v", ErrInvalidCookie, err)
+	}
+	// Modified payload.
+	forged, _ := (&sessionCodec{key: []byte("other")}).encode(&Session{User: "bob", Expiry: time.Now().Add(time.Hour).Unix()})
+	payload, _, _ := strings.Cut(forged, ".")
+	_, sig, _ := strings.Cut(value, ".")
+	if _, err = c.decode(payload + "." + sig); err != ErrInvalidCookie {
+		t.Fatalf("expected %v, but got %v", ErrInvalidCookie, err)
+	}
+	// Expired.
+	expired, _ := c.encode(&Session{Expiry: time.Now().Add(-time.Minute).Unix()})
+	if _, err = c.decode(expired); err != ErrExpired {
+		t.Fatalf("expected %v, but got %v", ErrExpired, err)
+	}
+	// Signed for another purpose.
+	state, _ := c.sign(purposeOidcState, &oidcState{State: "s", Expiry: time.Now().Add(time.Hour).Unix()})
+	if _, err = c.decode(state); err != ErrInvalidCookie {
+		t.Fatalf("expected %v, but got %v", ErrInvalidCookie, err)
+	}
+}
+
+func TestOidcSession(t *testing.T) {
+	var user string
+	a := &Authenticator{
+		Mode:       ModeOIDC,
+		UserHeader: "X-Webide-User",
+		sessions:   &sessionCodec{key: []byte("key")},
+		oidc:       &oidcProvider{},
+	}
+	handler := a.Handler(okHandler(&user))
+
+	expiry := time.Now().Add(time.Hour).Unix()
+	state, _ := a.sessions.sign(purposeOidcState, &oidcState{State: "s", Nonce: "n", Next: "/", Expiry: expiry})
+	anonymous, _ := a.sessions.encode(&Session{Expiry: expiry})
+	alice, _ := a.sessions.encode(&Session{User: "alice", Expiry: expiry})
+	cases := []struct {
+		name   string
+		value  string
+		status int
+	}{
+		{"state cookie", state, http.StatusUnauthorized},
+		{"session without user", anonymous, http.StatusUnauthorized},
+		{"session of alice", alice, http.StatusOK},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: SessionCookie, Value: c.value})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != c.status {
+			t.Fatalf("%s: expected status %d, but got %d", c.name, c.status, w.Code)
+		}
+	}
+	if user != "alice" {
+		t.Fatalf("expected user alice, but got %q", user)
+	}
+}
+
+func TestRedirectTarget(t *testing.T) {
+	cases := map[string]string{
+		"/?folder=/workspace": "/?folder=/workspace",
+		"":                    "/",
+		"https://evil.com":    "/",
+		"//evil.com":          "/",
+		"/\\evil.com":         "/",
+	}
+	for next, expected := range cases {
+		if got := redirectTarget(next); got != expected {
+			t.Fatalf("redirectTarget(%q): expected %q, but got %q", next, expected, got)
+		}
+	}
+}
+
+// okHandler records the user header of the authenticated requests.
+func okHandler(user *string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*user = r.Header.Get("X-Webide-User")
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+func TestTokenMode(t *testing.T) {
+	var user string
+	a := &Authenticator{
+		Mode: ModeToken, Token: "s3cret", Exempt: []string{"/healthz"},
+		Trusted: func(r *http.Request) bool { return r.Header.Get("x-fc-control-path") == r.URL.Path },
+	}
+	handler := a.Handler(okHandler(&user))
+	trusted := httptest.NewRequest("POST", "/pre-stop", nil)
+	trusted.Header.Set("x-fc-control-path", "/pre-stop")
+
+	cookie := httptest.NewRequest("GET", "/progress", nil)
+	cookie.AddCookie(&http.Cookie{Name: TokenCookie, Value: "s3cret"})
+	bearer := httptest.NewRequest("GET", "/progress", nil)
+	bearer.Header.Set("Authorization", "Bearer s3cret")
+
+	cases := []struct {
+		name   string
+		req    *http.Request
+		status int
+	}{
+		{"no token", httptest.NewRequest("GET", "/", nil), http.StatusUnauthorized},
+		{"wrong token", httptest.NewRequest("GET", "/?tkn=wrong", nil), http.StatusUnauthorized},
+		{"query token", httptest.NewRequest("GET", "/?tkn=s3cret", nil), http.StatusOK},
+		{"cookie token", cookie, http.StatusOK},
+		{"bearer token", bearer, http.StatusOK},
+		{"exempt", httptest.NewRequest("GET", "/healthz", nil), http.StatusOK},
+		{"trusted", trusted, http.StatusOK},
+		{"untrusted", httptest.NewRequest("POST", "/pre-stop", nil), http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, c.req)
+		if w.Code != c.status {
+			t.Fatalf("%s: expected status %d, but got %d", c.name, c.status, w.Code)
+		}
+	}
+}
+
+func TestPasswordMode(t *testing.T) {
+	var user string
+	a := &Authenticator{
+		Mode:       ModePassword,
+		Password:   "s3cret",
+		SessionTTL: time.Hour,
+		UserHeader: "X-Webide-User",
+		sessions:   &sessionCodec{key: []byte("key")},
+	}
+	handler := a.Handler(okHandler(&user))
+
+	// The page loads are redirected to the login page.
+	req := httptest.NewRequest("GET", "/?folder=/workspace", nil)
+	req.Header.Set("Accept", "text/html")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/login?next="+url.QueryEscape("/?folder=/workspace") {
+		t.Fatalf("expected redirect to login page, but got %d %s", w.Code, w.Header().Get("Location"))
+	}
+
+	login := func(password string) *httptest.ResponseRecorder {
+		form := url.Values{"password": {password}, "next": {"/?folder=/workspace"}}
+		req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	if w = login("wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d for wrong password, but got %d", http.StatusUnauthorized, w.Code)
+	}
+	w = login("s3cret")
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/?folder=/workspace" {
+		t.Fatalf("expected redirect to the next page, but got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != SessionCookie || !cookies[0].HttpOnly {
+		t.Fatalf("expected http only session cookie, but got %+v", cookies)
+	}
+
+	// The session is accepted, and the user header from the client is removed, the session has no user.
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookies[0])
+	req.Header.Set("X-Webide-User", "bob")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || user != "" {
+		t.Fatalf("expected status %d and no user, but got %d %q", http.StatusOK, w.Code, user)
+	}
+
+	// The user header is overridden by the user of the session.
+	value, _ := a.sessions.encode(&Session{User: "alice", Expiry: time.Now().Add(time.Hour).Unix()})
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: SessionCookie, Value: value})
+	req.Header.Set("X-Webide-User", "bob")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || user != "alice" {
+		t.Fatalf("expected status %d and user alice, but got %d %q", http.StatusOK, w.Code, user)
+	}
+}
@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// loginFailureDelay slows down the password guessing.
+const loginFailureDelay = time.Second
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Web IDE</title>
+<style>
+body { font-family: sans-serif; display: flex; justify-content: center; margin-top: 15vh; }
+form { display: flex; flex-direction: column; gap: 12px; width: 280px; }
+input { padding: 8px; font-size: 14px; }
+.error { color: #c62828; }
+</style>
+</head>
+<body>
+<form method="POST" action="/login">
+<h2>Web IDE</h2>
+{{if .Error}}<div class="error">{{.Error}}</div>{{end}}
+<input type="hidden" name="next" value="{{.Next}}">
+<input type="password" name="password" placeholder="Password" autofocus required>
+<input type="submit" value="Log in">
+</form>
+</body>
+</html>
+`))
+
+type loginData struct {
+	Next  string
+	Error string
+}
+
+// passwordLogin shows the login page, and issues the session cookie if the password is correct.
+func (a *Authenticator) passwordLogin(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		a.renderLogin(w, http.StatusOK, loginData{Next: redirectTarget(r.URL.Query().Get("next"))})
+	case http.MethodPost:
+		next := redirectTarget(r.PostFormValue("next"))
+		if !equal(r.PostFormValue("password"), a.Password) {
+			slog.Warn("Login failed.", "remoteAddr", r.RemoteAddr)
+			time.Sleep(loginFailureDelay)
+			a.renderLogin(w, http.StatusUnauthorized, loginData{Next: next, Error: "Incorrect password."})
+			return
+		}
+		if err := a.setSession(w, r, ""); err != nil {
+			slog.Error("Create session failed.", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		slog.Info("Login succeeded.", "remoteAddr", r.RemoteAddr)
+		http.Redirect(w, r, next, http.StatusFound)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *Authenticator) renderLogin(w http.ResponseWriter, status int, data loginData) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := loginPage.Execute(w, data); err != nil {
+		slog.Error("Render login page failed.", "error", err)
+	}
+}
@@ -0,0 +1,208 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/spf13/viper"
+	"golang.org/x/oauth2"
+)
+
+const (
+	stateCookie = "webide-oidc"
+	stateTTL    = 10 * time.Minute
+)
+
+// oidcProvider implements the OpenID Connect authorization code flow.
+type oidcProvider struct {
+	Issuer       string
+	ClientId     string
+	ClientSecret string
+	RedirectUrl  string   // the absolute url of CallbackPath registered in the identity provider
+	Scopes       []string // requested scopes, must include openid
+	UserClaim    string   // the id token claim used as the user id
+	AllowedUsers []string // the users allowed to log in, empty allows every authenticated user
+
+	// The provider is discovered on the first login instead of the startup,
+	// so an unreachable identity provider does not prevent the proxy from starting.
+	mu       sync.Mutex
+	config   *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// oidcState is kept in a signed cookie between the login redirect and the callback.
+type oidcState struct {
+	State  string `json:"s"`
+	Nonce  string `json:"n"`
+	Next   string `json:"r"`
+	Expiry int64  `json:"e"`
+}
+
+func newOidcProvider() (*oidcProvider, error) {
+	viper.SetDefault("auth.oidc.scopes", []string{oidc.ScopeOpenID, "profile", "email"})
+	viper.SetDefault("auth.oidc.userClaim", "preferred_username")
+
+	p := &oidcProvider{
+		Issuer:       viper.GetString("auth.oidc.issuer"),
+		ClientId:     viper.GetString("auth.oidc.clientId"),
+		ClientSecret: viper.GetString("auth.oidc.clientSecret"),
+		RedirectUrl:  viper.GetString("auth.oidc.redirectUrl"),
+		Scopes:       viper.GetStringSlice("auth.oidc.scopes"),
+		UserClaim:    viper.GetString("auth.oidc.userClaim"),
+		AllowedUsers: viper.GetStringSlice("auth.oidc.allowedUsers"),
+	}
+	if secret := os.Getenv("WEBIDE_OIDC_CLIENT_SECRET"); secret != "" {
+		p.ClientSecret = secret
+	}
+	if p.Issuer == "" || p.ClientId == "" || p.RedirectUrl == "" {
+		return nil, errors.New("auth.oidc.issuer, auth.oidc.clientId and auth.oidc.redirectUrl are required in oidc mode")
+	}
+	return p, nil
+}
+
+// discover fetches the provider metadata once it succeeds.
+func (p *oidcProvider) discover(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.config != nil {
+		return p.config, p.verifier, nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, p.Issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	p.config = &oauth2.Config{
+		ClientID:     p.ClientId,
+		ClientSecret: p.ClientSecret,
+		RedirectURL:  p.RedirectUrl,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       p.Scopes,
+	}
+	p.verifier = provider.Verifier(&oidc.Config{ClientID: p.ClientId})
+	slog.Info("Discover OIDC provider succeeded.", "issuer", p.Issuer)
+	return p.config, p.verifier, nil
+}
+
+// allowed returns whether the user is allowed to log in.
+func (p *oidcProvider) allowed(user string) bool {
+	if len(p.AllowedUsers) == 0 {
+		return true
+	}
+	for _, u := range p.AllowedUsers {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcLogin redirects to the identity provider.
+func (a *Authenticator) oidcLogin(w http.ResponseWriter, r *http.Request) {
+	config, _, err := a.oidc.discover(r.Context())
+	if err != nil {
+		slog.Error("Discover OIDC provider failed.", "issuer", a.oidc.Issuer, "error", err)
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprint(w, "identity provider is unavailable")
+		return
+	}
+
+	state := &oidcState{Next: redirectTarget(r.URL.Query().Get("next")), Expiry: time.Now().Add(stateTTL).Unix()}
+	if state.State, err = randomString(); err == nil {
+		state.Nonce, err = randomString()
+	}
+	var value string
+	if err == nil {
+		value, err = a.sessions.sign(purposeOidcState, state)
+	}
+	if err != nil {
+		slog.Error("Create OIDC state failed.", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name: stateCookie, Value: value, Path: CallbackPath, MaxAge: int(stateTTL.Seconds()),
+		HttpOnly: true, Secure: isHttps(r), SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, config.AuthCodeURL(state.State, oidc.Nonce(state.Nonce)), http.StatusFound)
+}
+
+// oidcCallback exchanges the authorization code, verifies the id token and issues the session cookie.
+func (a *Authenticator) oidcCallback(w http.ResponseWriter, r *http.Request) {
+	user, next, err := a.oidcUser(w, r)
+	if err != nil {
+		slog.Warn("OIDC login failed.", "remoteAddr", r.RemoteAddr, "error", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "login failed")
+		return
+	}
+	if err = a.setSession(w, r, user); err != nil {
+		slog.Error("Create session failed.", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	slog.Info("OIDC login succeeded.", "user", user)
+	http.Redirect(w, r, next, http.StatusFound)
+}
+
+// oidcUser returns the authenticated user and the page to redirect to.
+func (a *Authenticator) oidcUser(w http.ResponseWriter, r *http.Request) (user string, next string, err error) {
+	c, err := r.Cookie(stateCookie)
+	if err != nil {
+		return "", "", errors.New("missing state cookie")
+	}
+	http.SetCookie(w, &http.Cookie{Name: stateCookie, Value: "", Path: CallbackPath, MaxAge: -1})
+	state := &oidcState{}
+	if err = a.sessions.verify(purposeOidcState, c.Value, state); err != nil {
+		return "", "", err
+	}
+	if time.Now().Unix() > state.Expiry {
+		return "", "", ErrExpired
+	}
+	if !equal(r.URL.Query().Get("state"), state.State) {
+		return "", "", errors.New("state mismatch")
+	}
+	if e := r.URL.Query().Get("error"); e != "" {
+		return "", "", fmt.Errorf("%s: %s", e, r.URL.Query().Get("error_description"))
+	}
+
+	config, verifier, err := a.oidc.discover(r.Context())
+	if err != nil {
+		return "", "", err
+	}
+	token, err := config.Exchange(r.Context(), r.URL.Query().Get("code"))
+	if err != nil {
+		return "", "", fmt.Errorf("exchange code: %w", err)
+	}
+	rawIdToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return "", "", errors.New("missing id token")
+	}
+	idToken, err := verifier.Verify(r.Context(), rawIdToken)
+	if err != nil {
+		return "", "", fmt.Errorf("verify id token: %w", err)
+	}
+	if !equal(idToken.Nonce, state.Nonce) {
+		return "", "", errors.New("nonce mismatch")
+	}
+
+	claims := map[string]interface{}{}
+	if err = idToken.Claims(&claims); err != nil {
+		return "", "", err
+	}
+	user, _ = claims[a.oidc.UserClaim].(string)
+	if user == "" {
+		return "", "", fmt.Errorf("missing claim %s in id token", a.oidc.UserClaim)
+	}
+	if !a.oidc.allowed(user) {
+		return "", "", fmt.Errorf("user %s is not allowed", user)
+	}
+	return user, state.Next, nil
+}
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidCookie = errors.New("invalid cookie signature")
+	ErrExpired       = errors.New("cookie expired")
+)
+
+// Session is the authenticated state kept in the signed session cookie.
+type Session struct {
+	User   string `json:"u,omitempty"` // the user id from the identity provider, empty in password mode
+	Expiry int64  `json:"e"`           // unix time after which the session is invalid
+}
+
+// The purposes of the signed cookies. The purpose is part of the signed data, so a cookie signed for
+// one purpose, e.g. the oidc state, is never accepted for another one, e.g. as a session.
+const (
+	purposeSession   = "session"
+	purposeOidcState = "oidc-state"
+)
+
+// sessionCodec signs the cookie values with HMAC-SHA256, so they can not be forged or modified by the clients.
+// The format is base64(json) + "." + base64(hmac(purpose + "." + base64(json))).
+type sessionCodec struct {
+	key []byte
+}
+
+func (c *sessionCodec) encode(session *Session) (string, error) {
+	return c.sign(purposeSession, session)
+}
+
+func (c *sessionCodec) decode(value string) (*Session, error) {
+	session := &Session{}
+	if err := c.verify(purposeSession, value, session); err != nil {
+		return nil, err
+	}
+	if time.Now().Unix() > session.Expiry {
+		return nil, ErrExpired
+	}
+	return session, nil
+}
+
+// sign encodes v as json and signs it for the purpose.
+func (c *sessionCodec) sign(purpose string, v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(c.mac(purpose, payload)), nil
+}
+
+// verify checks the signature for the purpose and decodes the json into v.
+func (c *sessionCodec) verify(purpose string, value string, v interface{}) error {
+	payload, sig, ok := strings.Cut(value, ".")
+	if !ok {
+		return ErrInvalidCookie
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, c.mac(purpose, payload)) {
+		return ErrInvalidCookie
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return ErrInvalidCookie
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (c *sessionCodec) mac(purpose string, payload string) []byte {
+	h := hmac.New(sha256.New, c.key)
+	h.Write([]byte(purpose + "." + payload))
+	return h.Sum(nil)
+}
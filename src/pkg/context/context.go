@@ -1,60 +1,109 @@
 package context
 
 import (
+	"aliyun/serverless/webide-server/pkg/logging"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
 )
 
+const (
+	SourceFc    = "fc"    // the FC runtime, the context is parsed from the request headers
+	SourceEnv   = "env"   // VM or container, the context is parsed from the environment variables
+	SourceLocal = "local" // local development, no cloud service is used
+)
+
 // Context represents the infromation provided by the runtime, such as FC, docker container and etc.
 type Context struct {
-	AccountId       string
-	AccessKeyId     string
-	AccessKeySecret string
-	SecurityToken   string
-	Region          string
+	Source      string
+	AccountId   string
+	Region      string
+	Credentials *CredentialCache // the credentials chain configured by credentials.providers, refreshed before expiry. nil in local source
+	Fc          *FcProvider      // the credentials passed by FC runtime, updated by the requests. nil outside FC
+}
+
+// String describes the context without the credentials, so the context is safe to be printed
+// in the logs and the errors, even by %+v.
+func (ctx Context) String() string {
+	credentials := "<nil>"
+	if ctx.Credentials != nil || ctx.Fc != nil {
+		credentials = logging.Redacted
+	}
+	return fmt.Sprintf("{Source:%s AccountId:%s Region:%s Credentials:%s}", ctx.Source, ctx.AccountId, ctx.Region, credentials)
+}
+
+func (ctx Context) GoString() string {
+	return ctx.String()
+}
+
+// LogValue logs the context without the credentials.
+func (ctx Context) LogValue() slog.Value {
+	return slog.GroupValue(slog.String("source", ctx.Source), slog.String("accountId", ctx.AccountId), slog.String("region", ctx.Region))
 }
 
 // Init the context from FC context.
 func New(request *http.Request) (*Context, error) {
 	ctx := &Context{
-		AccessKeyId:     request.Header.Get("x-fc-access-key-id"),
-		AccessKeySecret: request.Header.Get("x-fc-access-key-secret"),
-		SecurityToken:   request.Header.Get("x-fc-security-token"),
-		Region:          request.Header.Get("x-fc-region"),
+		Source: SourceFc,
+		Region: request.Header.Get("x-fc-region"),
+		Fc:     &FcProvider{},
 	}
+	ctx.Fc.Update(request.Header)
 
-	if ctx.AccessKeyId == "" {
-		return nil, fmt.Errorf("can not get access key id from fc runtime. Please make sure you already granted OSS permission to your FC function")
-	}
-	if ctx.AccessKeySecret == "" {
-		return nil, fmt.Errorf("can not get access key secret from fc runtime. Please make sure you already granted OSS permission to your FC function")
-	}
 	if ctx.Region == "" {
 		return nil, fmt.Errorf("can not get region from fc runtime. Please make sure you already granted OSS permission to your FC function")
 	}
+	if err := ctx.initCredentials(); err != nil {
+		return nil, fmt.Errorf("can not get credentials from fc runtime. Please make sure you already granted OSS permission to your FC function. Error: %w", err)
+	}
 
 	return ctx, nil
 }
 
+// UpdateFc updates the FC credentials by the request headers. The FC credentials never expire in the cache,
+// so the cached ones are dropped once FC passes new ones, e.g. the refreshed STS token.
+func (ctx *Context) UpdateFc(header http.Header) {
+	if ctx.Fc == nil || !ctx.Fc.Update(header) {
+		return
+	}
+	if ctx.Credentials != nil {
+		ctx.Credentials.Invalidate()
+	}
+}
+
 // For test only.
 func NewFromEnvVars() (*Context, error) {
 	ctx := &Context{
-		AccessKeyId:     os.Getenv("ALI_KEY_ID"),
-		AccessKeySecret: os.Getenv("ALI_KEY_SECRET"),
-		SecurityToken:   os.Getenv("ALI_SECURITY_TOKEN"),
-		Region:          os.Getenv("ALI_REGION"),
+		Source: SourceEnv,
+		Region: os.Getenv("ALI_REGION"),
 	}
 
-	if ctx.AccessKeyId == "" {
-		return nil, fmt.Errorf("can not get access key id from environment variable")
-	}
-	if ctx.AccessKeySecret == "" {
-		return nil, fmt.Errorf("can not get access key secret from environment variable")
-	}
 	if ctx.Region == "" {
 		return nil, fmt.Errorf("can not get region from environment variable")
 	}
+	if err := ctx.initCredentials(); err != nil {
+		return nil, fmt.Errorf("can not get credentials from environment variable or the other providers. Error: %w", err)
+	}
 
 	return ctx, nil
 }
+
+// NewLocal creates the context for local development, which has neither region nor credentials.
+// The data is stored in the local storage, so the server runs offline.
+func NewLocal() *Context {
+	return &Context{Source: SourceLocal}
+}
+
+// initCredentials creates the credentials chain, and makes sure the credentials are available.
+func (ctx *Context) initCredentials() error {
+	credentials, err := newCredentials(ctx.Fc)
+	if err != nil {
+		return err
+	}
+	if _, err = credentials.Get(); err != nil {
+		return err
+	}
+	ctx.Credentials = credentials
+	return nil
+}
@@ -0,0 +1,392 @@
+package context
+
+import (
+	"aliyun/serverless/webide-server/pkg/logging"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/viper"
+	"gopkg.in/ini.v1"
+)
+
+const (
+	ProviderFc         = "fc"         // the credentials in the FC request headers
+	ProviderEnv        = "env"        // the credentials in the environment variables
+	ProviderFile       = "file"       // the credentials file of the alibaba cloud sdks
+	ProviderEcsRamRole = "ecsRamRole" // the RAM role credentials from the ECS instance metadata
+	ProviderStatic     = "static"     // the credentials in the config file
+
+	// DefaultRefreshBefore is how long before the expiration the credentials are refreshed.
+	DefaultRefreshBefore = 5 * time.Minute
+
+	ecsMetadataEndpoint = "http://100.100.100.200/latest/meta-data/ram/security-credentials/"
+	// fileRecheckInterval is how often the credentials file is read again, which may be rotated by others.
+	fileRecheckInterval = 5 * time.Minute
+)
+
+var ErrNoCredentials = errors.New("no credentials")
+
+// Credentials is an access key, with the security token if it is a STS token.
+type Credentials struct {
+	AccessKeyId     string
+	AccessKeySecret string
+	SecurityToken   string
+	Expiration      time.Time // zero if the credentials never expire
+}
+
+// String describes the credentials with the secret and the token redacted.
+func (c Credentials) String() string {
+	return fmt.Sprintf("{AccessKeyId:%s AccessKeySecret:%s SecurityToken:%s Expiration:%s}",
+		c.AccessKeyId, redacted(c.AccessKeySecret), redacted(c.SecurityToken), c.Expiration)
+}
+
+func (c Credentials) GoString() string {
+	return c.String()
+}
+
+// LogValue logs the credentials without the secret and the token.
+func (c Credentials) LogValue() slog.Value {
+	return slog.GroupValue(slog.String("accessKeyId", c.AccessKeyId), slog.Time("expiration", c.Expiration))
+}
+
+// redacted masks the non-empty secret, an empty one is kept to tell it is missing.
+func redacted(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return logging.Redacted
+}
+
+// CredentialProvider retrieves the credentials from a source.
+type CredentialProvider interface {
+	// Retrieve returns the current credentials, or an error if the source has no credentials.
+	Retrieve() (*Credentials, error)
+}
+
+// StaticProvider returns the fixed credentials.
+type StaticProvider struct {
+	Credentials Credentials
+}
+
+func (p *StaticProvider) Retrieve() (*Credentials, error) {
+	if p.Credentials.AccessKeyId == "" || p.Credentials.AccessKeySecret == "" {
+		return nil, ErrNoCredentials
+	}
+	c := p.Credentials
+	return &c, nil
+}
+
+// FcProvider returns the credentials passed by FC runtime in the request headers.
+// FC passes the latest credentials in every request, so they are updated by the requests
+// and never expire while the instance serves the requests.
+type FcProvider struct {
+	mu          sync.Mutex
+	credentials Credentials
+}
+
+// Update updates the credentials if the headers contain them, and reports whether they are changed.
+func (p *FcProvider) Update(header http.Header) bool {
+	c := Credentials{
+		AccessKeyId:     header.Get("x-fc-access-key-id"),
+		AccessKeySecret: header.Get("x-fc-access-key-secret"),
+		SecurityToken:   header.Get("x-fc-security-token"),
+	}
+	if c.AccessKeyId == "" || c.AccessKeySecret == "" {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	changed := c != p.credentials
+	p.credentials = c
+	return changed
+}
+
+// String describes the credentials with the secret and the token redacted, which are unexported fields
+// printed by %+v otherwise.
+func (p *FcProvider) String() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.credentials.String()
+}
+
+func (p *FcProvider) GoString() string {
+	return p.String()
+}
+
+func (p *FcProvider) Retrieve() (*Credentials, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.credentials.AccessKeyId == "" {
+		return nil, ErrNoCredentials
+	}
+	c := p.credentials
+	return &c, nil
+}
+
+// EnvProvider returns the credentials in the environment variables
+// ALIBABA_CLOUD_ACCESS_KEY_ID, ALIBABA_CLOUD_ACCESS_KEY_SECRET and ALIBABA_CLOUD_SECURITY_TOKEN,
+// or ALI_KEY_ID, ALI_KEY_SECRET and ALI_SECURITY_TOKEN.
+type EnvProvider struct{}
+
+func (p *EnvProvider) Retrieve() (*Credentials, error) {
+	for _, names := range [][3]string{
+		{"ALIBABA_CLOUD_ACCESS_KEY_ID", "ALIBABA_CLOUD_ACCESS_KEY_SECRET", "ALIBABA_CLOUD_SECURITY_TOKEN"},
+		{"ALI_KEY_ID", "ALI_KEY_SECRET", "ALI_SECURITY_TOKEN"},
+	} {
+		c := &Credentials{AccessKeyId: os.Getenv(names[0]), AccessKeySecret: os.Getenv(names[1]), SecurityToken: os.Getenv(names[2])}
+		if c.AccessKeyId != "" && c.AccessKeySecret != "" {
+			return c, nil
+		}
+	}
+	return nil, ErrNoCredentials
+}
+
+// FileProvider returns the credentials of a profile in the ini credentials file used by the alibaba cloud sdks, e.g.
+//
+//	[default]
+//	type = access_key
+//	access_key_id = <id>
+//	access_key_secret = <secret>
+//
+// The type sts with security_token is also supported. The file is read again every few minutes.
+type FileProvider struct {
+	Path    string
+	Profile string
+}
+
+func (p *FileProvider) Retrieve() (*Credentials, error) {
+	path, err := homedir.Expand(p.Path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = os.Stat(path); os.IsNotExist(err) {
+		return nil, ErrNoCredentials
+	}
+	file, err := ini.Load(path)
+	if err != nil {
+		return nil, fmt.Errorf("load credentials file %s: %w", path, err)
+	}
+	section, err := file.GetSection(p.Profile)
+	if err != nil {
+		return nil, fmt.Errorf("profile %s not found in credentials file %s", p.Profile, path)
+	}
+
+	c := &Credentials{
+		AccessKeyId:     section.Key("access_key_id").String(),
+		AccessKeySecret: section.Key("access_key_secret").String(),
+		Expiration:      time.Now().Add(fileRecheckInterval),
+	}
+	switch t := section.Key("type").MustString("access_key"); t {
+	case "access_key":
+	case "sts":
+		c.SecurityToken = section.Key("security_token").String()
+	default:
+		return nil, fmt.Errorf("unsupported credentials type %s in profile %s", t, p.Profile)
+	}
+	if c.AccessKeyId == "" || c.AccessKeySecret == "" {
+		return nil, fmt.Errorf("access_key_id or access_key_secret is missing in profile %s", p.Profile)
+	}
+	return c, nil
+}
+
+// EcsRamRoleProvider returns the STS token of the RAM role attached to the ECS instance from the instance metadata.
+type EcsRamRoleProvider struct {
+	RoleName string // discovered from the metadata if empty
+	Endpoint string // the metadata endpoint, ecsMetadataEndpoint if empty
+	Client   *http.Client
+}
+
+func (p *EcsRamRoleProvider) Retrieve() (*Credentials, error) {
+	endpoint := p.Endpoint
+	if endpoint == "" {
+		endpoint = ecsMetadataEndpoint
+	}
+	client := p.Client
+	if client == nil {
+		// Fail fast outside ECS, where the metadata endpoint is unreachable.
+		client = &http.Client{Timeout: time.Second}
+	}
+
+	role := p.RoleName
+	if role == "" {
+		body, err := p.get(client, endpoint)
+		if err != nil {
+			return nil, err
+		}
+		role = strings.TrimSpace(strings.SplitN(string(body), "\n", 2)[0])
+		if role == "" {
+			return nil, ErrNoCredentials
+		}
+	}
+
+	body, err := p.get(client, endpoint+role)
+	if err != nil {
+		return nil, err
+	}
+	resp := struct {
+		Code            string
+		AccessKeyId     string
+		AccessKeySecret string
+		SecurityToken   string
+		Expiration      time.Time
+	}{}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("parse ecs ram role credentials: %w", err)
+	}
+	if resp.Code != "Success" || resp.AccessKeyId == "" {
+		return nil, fmt.Errorf("get ecs ram role %s credentials failed, code: %s", role, resp.Code)
+	}
+	return &Credentials{
+		AccessKeyId:     resp.AccessKeyId,
+		AccessKeySecret: resp.AccessKeySecret,
+		SecurityToken:   resp.SecurityToken,
+		Expiration:      resp.Expiration,
+	}, nil
+}
+
+func (p *EcsRamRoleProvider) get(client *http.Client, url string) ([]byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNoCredentials
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// ChainProvider returns the credentials of the first provider which has them.
+type ChainProvider struct {
+	Providers []CredentialProvider
+}
+
+func (p *ChainProvider) Retrieve() (*Credentials, error) {
+	var errs []string
+	for _, provider := range p.Providers {
+		c, err := provider.Retrieve()
+		if err == nil {
+			return c, nil
+		}
+		if !errors.Is(err, ErrNoCredentials) {
+			errs = append(errs, fmt.Sprintf("%T: %v", provider, err))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNoCredentials, strings.Join(errs, "; "))
+	}
+	return nil, ErrNoCredentials
+}
+
+// CredentialCache caches the credentials of the provider, and refreshes them RefreshBefore the expiration.
+// If the refresh fails, the cached credentials are used until they expire.
+type CredentialCache struct {
+	Provider      CredentialProvider
+	RefreshBefore time.Duration
+
+	mu          sync.Mutex
+	credentials *Credentials
+}
+
+// NewCredentialCache creates the cache of the provider.
+func NewCredentialCache(provider CredentialProvider, refreshBefore time.Duration) *CredentialCache {
+	return &CredentialCache{Provider: provider, RefreshBefore: refreshBefore}
+}
+
+// String describes the cache with the cached credentials redacted.
+func (c *CredentialCache) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	credentials := "<nil>"
+	if c.credentials != nil {
+		credentials = c.credentials.String()
+	}
+	return fmt.Sprintf("{Provider:%T RefreshBefore:%s Credentials:%s}", c.Provider, c.RefreshBefore, credentials)
+}
+
+func (c *CredentialCache) GoString() string {
+	return c.String()
+}
+
+// Get returns the valid credentials.
+func (c *CredentialCache) Get() (*Credentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.credentials != nil && !c.expiring(c.credentials, c.RefreshBefore) {
+		return c.credentials, nil
+	}
+	credentials, err := c.Provider.Retrieve()
+	if err != nil {
+		if c.credentials != nil && !c.expiring(c.credentials, 0) {
+			slog.Warn("Refresh credentials failed, use the cached ones.", "expiration", c.credentials.Expiration, "error", err)
+			return c.credentials, nil
+		}
+		return nil, err
+	}
+	if !credentials.Expiration.IsZero() {
+		slog.Info("Refresh credentials succeeded.", "expiration", credentials.Expiration)
+	}
+	c.credentials = credentials
+	return credentials, nil
+}
+
+// Invalidate drops the cached credentials, so the next Get retrieves them again.
+func (c *CredentialCache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.credentials = nil
+}
+
+func (c *CredentialCache) expiring(credentials *Credentials, within time.Duration) bool {
+	return !credentials.Expiration.IsZero() && time.Now().Add(within).After(credentials.Expiration)
+}
+
+// newCredentials creates the credentials chain from the config. fc is used for the fc provider, nil outside FC.
+func newCredentials(fc *FcProvider) (*CredentialCache, error) {
+	viper.SetDefault("credentials.providers", []string{ProviderFc, ProviderEnv, ProviderFile, ProviderEcsRamRole, ProviderStatic})
+	viper.SetDefault("credentials.file", "~/.alibabacloud/credentials")
+	viper.SetDefault("credentials.profile", "default")
+	viper.SetDefault("credentials.ecsRamRole", "")
+	viper.SetDefault("credentials.refreshBefore", DefaultRefreshBefore)
+
+	chain := &ChainProvider{}
+	for _, name := range viper.GetStringSlice("credentials.providers") {
+		switch name {
+		case ProviderFc:
+			if fc != nil {
+				chain.Providers = append(chain.Providers, fc)
+			}
+		case ProviderEnv:
+			chain.Providers = append(chain.Providers, &EnvProvider{})
+		case ProviderFile:
+			profile := viper.GetString("credentials.profile")
+			if p := os.Getenv("ALIBABA_CLOUD_PROFILE"); p != "" {
+				profile = p
+			}
+			chain.Providers = append(chain.Providers, &FileProvider{Path: viper.GetString("credentials.file"), Profile: profile})
+		case ProviderEcsRamRole:
+			chain.Providers = append(chain.Providers, &EcsRamRoleProvider{RoleName: viper.GetString("credentials.ecsRamRole")})
+		case ProviderStatic:
+			chain.Providers = append(chain.Providers, &StaticProvider{Credentials: Credentials{
+				AccessKeyId:     viper.GetString("credentials.accessKeyId"),
+				AccessKeySecret: viper.GetString("credentials.accessKeySecret"),
+			}})
+		default:
+			return nil, fmt.Errorf("unsupported credentials provider: %s", name)
+		}
+	}
+	return NewCredentialCache(chain, viper.GetDuration("credentials.refreshBefore")), nil
+}
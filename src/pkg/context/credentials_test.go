@@ -0,0 +1,223 @@
+package context
+
+import (
+	"aliyun/serverless/webide-server/pkg/logging"
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stsProvider issues a new token with the lifetime for every retrieve, like the STS service.
+type stsProvider struct {
+	lifetime time.Duration
+	issued   int
+	err      error
+}
+
+func (p *stsProvider) Retrieve() (*Credentials, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	p.issued++
+	return &Credentials{
+		AccessKeyId:     "STS.id",
+		AccessKeySecret: "secret",
+		SecurityToken:   fmt.Sprintf("token-%d", p.issued),
+		Expiration:      time.Now().Add(p.lifetime),
+	}, nil
+}
+
+func TestCredentialCacheRefresh(t *testing.T) {
+	provider := &stsProvider{lifetime: 200 * time.Millisecond}
+	cache := NewCredentialCache(provider, 100*time.Millisecond)
+
+	c, err := cache.Get()
+	if err != nil || c.SecurityToken != "token-1" {
+		t.Fatalf("expected token-1, but got %+v, error: %v", c, err)
+	}
+	if c, _ = cache.Get(); c.SecurityToken != "token-1" {
+		t.Fatalf("expected the cached token-1, but got %+v", c)
+	}
+
+	// The session outlives the token, which is refreshed before it expires.
+	time.Sleep(120 * time.Millisecond)
+	if c, _ = cache.Get(); c.SecurityToken != "token-2" {
+		t.Fatalf("expected the refreshed token-2, but got %+v", c)
+	}
+
+	// The refresh fails, the cached token is used until it expires.
+	provider.err = errors.New("sts unavailable")
+	time.Sleep(120 * time.Millisecond)
+	if c, err = cache.Get(); err != nil || c.SecurityToken != "token-2" {
+		t.Fatalf("expected the cached token-2, but got %+v, error: %v", c, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err = cache.Get(); err == nil {
+		t.Fatalf("expected error after the token expired")
+	}
+}
+
+func TestChainProvider(t *testing.T) {
+	fc := &FcProvider{}
+	chain := &ChainProvider{Providers: []CredentialProvider{
+		fc,
+		&StaticProvider{Credentials: Credentials{AccessKeyId: "static", AccessKeySecret: "secret"}},
+	}}
+	if c, err := chain.Retrieve(); err != nil || c.AccessKeyId != "static" {
+		t.Fatalf("expected the static credentials, but got %+v, error: %v", c, err)
+	}
+
+	header := http.Header{}
+	header.Set("x-fc-access-key-id", "fc")
+	header.Set("x-fc-access-key-secret", "secret")
+	header.Set("x-fc-security-token", "token")
+	fc.Update(header)
+	if c, err := chain.Retrieve(); err != nil || c.AccessKeyId != "fc" || c.SecurityToken != "token" {
+		t.Fatalf("expected the fc credentials, but got %+v, error: %v", c, err)
+	}
+
+	// The requests without the credentials do not clear them.
+	fc.Update(http.Header{})
+	if c, err := chain.Retrieve(); err != nil || c.AccessKeyId != "fc" {
+		t.Fatalf("expected the fc credentials, but got %+v, error: %v", c, err)
+	}
+
+	if _, err := (&ChainProvider{Providers: []CredentialProvider{&StaticProvider{}}}).Retrieve(); !errors.Is(err, ErrNoCredentials) {
+		t.Fatalf("expected %v, but got %v", ErrNoCredentials, err)
+	}
+}
+
+func TestFcCredentialsUpdate(t *testing.T) {
+	request := httptest.NewRequest("POST", "/initialize", nil)
+	request.Header.Set("x-fc-region", "cn-hangzhou")
+	request.Header.Set("x-fc-access-key-id", "STS.init")
+	request.Header.Set("x-fc-access-key-secret", "secret")
+	request.Header.Set("x-fc-security-token", "token-1")
+	ctx, err := New(request)
+	if err != nil {
+		t.Fatalf("unable to create context: %v", err)
+	}
+	if c, err := ctx.Credentials.Get(); err != nil || c.SecurityToken != "token-1" {
+		t.Fatalf("expected token-1, but got %+v, error: %v", c, err)
+	}
+
+	// FC passes the refreshed token in the later requests, e.g. /pre-stop.
+	header := http.Header{}
+	header.Set("x-fc-access-key-id", "STS.refreshed")
+	header.Set("x-fc-access-key-secret", "new-secret")
+	header.Set("x-fc-security-token", "token-2")
+	ctx.UpdateFc(header)
+	if c, err := ctx.Credentials.Get(); err != nil || c.AccessKeyId != "STS.refreshed" || c.SecurityToken != "token-2" {
+		t.Fatalf("expected the refreshed credentials, but got %+v, error: %v", c, err)
+	}
+}
+
+func TestFileProvider(t *testing.T) {
+	dir, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Fatalf("unable to create temporary dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "credentials")
+	content := `[default]
+type = access_key
+access_key_id = id
+access_key_secret = secret
+
+[dev]
+type = sts
+access_key_id = STS.id
+access_key_secret = secret
+security_token = token
+`
+	if err = os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+
+	if c, err := (&FileProvider{Path: path, Profile: "default"}).Retrieve(); err != nil || c.AccessKeyId != "id" || c.SecurityToken != "" {
+		t.Fatalf("unexpected default credentials %+v, error: %v", c, err)
+	}
+	if c, err := (&FileProvider{Path: path, Profile: "dev"}).Retrieve(); err != nil || c.SecurityToken != "token" {
+		t.Fatalf("unexpected dev credentials %+v, error: %v", c, err)
+	}
+	if _, err := (&FileProvider{Path: path, Profile: "missing"}).Retrieve(); err == nil {
+		t.Fatalf("expected error of the missing profile")
+	}
+	if _, err := (&FileProvider{Path: filepath.Join(dir, "missing"), Profile: "default"}).Retrieve(); !errors.Is(err, ErrNoCredentials) {
+		t.Fatalf("expected %v, but got %v", ErrNoCredentials, err)
+	}
+}
+
+func TestEcsRamRoleProvider(t *testing.T) {
+	expiration := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprint(w, "webide-role")
+		case "/webide-role":
+			fmt.Fprintf(w, `{"Code":"Success","AccessKeyId":"STS.id","AccessKeySecret":"secret","SecurityToken":"token","Expiration":"%s"}`,
+				expiration.Format(time.RFC3339))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	c, err := (&EcsRamRoleProvider{Endpoint: server.URL + "/"}).Retrieve()
+	if err != nil || c.SecurityToken != "token" || !c.Expiration.Equal(expiration) {
+		t.Fatalf("unexpected credentials %+v, error: %v", c, err)
+	}
+	if _, err = (&EcsRamRoleProvider{Endpoint: server.URL + "/", RoleName: "other"}).Retrieve(); !errors.Is(err, ErrNoCredentials) {
+		t.Fatalf("expected %v, but got %v", ErrNoCredentials, err)
+	}
+}
+
+func TestRedaction(t *testing.T) {
+	header := http.Header{}
+	header.Set("x-fc-access-key-id", "STS.id")
+	header.Set("x-fc-access-key-secret", "fc-secret")
+	header.Set("x-fc-security-token", "fc-token")
+	fc := &FcProvider{}
+	fc.Update(header)
+	ctx := &Context{
+		Source: SourceFc,
+		Region: "cn-hangzhou",
+		Credentials: NewCredentialCache(&ChainProvider{Providers: []CredentialProvider{
+			fc,
+			&StaticProvider{Credentials: Credentials{AccessKeyId: "id", AccessKeySecret: "static-secret", SecurityToken: "static-token"}},
+		}}, 0),
+		Fc: fc,
+	}
+	c, err := ctx.Credentials.Get()
+	if err != nil {
+		t.Fatalf("unable to get credentials: %v", err)
+	}
+
+	var buf bytes.Buffer
+	logger, _ := logging.New(&buf, logging.FormatJSON, slog.LevelDebug)
+	logger.Info("Context.", "ctx", ctx, "fc", fc, "credentials", c, "value", *ctx)
+	printed := buf.String()
+	for _, format := range []string{"%v", "%+v", "%#v", "%s"} {
+		printed += fmt.Sprintf(format, ctx) + fmt.Sprintf(format, *ctx) + fmt.Sprintf(format, ctx.Credentials) +
+			fmt.Sprintf(format, fc) + fmt.Sprintf(format, c) + fmt.Sprintf(format, *c)
+	}
+	for _, secret := range []string{"fc-secret", "fc-token", "static-secret", "static-token"} {
+		if strings.Contains(printed, secret) {
+			t.Fatalf("expected %s redacted, but got:\n%s", secret, printed)
+		}
+	}
+	for _, expected := range []string{"cn-hangzhou", "STS.id", logging.Redacted} {
+		if !strings.Contains(printed, expected) {
+			t.Fatalf("expected %s printed, but got:\n%s", expected, printed)
+		}
+	}
+}
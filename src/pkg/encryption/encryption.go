@@ -0,0 +1,243 @@
+// Package encryption implements the client-side envelope encryption of the persisted objects.
+//
+// Every object is encrypted with a random data key by AES-256-GCM in chunks, so objects of any size
+// are encrypted and decrypted as streams. The data key is encrypted by a master key of the KeyProvider
+// and stored in the object header, like the KMS GenerateDataKey and Decrypt APIs.
+//
+// An encrypted object is laid out as:
+//
+//	Magic | header length (uint32, big endian) | header (json) | chunk 0 | chunk 1 | ... | last chunk
+//
+// Each chunk is chunkSize bytes of plaintext sealed with a 16 bytes tag, except the last one which may
+// be shorter or empty. The nonce of a chunk is the random nonce prefix in the header, the chunk index
+// and a flag of the last chunk, so reordered, truncated or appended chunks fail the decryption.
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	Algorithm        = "AES-256-GCM"
+	DefaultChunkSize = 64 << 10 // plaintext bytes of a chunk
+	DataKeySize      = 32       // bytes of the AES-256 data key
+
+	noncePrefixSize = 7
+	maxHeaderSize   = 64 << 10
+	maxChunkSize    = 16 << 20
+)
+
+// Magic starts the encrypted objects. It never starts a gzip stream (0x1f 0x8b) or a snapshot manifest ('{').
+var Magic = []byte("WIDEENC\x01")
+
+var ErrDecrypt = errors.New("decrypt failed, the data is corrupted or the key is wrong")
+
+// IsEncrypted reports whether the data, usually the first bytes of an object, is encrypted.
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, Magic)
+}
+
+// header is stored in plaintext before the chunks.
+type header struct {
+	Algorithm   string `json:"algorithm"`
+	KeyId       string `json:"keyId"`   // the master key which encrypted the data key
+	DataKey     []byte `json:"dataKey"` // the encrypted data key
+	NoncePrefix []byte `json:"noncePrefix"`
+	ChunkSize   int    `json:"chunkSize"`
+}
+
+// nonce returns the nonce of the chunk.
+func (h *header) nonce(index uint32, last bool) []byte {
+	nonce := make([]byte, noncePrefixSize+5)
+	copy(nonce, h.NoncePrefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], index)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Writer encrypts the data written to it. Close must be called to write the last chunk.
+type Writer struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	h      *header
+	raw    []byte // the encoded header, authenticated with every chunk
+	buf    []byte
+	index  uint32
+	closed bool
+}
+
+// NewWriter returns the writer which encrypts the data to w with a new data key from keys.
+func NewWriter(w io.Writer, keys KeyProvider) (*Writer, error) {
+	return newWriter(w, keys, DefaultChunkSize)
+}
+
+func newWriter(w io.Writer, keys KeyProvider, chunkSize int) (*Writer, error) {
+	keyId, dataKey, encryptedKey, err := keys.GenerateDataKey()
+	if err != nil {
+		return nil, fmt.Errorf("generate data key: %w", err)
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	h := &header{Algorithm: Algorithm, KeyId: keyId, DataKey: encryptedKey, NoncePrefix: make([]byte, noncePrefixSize), ChunkSize: chunkSize}
+	if _, err = rand.Read(h.NoncePrefix); err != nil {
+		return nil, err
+	}
+	raw, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, len(Magic)+4)
+	copy(prefix, Magic)
+	binary.BigEndian.PutUint32(prefix[len(Magic):], uint32(len(raw)))
+	if _, err = w.Write(append(prefix, raw...)); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, aead: aead, h: h, raw: raw, buf: make([]byte, 0, chunkSize)}, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to closed encryption writer")
+	}
+	n := 0
+	for len(p) > 0 {
+		// The full chunk is sealed when more data comes, so the last chunk is known on Close.
+		if len(w.buf) == cap(w.buf) {
+			if err := w.seal(false); err != nil {
+				return n, err
+			}
+		}
+		c := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+// Close writes the last chunk. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.seal(true)
+}
+
+func (w *Writer) seal(last bool) error {
+	sealed := w.aead.Seal(nil, w.h.nonce(w.index, last), w.buf, w.raw)
+	w.index++
+	w.buf = w.buf[:0]
+	_, err := w.w.Write(sealed)
+	return err
+}
+
+// Reader decrypts the data read from an encrypted stream.
+type Reader struct {
+	r     *bufio.Reader
+	aead  cipher.AEAD
+	h     *header
+	raw   []byte
+	chunk []byte // the sealed chunk being read
+	buf   []byte // the decrypted data not read yet
+	index uint32
+	done  bool
+}
+
+// NewReader reads the header from r, and returns the reader of the decrypted data.
+// The data key is decrypted by keys.
+func NewReader(r io.Reader, keys KeyProvider) (*Reader, error) {
+	br := bufio.NewReader(r)
+	prefix := make([]byte, len(Magic)+4)
+	if _, err := io.ReadFull(br, prefix); err != nil || !IsEncrypted(prefix) {
+		return nil, errors.New("not an encrypted stream")
+	}
+	size := binary.BigEndian.Uint32(prefix[len(Magic):])
+	if size > maxHeaderSize {
+		return nil, fmt.Errorf("invalid encryption header size %d", size)
+	}
+	raw := make([]byte, size)
+	if _, err := io.ReadFull(br, raw); err != nil {
+		return nil, fmt.Errorf("read encryption header: %w", err)
+	}
+	h := &header{}
+	if err := json.Unmarshal(raw, h); err != nil {
+		return nil, fmt.Errorf("parse encryption header: %w", err)
+	}
+	if h.Algorithm != Algorithm || len(h.NoncePrefix) != noncePrefixSize || h.ChunkSize <= 0 || h.ChunkSize > maxChunkSize {
+		return nil, fmt.Errorf("unsupported encryption header: algorithm %s, chunk size %d", h.Algorithm, h.ChunkSize)
+	}
+
+	dataKey, err := keys.DecryptDataKey(h.KeyId, h.DataKey)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt data key of master key %s: %w", h.KeyId, err)
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{r: br, aead: aead, h: h, raw: raw, chunk: make([]byte, h.ChunkSize+aead.Overhead())}, nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next chunk.
+func (r *Reader) open() error {
+	n, err := io.ReadFull(r.r, r.chunk)
+	last := false
+	switch {
+	case err == io.ErrUnexpectedEOF || err == io.EOF:
+		// A short chunk is the last one. The missing last chunk fails the decryption below.
+		last = true
+	case err != nil:
+		return err
+	default:
+		if _, err = r.r.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	plain, err := r.aead.Open(r.chunk[:0], r.h.nonce(r.index, last), r.chunk[:n], r.raw)
+	if err != nil {
+		return ErrDecrypt
+	}
+	r.index++
+	r.buf, r.done = plain, last
+	return nil
+}
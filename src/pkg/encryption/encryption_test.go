@@ -0,0 +1,118 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+func newTestKeys(t *testing.T, keyId string, retired map[string][]byte) (*StaticKeyProvider, []byte) {
+	key := make([]byte, DataKeySize)
+	rand.Read(key)
+	keys, err := NewStaticKeyProvider(keyId, key, retired)
+	if err != nil {
+		t.Fatalf("unable to create key provider: %v", err)
+	}
+	return keys, key
+}
+
+func encrypt(t *testing.T, keys KeyProvider, data []byte, chunkSize int) []byte {
+	var buf bytes.Buffer
+	w, err := newWriter(&buf, keys, chunkSize)
+	if err != nil {
+		t.Fatalf("unable to create writer: %v", err)
+	}
+	// Write in small pieces to cross the chunk boundaries.
+	for len(data) > 0 {
+		n := 7
+		if n > len(data) {
+			n = len(data)
+		}
+		if _, err = w.Write(data[:n]); err != nil {
+			t.Fatalf("unable to write: %v", err)
+		}
+		data = data[n:]
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("unable to close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func decrypt(keys KeyProvider, data []byte) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(data), keys)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestRoundTrip(t *testing.T) {
+	keys, _ := newTestKeys(t, "default", nil)
+	for _, size := range []int{0, 1, 16, 17, 48, 100} {
+		data := make([]byte, size)
+		rand.Read(data)
+		encrypted := encrypt(t, keys, data, 16)
+		if !IsEncrypted(encrypted) {
+			t.Fatalf("size %d: expected the magic header", size)
+		}
+		if size >= 16 && bytes.Contains(encrypted, data[:16]) {
+			t.Fatalf("size %d: plaintext found in the encrypted data", size)
+		}
+		decrypted, err := decrypt(keys, encrypted)
+		if err != nil || !bytes.Equal(decrypted, data) {
+			t.Fatalf("size %d: unexpected decrypted data, error: %v", size, err)
+		}
+	}
+}
+
+func TestTampered(t *testing.T) {
+	keys, _ := newTestKeys(t, "default", nil)
+	data := make([]byte, 40)
+	encrypted := encrypt(t, keys, data, 16)
+	chunk := 16 + 16 // sealed chunk size
+	body := len(encrypted) - (chunk*2 + 8 + 16)
+
+	cases := map[string][]byte{
+		"flipped":         append([]byte{}, encrypted...),
+		"truncated":       encrypted[:len(encrypted)-1],
+		"last removed":    encrypted[:body+chunk*2],
+		"chunks swapped":  append(append(append([]byte{}, encrypted[:body]...), encrypted[body+chunk:body+chunk*2]...), encrypted[body:body+chunk]...),
+		"chunk appended":  append(append([]byte{}, encrypted...), encrypted[body:body+chunk]...),
+		"header modified": bytes.Replace(encrypted, []byte(`"chunkSize":16`), []byte(`"chunkSize":17`), 1),
+	}
+	cases["flipped"][len(encrypted)-20] ^= 1
+	for name, tampered := range cases {
+		if _, err := decrypt(keys, tampered); err == nil {
+			t.Fatalf("%s: expected the decryption failed", name)
+		}
+	}
+}
+
+func TestKeys(t *testing.T) {
+	old, oldKey := newTestKeys(t, "old", nil)
+	encrypted := encrypt(t, old, []byte("saved with the old key"), DefaultChunkSize)
+
+	// The data encrypted by the retired key is still readable after the rotation.
+	current, _ := newTestKeys(t, "current", map[string][]byte{"old": oldKey})
+	if data, err := decrypt(current, encrypted); err != nil || string(data) != "saved with the old key" {
+		t.Fatalf("unexpected data %q, error: %v", data, err)
+	}
+	if keyId, _, _, _ := current.GenerateDataKey(); keyId != "current" {
+		t.Fatalf("expected the data key encrypted by the current key, but got %s", keyId)
+	}
+
+	other, _ := newTestKeys(t, "current", nil)
+	if _, err := decrypt(other, encrypted); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected %v, but got %v", ErrKeyNotFound, err)
+	}
+	wrong, _ := newTestKeys(t, "old", nil)
+	if _, err := decrypt(wrong, encrypted); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("expected %v, but got %v", ErrDecrypt, err)
+	}
+	if _, err := NewStaticKeyProvider("short", []byte("short"), nil); err == nil {
+		t.Fatalf("expected the invalid key error")
+	}
+}
@@ -0,0 +1,128 @@
+package encryption
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	ProviderStatic = "static" // the master keys in the config file or the environment variable
+)
+
+var ErrKeyNotFound = errors.New("master key not found")
+
+// KeyProvider manages the master keys which encrypt the data keys, like a KMS service.
+// The master keys never leave the provider, only the data keys are encrypted and decrypted by them.
+type KeyProvider interface {
+	// GenerateDataKey returns a new data key in plaintext, and the one encrypted by the current master key keyId.
+	GenerateDataKey() (keyId string, plaintext []byte, encrypted []byte, err error)
+	// DecryptDataKey decrypts the data key encrypted by the master key keyId.
+	DecryptDataKey(keyId string, encrypted []byte) ([]byte, error)
+}
+
+// StaticKeyProvider encrypts the data keys by AES-256-GCM with the master keys in memory.
+type StaticKeyProvider struct {
+	KeyId string            // the current master key, which encrypts the new data keys
+	Keys  map[string][]byte // the 32 bytes master keys by id, including the retired ones which decrypt the old data
+}
+
+// NewStaticKeyProvider creates the provider with the current master key, and the retired ones by id.
+func NewStaticKeyProvider(keyId string, key []byte, retired map[string][]byte) (*StaticKeyProvider, error) {
+	p := &StaticKeyProvider{KeyId: keyId, Keys: map[string][]byte{}}
+	for id, k := range retired {
+		p.Keys[id] = k
+	}
+	p.Keys[keyId] = key
+	for id, k := range p.Keys {
+		if len(k) != DataKeySize {
+			return nil, fmt.Errorf("master key %s must be %d bytes, but got %d", id, DataKeySize, len(k))
+		}
+	}
+	return p, nil
+}
+
+func (p *StaticKeyProvider) GenerateDataKey() (string, []byte, []byte, error) {
+	aead, err := p.aead(p.KeyId)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	dataKey := make([]byte, DataKeySize)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(dataKey); err != nil {
+		return "", nil, nil, err
+	}
+	if _, err = rand.Read(nonce); err != nil {
+		return "", nil, nil, err
+	}
+	// nonce | sealed data key
+	return p.KeyId, dataKey, aead.Seal(nonce, nonce, dataKey, []byte(p.KeyId)), nil
+}
+
+func (p *StaticKeyProvider) DecryptDataKey(keyId string, encrypted []byte) ([]byte, error) {
+	aead, err := p.aead(keyId)
+	if err != nil {
+		return nil, err
+	}
+	if len(encrypted) < aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	nonce, sealed := encrypted[:aead.NonceSize()], encrypted[aead.NonceSize():]
+	dataKey, err := aead.Open(nil, nonce, sealed, []byte(keyId))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return dataKey, nil
+}
+
+func (p *StaticKeyProvider) aead(keyId string) (cipher.AEAD, error) {
+	key, ok := p.Keys[keyId]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, keyId)
+	}
+	return newAEAD(key)
+}
+
+// New creates the key provider configured by the `encryption` config items, or nil if the encryption is disabled.
+// The environment variable WEBIDE_ENCRYPTION_KEY overrides encryption.key.
+func New() (KeyProvider, error) {
+	viper.SetDefault("encryption.enabled", false)
+	viper.SetDefault("encryption.provider", ProviderStatic)
+	viper.SetDefault("encryption.keyId", "default")
+	viper.SetDefault("encryption.key", "")
+	viper.SetDefault("encryption.retiredKeys", map[string]string{})
+
+	if !viper.GetBool("encryption.enabled") {
+		return nil, nil
+	}
+	switch provider := viper.GetString("encryption.provider"); provider {
+	case ProviderStatic:
+		encoded := viper.GetString("encryption.key")
+		if key := os.Getenv("WEBIDE_ENCRYPTION_KEY"); key != "" {
+			encoded = key
+		}
+		if encoded == "" {
+			return nil, errors.New("encryption is enabled, but encryption.key or WEBIDE_ENCRYPTION_KEY is not set")
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("decode encryption key: %w", err)
+		}
+		retired := map[string][]byte{}
+		for id, encoded := range viper.GetStringMapString("encryption.retiredKeys") {
+			if retired[id], err = base64.StdEncoding.DecodeString(encoded); err != nil {
+				return nil, fmt.Errorf("decode retired encryption key %s: %w", id, err)
+			}
+		}
+		// The key ids are lower case, like the keys of encryption.retiredKeys read by viper.
+		return NewStaticKeyProvider(strings.ToLower(viper.GetString("encryption.keyId")), key, retired)
+	default:
+		return nil, fmt.Errorf("unsupported encryption key provider: %s", provider)
+	}
+}
@@ -0,0 +1,193 @@
+// Package ignore matches the paths against gitignore-style patterns.
+//
+// The patterns follow the syntax of .gitignore:
+//
+//   - Blank lines and the lines starting with # are ignored. \# and \! escape the leading # and !.
+//   - A leading ! negates the pattern, which re-includes the paths excluded by the previous patterns.
+//     A path inside an excluded directory can not be re-included.
+//   - A trailing / matches directories only.
+//   - A pattern with a / at the beginning or in the middle is relative to the root directory,
+//     otherwise it matches the name at any level.
+//   - * matches anything except /, ? matches any character except /, and [a-z] matches a character in the range.
+//   - ** matches any number of directories in the leading **/, the trailing /** and the middle /**/.
+//
+// The last pattern matching a path decides whether it is excluded.
+package ignore
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+)
+
+type rule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// Matcher matches the slash separated paths relative to the root directory.
+type Matcher struct {
+	rules []rule
+}
+
+// New compiles the patterns in order. The invalid patterns are logged and skipped, like git does.
+func New(patterns []string) *Matcher {
+	m := &Matcher{}
+	for _, p := range patterns {
+		r, ok := compile(p)
+		if !ok {
+			continue
+		}
+		m.rules = append(m.rules, r)
+	}
+	return m
+}
+
+// ReadFile reads the patterns from the ignore file, one per line. A missing file has no patterns.
+func ReadFile(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		patterns = append(patterns, strings.TrimSuffix(scanner.Text(), "\r"))
+	}
+	return patterns, scanner.Err()
+}
+
+// Empty reports whether the matcher has no patterns, so nothing is excluded.
+func (m *Matcher) Empty() bool {
+	return len(m.rules) == 0
+}
+
+// Match reports whether the path is excluded. isDir tells whether the path is a directory.
+// A path inside an excluded directory is excluded as well.
+func (m *Matcher) Match(path string, isDir bool) bool {
+	for i := 0; i < len(path); i++ {
+		if path[i] == '/' && m.match(path[:i], true) {
+			return true
+		}
+	}
+	return m.match(path, isDir)
+}
+
+// match reports whether the path is excluded by the last matching rule.
+func (m *Matcher) match(path string, isDir bool) bool {
+	for i := len(m.rules) - 1; i >= 0; i-- {
+		r := &m.rules[i]
+		if r.dirOnly && !isDir {
+			continue
+		}
+		if r.re.MatchString(path) {
+			return !r.negate
+		}
+	}
+	return false
+}
+
+// compile converts the pattern to the regular expression matching the whole path.
+func compile(pattern string) (rule, bool) {
+	r := rule{}
+	p := pattern
+	// The trailing spaces are ignored unless escaped.
+	for strings.HasSuffix(p, " ") && !strings.HasSuffix(p, `\ `) {
+		p = p[:len(p)-1]
+	}
+	if p == "" || p[0] == '#' {
+		return r, false
+	}
+	if p[0] == '!' {
+		r.negate, p = true, p[1:]
+	} else if strings.HasPrefix(p, `\!`) || strings.HasPrefix(p, `\#`) {
+		p = p[1:]
+	}
+	if strings.HasSuffix(p, "/") {
+		r.dirOnly, p = true, strings.TrimRight(p, "/")
+	}
+	anchored := strings.Contains(p, "/")
+	p = strings.TrimLeft(p, "/")
+	if p == "" {
+		return r, false
+	}
+
+	var b strings.Builder
+	b.WriteString("^")
+	if !anchored {
+		b.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(p); i++ {
+		switch c := p[i]; c {
+		case '*':
+			// ** is special only as a whole path component.
+			if i+1 < len(p) && p[i+1] == '*' && (i == 0 || p[i-1] == '/') && (i+2 == len(p) || p[i+2] == '/') {
+				if i+2 == len(p) {
+					b.WriteString(".*")
+				} else {
+					b.WriteString("(?:.*/)?")
+				}
+				i += 2
+				continue
+			}
+			b.WriteString("[^/]*")
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := classEnd(p, i)
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := p[i+1 : end]
+			if class[0] == '!' {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i = end
+		case '\\':
+			if i+1 < len(p) {
+				i++
+			}
+			b.WriteString(regexp.QuoteMeta(p[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		slog.Warn("Skip invalid ignore pattern.", "pattern", pattern, "error", err)
+		return r, false
+	}
+	r.re = re
+	return r, true
+}
+
+// classEnd returns the index of the ] closing the character class starting at p[start], or -1 if it is not closed.
+func classEnd(p string, start int) int {
+	i := start + 1
+	if i < len(p) && (p[i] == '!' || p[i] == '^') {
+		i++
+	}
+	// A ] right after the opening is a member of the class.
+	if i < len(p) && p[i] == ']' {
+		i++
+	}
+	for ; i < len(p); i++ {
+		if p[i] == ']' {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,86 @@
+package ignore
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		patterns []string
+		path     string
+		isDir    bool
+		expected bool
+	}{
+		// The names match at any level.
+		{[]string{"node_modules"}, "node_modules", true, true},
+		{[]string{"node_modules"}, "web/node_modules", true, true},
+		{[]string{"node_modules"}, "web/node_modules/react/index.js", false, true},
+		{[]string{"*.log"}, "logs/server.log", false, true},
+		{[]string{"*.log"}, "server.log.txt", false, false},
+		// Directories only.
+		{[]string{"target/"}, "target", true, true},
+		{[]string{"target/"}, "target", false, false},
+		{[]string{"target/"}, "target/classes/Main.class", false, true},
+		// Anchored to the root.
+		{[]string{"/build"}, "build", true, true},
+		{[]string{"/build"}, "app/build", true, false},
+		{[]string{"app/build"}, "app/build", true, true},
+		{[]string{"app/build"}, "src/app/build", true, false},
+		// Wildcards.
+		{[]string{"**/.cache"}, ".cache", true, true},
+		{[]string{"**/.cache"}, "a/b/.cache", true, true},
+		{[]string{"logs/**"}, "logs/a/b.txt", false, true},
+		{[]string{"logs/**"}, "logs", true, false},
+		{[]string{"a/**/b"}, "a/b", true, true},
+		{[]string{"a/**/b"}, "a/x/y/b", true, true},
+		{[]string{"a/*/b"}, "a/x/y/b", true, false},
+		{[]string{"file?.txt"}, "file1.txt", false, true},
+		{[]string{"file?.txt"}, "file10.txt", false, false},
+		{[]string{"[a-c].txt"}, "b.txt", false, true},
+		{[]string{"[!a-c].txt"}, "b.txt", false, false},
+		{[]string{"[!a-c].txt"}, "d.txt", false, true},
+		// Negation.
+		{[]string{"*.log", "!keep.log"}, "keep.log", false, false},
+		{[]string{"*.log", "!keep.log"}, "drop.log", false, true},
+		{[]string{"!keep.log", "*.log"}, "keep.log", false, true},
+		{[]string{"build/", "!build/keep.txt"}, "build/keep.txt", false, true},
+		// Comments, escapes and spaces.
+		{[]string{"# comment"}, "# comment", false, false},
+		{[]string{`\#file`}, "#file", false, true},
+		{[]string{`\!file`}, "!file", false, true},
+		{[]string{"file.txt   "}, "file.txt", false, true},
+		{[]string{`a\*b`}, "a*b", false, true},
+		{[]string{`a\*b`}, "axb", false, false},
+		{[]string{"[unclosed"}, "[unclosed", false, true},
+		{[]string{"", "/"}, "a", false, false},
+	}
+	for _, c := range cases {
+		if actual := New(c.patterns).Match(c.path, c.isDir); actual != c.expected {
+			t.Errorf("patterns %q, path %s (dir %v): expected %v, but got %v", c.patterns, c.path, c.isDir, c.expected, actual)
+		}
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	dir := t.TempDir()
+	if patterns, err := ReadFile(filepath.Join(dir, ".webideignore")); err != nil || patterns != nil {
+		t.Fatalf("expected no patterns of the missing file, but got %q, error: %v", patterns, err)
+	}
+	name := filepath.Join(dir, ".webideignore")
+	if err := os.WriteFile(name, []byte("# deps\r\nnode_modules/\n\n!keep\n"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	patterns, err := ReadFile(name)
+	if err != nil || !reflect.DeepEqual(patterns, []string{"# deps", "node_modules/", "", "!keep"}) {
+		t.Fatalf("unexpected patterns %q, error: %v", patterns, err)
+	}
+	if m := New(patterns); m.Empty() || !m.Match("node_modules", true) {
+		t.Fatalf("expected node_modules excluded")
+	}
+	if m := New([]string{"# only comments", ""}); !m.Empty() {
+		t.Fatalf("expected the empty matcher")
+	}
+}
@@ -0,0 +1,83 @@
+// Package logging creates the structured logger of webide-server.
+//
+// The records are written in JSON or logfmt. The attributes whose keys name credentials, e.g. accessKeySecret
+// or securityToken, are redacted by the handler, so a secret logged as an attribute never reaches the logs.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The output formats.
+const (
+	FormatJSON   = "json"   // one json object per line
+	FormatLogfmt = "logfmt" // key=value pairs per line
+)
+
+// RequestIdHeader carries the id of the request invoking the function in FC.
+const RequestIdHeader = "x-fc-request-id"
+
+// Redacted replaces the values of the credential attributes.
+const Redacted = "[REDACTED]"
+
+// sensitiveKeys are the lower-case substrings of the attribute keys whose values are redacted.
+var sensitiveKeys = []string{
+	"secret", "token", "password", "passwd", "credential", "authorization", "cookie", "privatekey", "masterkey",
+}
+
+// New creates the logger writing the records at level and above to w in format.
+func New(w io.Writer, format string, level slog.Leveler) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redact}
+	switch format {
+	case FormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case FormatLogfmt:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unsupported log format: %s", format)
+	}
+}
+
+// ParseLevel parses the level name, which is debug, info, warn or error.
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(name))
+	return level, err
+}
+
+// Sensitive reports whether the attribute key names a credential, whose value is redacted.
+func Sensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range sensitiveKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// redact is the ReplaceAttr of the handlers, which is called for the attributes in the groups as well.
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if a.Value.Kind() != slog.KindGroup && Sensitive(a.Key) {
+		return slog.String(a.Key, Redacted)
+	}
+	return a
+}
+
+// FromRequest returns the logger carrying the FC request id of r, or l itself if r has no request id.
+func FromRequest(l *slog.Logger, r *http.Request) *slog.Logger {
+	if id := r.Header.Get(RequestIdHeader); id != "" {
+		return l.With("requestId", id)
+	}
+	return l
+}
+
+// Duration returns the attribute of the seconds elapsed since start.
+func Duration(start time.Time) slog.Attr {
+	return slog.Float64("durationSeconds", time.Since(start).Seconds())
+}
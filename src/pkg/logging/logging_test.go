@@ -0,0 +1,87 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, FormatJSON, slog.LevelInfo)
+	if err != nil {
+		t.Fatalf("unable to create logger: %v", err)
+	}
+	logger.Debug("Hidden.")
+	logger.With("securityToken", "token-value").Info("Load succeeded.", "key", "workspace.tar.gz",
+		slog.Group("ctx", "AccessKeySecret", "secret-value", "region", "cn-hangzhou"),
+		"error", errors.New("failed"), Duration(time.Now()))
+
+	var record map[string]interface{}
+	if err = json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("expected a single json record, but got %q: %v", buf.String(), err)
+	}
+	if record["msg"] != "Load succeeded." || record["key"] != "workspace.tar.gz" || record["error"] != "failed" {
+		t.Fatalf("unexpected record: %v", record)
+	}
+	if record["securityToken"] != Redacted {
+		t.Fatalf("expected the token redacted, but got %v", record["securityToken"])
+	}
+	group, _ := record["ctx"].(map[string]interface{})
+	if group["AccessKeySecret"] != Redacted || group["region"] != "cn-hangzhou" {
+		t.Fatalf("unexpected group: %v", group)
+	}
+	if _, ok := record["durationSeconds"].(float64); !ok {
+		t.Fatalf("expected the duration in seconds, but got %v", record["durationSeconds"])
+	}
+	if strings.Contains(buf.String(), "-value") {
+		t.Fatalf("expected no credential in the logs: %s", buf.String())
+	}
+
+	buf.Reset()
+	logger, err = New(&buf, FormatLogfmt, slog.LevelDebug)
+	if err != nil {
+		t.Fatalf("unable to create logger: %v", err)
+	}
+	logger.Debug("Shown.", "password", "p", "user", "alice")
+	if expected := `level=DEBUG msg=Shown. password=[REDACTED] user=alice`; !strings.Contains(buf.String(), expected) {
+		t.Fatalf("expected %q in the logs, but got %q", expected, buf.String())
+	}
+
+	if _, err = New(&buf, "xml", slog.LevelInfo); err == nil {
+		t.Fatalf("expected the unsupported format refused")
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for name, expected := range map[string]slog.Level{
+		"debug": slog.LevelDebug, "info": slog.LevelInfo, "WARN": slog.LevelWarn, "error": slog.LevelError,
+	} {
+		if level, err := ParseLevel(name); err != nil || level != expected {
+			t.Fatalf("expected %s parsed to %s, but got %s, error: %v", name, expected, level, err)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Fatalf("expected the unknown level refused")
+	}
+}
+
+func TestFromRequest(t *testing.T) {
+	var buf bytes.Buffer
+	logger, _ := New(&buf, FormatLogfmt, slog.LevelInfo)
+
+	r := httptest.NewRequest("POST", "/initialize", nil)
+	FromRequest(logger, r).Info("Without id.")
+	r.Header.Set(RequestIdHeader, "1-62a8f1c2-abc")
+	FromRequest(logger, r).Info("With id.")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || strings.Contains(lines[0], "requestId") || !strings.HasSuffix(lines[1], "requestId=1-62a8f1c2-abc") {
+		t.Fatalf("unexpected logs: %q", lines)
+	}
+}
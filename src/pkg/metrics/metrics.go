@@ -0,0 +1,161 @@
+// Package metrics defines the Prometheus metrics of webide-server, which are exposed by Handler.
+// The labels never carry the user ids, the paths or the object keys, so the metrics are safe to be scraped
+// without the credentials of the users.
+package metrics
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// The init phases of a vscode server, in which a cold start spends its time.
+const (
+	PhaseContext       = "context"        // getting the context and the credentials
+	PhaseDataLoad      = "data_load"      // loading the vscode server data
+	PhaseWorkspaceLoad = "workspace_load" // loading the workspace, which continues after vscode server is ready
+	PhaseVscodeReady   = "vscode_ready"   // launching vscode server until it is listening
+)
+
+// The operations and the targets of the persistence metrics.
+const (
+	OperationSave = "save"
+	OperationLoad = "load"
+
+	TargetData      = "data"      // the vscode server data
+	TargetWorkspace = "workspace" // the workspace data
+)
+
+var (
+	ProxyRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "webide",
+		Subsystem: "proxy",
+		Name:      "requests_total",
+		Help:      "Number of the requests proxied to vscode server, including the websocket connections.",
+	}, []string{"code", "method"})
+	ProxyDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "webide",
+		Subsystem: "proxy",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of the requests proxied to vscode server, excluding the websocket connections.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"code", "method"})
+	WebsocketConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "webide",
+		Subsystem: "proxy",
+		Name:      "websocket_connections",
+		Help:      "Number of the active websocket connections proxied to vscode server.",
+	})
+	InitPhaseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "webide",
+		Subsystem: "init",
+		Name:      "phase_duration_seconds",
+		Help:      "Duration of the init phases of the vscode servers.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 14), // 50ms to 7min
+	}, []string{"phase"})
+	PersistenceDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "webide",
+		Subsystem: "persistence",
+		Name:      "duration_seconds",
+		Help:      "Duration of the saves and loads of the vscode server data and the workspace, including the failed ones.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 14),
+	}, []string{"operation", "target"})
+	PersistenceFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "webide",
+		Subsystem: "persistence",
+		Name:      "failures_total",
+		Help:      "Number of the failed saves and loads of the vscode server data and the workspace.",
+	}, []string{"operation", "target"})
+	ArchiveSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "webide",
+		Subsystem: "archive",
+		Name:      "size_bytes",
+		Help:      "Size of the compressed archives, or of the snapshot files in incremental mode, saved to or loaded from the storage.",
+		Buckets:   prometheus.ExponentialBuckets(64<<10, 4, 10), // 64KB to 16GB
+	}, []string{"operation"})
+	ProcessRestarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "webide",
+		Subsystem: "process",
+		Name:      "restarts_total",
+		Help:      "Number of the restarts of the crashed child processes.",
+	}, []string{"name"})
+)
+
+func init() {
+	prometheus.MustRegister(ProxyRequests, ProxyDuration, WebsocketConnections, InitPhaseDuration,
+		PersistenceDuration, PersistenceFailures, ArchiveSize, ProcessRestarts)
+}
+
+// Handler serves the metrics, including the go runtime and the process metrics.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ObserveInitPhase records the duration of the init phase started at start.
+func ObserveInitPhase(phase string, start time.Time) {
+	InitPhaseDuration.WithLabelValues(phase).Observe(time.Since(start).Seconds())
+}
+
+// ObservePersistence records the duration of the save or load of the target started at start, and its failure.
+func ObservePersistence(operation string, target string, start time.Time, err error) {
+	PersistenceDuration.WithLabelValues(operation, target).Observe(time.Since(start).Seconds())
+	if err != nil {
+		PersistenceFailures.WithLabelValues(operation, target).Inc()
+	}
+}
+
+// InstrumentProxy counts the requests served by next by the status code, and measures their latency.
+// The websocket connections are counted when closed, and tracked by WebsocketConnections while active,
+// but not measured, whose duration is the lifetime of the connection.
+func InstrumentProxy(next http.Handler) http.Handler {
+	timed := promhttp.InstrumentHandlerDuration(ProxyDuration, promhttp.InstrumentHandlerCounter(ProxyRequests, next))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWebsocket(r) {
+			timed.ServeHTTP(w, r)
+			return
+		}
+		WebsocketConnections.Inc()
+		defer WebsocketConnections.Dec()
+		rec := &upgradeRecorder{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		ProxyRequests.WithLabelValues(strconv.Itoa(rec.code), strings.ToLower(r.Method)).Inc()
+	})
+}
+
+func isWebsocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// upgradeRecorder records the status code of the upgrade requests. The switching protocols response is written
+// to the hijacked connection by the reverse proxy, so the code is recorded by Hijack.
+type upgradeRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (u *upgradeRecorder) WriteHeader(code int) {
+	u.code = code
+	u.ResponseWriter.WriteHeader(code)
+}
+
+func (u *upgradeRecorder) Flush() {
+	if f, ok := u.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (u *upgradeRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := u.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer does not support hijacking")
+	}
+	u.code = http.StatusSwitchingProtocols
+	return hj.Hijack()
+}
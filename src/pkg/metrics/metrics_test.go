@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInstrumentProxy(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWebsocket(r) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		// Switch protocols on the hijacked connection like the reverse proxy, then echo until closed.
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("unable to hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, brw)
+	})
+	server := httptest.NewServer(InstrumentProxy(handler))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/missing")
+	if err != nil {
+		t.Fatalf("unable to get: %v", err)
+	}
+	resp.Body.Close()
+	if n := testutil.ToFloat64(ProxyRequests.WithLabelValues("404", "get")); n != 1 {
+		t.Fatalf("expected 1 request with 404, but got %v", n)
+	}
+	if n := testutil.CollectAndCount(ProxyDuration); n != 1 {
+		t.Fatalf("expected the latency of 1 series, but got %d", n)
+	}
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatalf("unable to dial: %v", err)
+	}
+	conn.Write([]byte("GET /socket HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+	status, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || !strings.Contains(status, "101") {
+		t.Fatalf("expected switching protocols, but got %q, error: %v", status, err)
+	}
+	if n := testutil.ToFloat64(WebsocketConnections); n != 1 {
+		t.Fatalf("expected 1 websocket connection, but got %v", n)
+	}
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(WebsocketConnections) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := testutil.ToFloat64(WebsocketConnections); n != 0 {
+		t.Fatalf("expected no websocket connection, but got %v", n)
+	}
+	if n := testutil.ToFloat64(ProxyRequests.WithLabelValues("101", "get")); n != 1 {
+		t.Fatalf("expected 1 websocket request, but got %v", n)
+	}
+	// The websocket connections are not measured.
+	if n := testutil.CollectAndCount(ProxyDuration); n != 1 {
+		t.Fatalf("expected the latency of 1 series, but got %d", n)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	ObservePersistence(OperationSave, TargetWorkspace, time.Now(), nil)
+	ObservePersistence(OperationSave, TargetWorkspace, time.Now(), errors.New("failed"))
+	ObserveInitPhase(PhaseDataLoad, time.Now().Add(-time.Second))
+	if n := testutil.ToFloat64(PersistenceFailures.WithLabelValues(OperationSave, TargetWorkspace)); n != 1 {
+		t.Fatalf("expected 1 failure, but got %v", n)
+	}
+
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := recorder.Body.String()
+	for _, expected := range []string{
+		`webide_persistence_duration_seconds_count{operation="save",target="workspace"} 2`,
+		`webide_init_phase_duration_seconds_count{phase="data_load"} 1`,
+		"go_goroutines",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Fatalf("expected %q in the metrics:\n%s", expected, body)
+		}
+	}
+}
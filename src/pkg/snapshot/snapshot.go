@@ -0,0 +1,656 @@
+// Package snapshot implements the incremental, content-addressed persistence of a local directory.
+//
+// A snapshot consists of a manifest object and a set of blob objects. The manifest lists every
+// directory, regular file and symlink with its mode, size, modification time and the sha256 of its content,
+// or the target of the symlink.
+// The content of each file is stored gzip compressed as a blob object keyed by the hash, so a file
+// is uploaded only once no matter how many times it is saved, and loading only fetches the files
+// which are missing or different locally.
+package snapshot
+
+import (
+	"aliyun/serverless/webide-server/pkg/storage"
+	"aliyun/serverless/webide-server/pkg/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Format identifies the manifest format.
+const Format = "webide-snapshot/v1"
+
+// Manifest describes the content of a directory.
+type Manifest struct {
+	Format string `json:"format"`
+	Files  []File `json:"files"`
+}
+
+// File describes a directory, a regular file or a symlink in the manifest.
+type File struct {
+	Path    string      `json:"path"` // slash separated path relative to the root directory
+	Mode    fs.FileMode `json:"mode"`
+	Size    int64       `json:"size,omitempty"`
+	ModTime time.Time   `json:"mtime"`
+	Hash    string      `json:"hash,omitempty"` // sha256 of the content, empty for directories and symlinks
+	Link    string      `json:"link,omitempty"` // target of the symlink, which is kept as it is
+}
+
+// IsSymlink reports whether the file is a symlink.
+func (f *File) IsSymlink() bool {
+	return f.Mode&fs.ModeSymlink != 0
+}
+
+// Stats reports the work done by Save or Load.
+type Stats struct {
+	Files        int64 // number of regular files in the manifest
+	Bytes        int64 // total size of the regular files
+	Transferred  int64 // number of blobs uploaded or downloaded
+	TransferSize int64 // total size of the transferred files before compression
+}
+
+// IsManifest reports whether the data, usually the first bytes of an object, is a snapshot manifest.
+// Archives are binary (e.g. gzip starts with 0x1f 0x8b), while the manifest is a json object.
+func IsManifest(data []byte) bool {
+	data = bytes.TrimLeft(data, " \t\r\n")
+	return len(data) > 0 && data[0] == '{'
+}
+
+// BlobPrefix returns the prefix of the blob objects for the manifest stored at key, which is next to the manifest.
+// Every key has its own blobs, e.g. the workspaces of different users in the same directory share none.
+func BlobPrefix(key string) string {
+	return key + ".blobs/"
+}
+
+// DefaultCollectGrace is the default Syncer.Grace.
+const DefaultCollectGrace = time.Hour
+
+// Syncer saves and loads the snapshots of local directories.
+type Syncer struct {
+	Storage  storage.Backend
+	Parallel int           // max concurrent blob uploads or downloads
+	Logger   *slog.Logger  // slog.Default() by NewSyncer
+	Grace    time.Duration // blobs modified within it are never collected, DefaultCollectGrace by NewSyncer
+
+	mu   sync.Mutex
+	last map[string]*Manifest // the latest manifest seen for each key
+}
+
+// NewSyncer creates the syncer.
+func NewSyncer(backend storage.Backend, parallel int) *Syncer {
+	if parallel <= 0 {
+		parallel = 1
+	}
+	return &Syncer{Storage: backend, Parallel: parallel, Logger: slog.Default(), Grace: DefaultCollectGrace,
+		last: map[string]*Manifest{}}
+}
+
+// Option configures the saves.
+type Option func(*options)
+
+type options struct {
+	exclude func(path string, isDir bool) bool
+	skipped func(path string, files int64, bytes int64)
+}
+
+// WithExclude leaves out of the snapshot the entries for which exclude returns true.
+// The path is slash separated and relative to the saved directory, and the excluded directories are not walked into.
+func WithExclude(exclude func(path string, isDir bool) bool) Option {
+	return func(o *options) {
+		o.exclude = exclude
+	}
+}
+
+// WithSkipped reports each entry left out by WithExclude to fn, with the number and the total size of the regular files
+// it contains, which are the file itself for a regular file.
+func WithSkipped(fn func(path string, files int64, bytes int64)) Option {
+	return func(o *options) {
+		o.skipped = fn
+	}
+}
+
+// Save takes the snapshot of the local directory src and stores the manifest at key.
+// Only the blobs which are not in the storage yet are uploaded. Files whose size and modification
+// time are unchanged since the last known manifest are not hashed again.
+func (s *Syncer) Save(src string, key string, opts ...Option) (*Stats, error) {
+	stats, _, err := s.save(src, key, func(r io.Reader) (string, error) {
+		return "", s.Storage.Put(key, r)
+	}, opts)
+	return stats, err
+}
+
+// SaveIf is Save which stores the manifest only if the stored one is not changed since it had the ETag etag,
+// or does not exist if etag is empty, see storage.Backend.PutIf. It returns the ETag of the stored manifest.
+// The blobs are uploaded regardless, which are shared and never overwritten.
+func (s *Syncer) SaveIf(src string, key string, etag string, opts ...Option) (*Stats, string, error) {
+	return s.save(src, key, func(r io.Reader) (string, error) {
+		return s.Storage.PutIf(key, r, etag)
+	}, opts)
+}
+
+// save uploads the blobs of src, then stores the manifest at key by put.
+func (s *Syncer) save(src string, key string, put func(r io.Reader) (string, error), opts []Option) (*Stats, string, error) {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	prev := s.lastManifest(key)
+	known := map[string]*File{} // path -> file in the previous manifest
+	uploaded := map[string]bool{}
+	if prev != nil {
+		for i := range prev.Files {
+			f := &prev.Files[i]
+			known[f.Path] = f
+			if f.Hash != "" {
+				uploaded[f.Hash] = true
+			}
+		}
+	}
+
+	manifest := &Manifest{Format: Format}
+	err := filepath.Walk(src, func(p string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		if o.exclude != nil && o.exclude(filepath.ToSlash(rel), info.IsDir()) {
+			if o.skipped != nil {
+				files, bytes := usage(p)
+				o.skipped(filepath.ToSlash(rel), files, bytes)
+			}
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() && info.Mode()&fs.ModeSymlink == 0 {
+			s.Logger.Info("Skip unsupported file type.", "path", p, "mode", info.Mode().String())
+			return nil
+		}
+		f := File{Path: filepath.ToSlash(rel), Mode: info.Mode(), ModTime: info.ModTime()}
+		switch {
+		case info.Mode().IsRegular():
+			f.Size = info.Size()
+			if old, ok := known[f.Path]; ok && old.Size == f.Size && old.ModTime.Equal(f.ModTime) {
+				f.Hash = old.Hash
+			}
+		case f.IsSymlink():
+			// The symlinks are recorded as they are, which is not followed by Walk.
+			if f.Link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		manifest.Files = append(manifest.Files, f)
+		return nil
+	})
+	if err != nil {
+		s.Logger.Error("Walk directory failed.", "dir", src, "error", err)
+		return nil, "", err
+	}
+
+	stats := &Stats{}
+	blobPrefix := BlobPrefix(key)
+	var pending sync.Map // hash -> struct{}, avoids uploading the same content twice in one save
+	err = s.parallel(len(manifest.Files), func(i int) error {
+		f := &manifest.Files[i]
+		if f.Mode.IsDir() || f.IsSymlink() {
+			return nil
+		}
+		atomic.AddInt64(&stats.Files, 1)
+		atomic.AddInt64(&stats.Bytes, f.Size)
+
+		local := filepath.Join(src, filepath.FromSlash(f.Path))
+		if f.Hash == "" {
+			hash, err := hashFile(local)
+			if err != nil {
+				return err
+			}
+			f.Hash = hash
+		}
+		if uploaded[f.Hash] {
+			return nil
+		}
+		if _, loaded := pending.LoadOrStore(f.Hash, struct{}{}); loaded {
+			return nil
+		}
+		if _, err := s.Storage.Stat(blobPrefix + f.Hash); err == nil {
+			return nil
+		} else if !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+		if err := s.putBlob(local, blobPrefix+f.Hash); err != nil {
+			return err
+		}
+		atomic.AddInt64(&stats.Transferred, 1)
+		atomic.AddInt64(&stats.TransferSize, f.Size)
+		return nil
+	})
+	if err != nil {
+		s.Logger.Error("Upload blobs failed.", "dir", src, "error", err)
+		return nil, "", err
+	}
+
+	// The manifest is written last, so it never references a missing blob.
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, "", err
+	}
+	etag, err := put(bytes.NewReader(data))
+	if err != nil {
+		s.Logger.Error("Put manifest failed.", "key", key, "error", err)
+		return nil, "", err
+	}
+	s.setLastManifest(key, manifest)
+
+	s.Logger.Info("Save snapshot succeeded.", "dir", src, "key", key, "stats", *stats)
+	return stats, etag, nil
+}
+
+// ProgressFunc receives the number of the restored files and bytes, and the total bytes of the manifest.
+type ProgressFunc func(files int64, bytes int64, totalBytes int64)
+
+// Load reads the manifest of key from r and restores it to the local directory dst.
+// Files which already exist locally with the same content are not downloaded.
+// Symlinks may point anywhere, but nothing is written through a symlink resolving outside dst, see tar.CheckTarget.
+// Local files which are not in the manifest are kept.
+// If base is not empty, the files which are up to date in the local directory base are copied from it
+// rather than downloaded, e.g. the previous content of a directory restored into an empty one.
+// progress is called after each file is restored if it is not nil.
+// No more blobs are downloaded after ctx is done, and the loading fails with its error.
+func (s *Syncer) Load(ctx context.Context, r io.Reader, key string, dst string, base string, progress ProgressFunc) (*Stats, error) {
+	manifest, err := decodeManifest(r)
+	if err != nil {
+		s.Logger.Error("Decode manifest failed.", "key", key, "error", err)
+		return nil, err
+	}
+	if err = os.MkdirAll(dst, 0755); err != nil {
+		return nil, err
+	}
+
+	// Create the directories first, so the files can be written in parallel.
+	for _, f := range manifest.Files {
+		if !f.Mode.IsDir() {
+			continue
+		}
+		target, err := checkedPath(dst, f.Path)
+		if err != nil {
+			return nil, err
+		}
+		// Another type where the directory is restored is replaced, e.g. a symlink, so nothing is written through it.
+		if info, err := os.Lstat(target); err == nil && !info.IsDir() {
+			if err = os.Remove(target); err != nil {
+				return nil, err
+			}
+		}
+		if err = os.MkdirAll(target, f.Mode.Perm()|0700); err != nil {
+			return nil, err
+		}
+	}
+
+	var totalBytes int64
+	for _, f := range manifest.Files {
+		totalBytes += f.Size
+	}
+
+	stats := &Stats{}
+	blobPrefix := BlobPrefix(key)
+	err = s.parallel(len(manifest.Files), func(i int) error {
+		f := &manifest.Files[i]
+		if f.Mode.IsDir() || f.IsSymlink() {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		target, err := checkedPath(dst, f.Path)
+		if err != nil {
+			return err
+		}
+		if !upToDate(target, f) && !copyLocal(base, target, f) {
+			if err = s.getBlob(blobPrefix+f.Hash, target, f); err != nil {
+				return err
+			}
+			atomic.AddInt64(&stats.Transferred, 1)
+			atomic.AddInt64(&stats.TransferSize, f.Size)
+		}
+
+		files := atomic.AddInt64(&stats.Files, 1)
+		bytes := atomic.AddInt64(&stats.Bytes, f.Size)
+		if progress != nil {
+			progress(files, bytes, totalBytes)
+		}
+		return nil
+	})
+	if err != nil {
+		s.Logger.Error("Download blobs failed.", "dir", dst, "error", err)
+		return nil, err
+	}
+
+	// The symlinks are created after the files are written, so no file is written through them.
+	for i := range manifest.Files {
+		if f := &manifest.Files[i]; f.IsSymlink() {
+			if err = s.restoreSymlink(dst, f); err != nil {
+				s.Logger.Error("Create symlink failed.", "path", f.Path, "link", f.Link, "error", err)
+				return nil, err
+			}
+		}
+	}
+
+	// Restore the directory modification times after their content is written.
+	for i := len(manifest.Files) - 1; i >= 0; i-- {
+		if f := manifest.Files[i]; f.Mode.IsDir() {
+			// The directory may be replaced by a symlink, whose target must never get the mtime.
+			target, err := checkedPath(dst, f.Path)
+			if info, lerr := os.Lstat(target); err == nil && lerr == nil && info.IsDir() {
+				os.Chtimes(target, f.ModTime, f.ModTime)
+			}
+		}
+	}
+	s.setLastManifest(key, manifest)
+
+	s.Logger.Info("Load snapshot succeeded.", "key", key, "dir", dst, "stats", *stats)
+	return stats, nil
+}
+
+// Collect deletes the blobs of the manifest at key, see BlobPrefix, which are referenced by none of the manifests
+// at roots, e.g. after some of the manifests sharing the blobs are deleted. The roots which do not exist or are
+// not manifests reference no blobs, and nothing is deleted if any of the roots can not be read.
+// The blobs modified within Grace are kept, since the concurrent saves upload the new blobs before
+// their manifests are stored. It returns the number of the deleted blobs.
+func (s *Syncer) Collect(key string, roots []string) (int, error) {
+	referenced := map[string]bool{}
+	for _, root := range roots {
+		manifest, err := s.readManifest(root)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			s.Logger.Error("Read manifest failed, no blob is collected.", "key", root, "error", err)
+			return 0, err
+		}
+		for _, f := range manifest.Files {
+			if f.Hash != "" {
+				referenced[f.Hash] = true
+			}
+		}
+	}
+
+	prefix := BlobPrefix(key)
+	blobs, err := s.Storage.List(prefix)
+	if err != nil {
+		s.Logger.Error("List blobs failed.", "prefix", prefix, "error", err)
+		return 0, err
+	}
+	deleted := 0
+	for _, blob := range blobs {
+		if referenced[strings.TrimPrefix(blob.Key, prefix)] || time.Since(blob.LastModified) < s.Grace {
+			continue
+		}
+		if err = s.Storage.Delete(blob.Key); err != nil {
+			s.Logger.Error("Delete blob failed.", "key", blob.Key, "error", err)
+			return deleted, err
+		}
+		deleted++
+	}
+	s.Logger.Info("Collect blobs succeeded.", "prefix", prefix, "blobs", len(blobs), "deleted", deleted)
+	return deleted, nil
+}
+
+// readManifest reads the manifest stored at key, which is empty if the object is not a manifest, e.g. an archive.
+func (s *Syncer) readManifest(key string) (*Manifest, error) {
+	body, err := s.Storage.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	r := bufio.NewReader(body)
+	if header, _ := r.Peek(1); !IsManifest(header) {
+		return &Manifest{}, nil
+	}
+	return decodeManifest(r)
+}
+
+// decodeManifest decodes the manifest read from r, refusing the unsupported formats.
+func decodeManifest(r io.Reader) (*Manifest, error) {
+	manifest := &Manifest{}
+	if err := json.NewDecoder(r).Decode(manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Format != Format {
+		return nil, fmt.Errorf("unsupported snapshot format: %q", manifest.Format)
+	}
+	return manifest, nil
+}
+
+func (s *Syncer) lastManifest(key string) *Manifest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last[key]
+}
+
+func (s *Syncer) setLastManifest(key string, m *Manifest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last[key] = m
+}
+
+// parallel calls fn for 0 <= i < n with at most s.Parallel concurrent calls.
+// It stops scheduling new calls after the first error and returns it.
+func (s *Syncer) parallel(n int, fn func(i int) error) error {
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+		failed   int32
+		sem      = make(chan struct{}, s.Parallel)
+	)
+	for i := 0; i < n && atomic.LoadInt32(&failed) == 0; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() { <-sem; wg.Done() }()
+			if err := fn(i); err != nil {
+				once.Do(func() { firstErr = err })
+				atomic.StoreInt32(&failed, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// putBlob uploads the gzip compressed content of the local file.
+func (s *Syncer) putBlob(local string, key string) error {
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	pr, pw := io.Pipe()
+	go func() {
+		gw := gzip.NewWriter(pw)
+		_, err := io.Copy(gw, f)
+		if err == nil {
+			err = gw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	err = s.Storage.Put(key, pr)
+	pr.CloseWithError(err)
+	if err != nil {
+		s.Logger.Error("Put blob failed.", "key", key, "path", local, "error", err)
+	}
+	return err
+}
+
+// getBlob downloads the blob and writes it to the local file, verifying the content hash.
+func (s *Syncer) getBlob(key string, target string, f *File) error {
+	body, err := s.Storage.Get(key)
+	if err != nil {
+		s.Logger.Error("Get blob failed.", "key", key, "error", err)
+		return err
+	}
+	defer body.Close()
+	gr, err := gzip.NewReader(body)
+	if err != nil {
+		return err
+	}
+	if err = writeContent(gr, target, f); errors.Is(err, errHashMismatch) {
+		return fmt.Errorf("blob %s is corrupted: %w", key, err)
+	}
+	return err
+}
+
+// copyLocal copies the file of the manifest from the local directory base to target, and reports whether it is
+// copied. Nothing is copied if base is empty or the file in base is not up to date.
+func copyLocal(base string, target string, f *File) bool {
+	if base == "" {
+		return false
+	}
+	local, err := targetPath(base, f.Path)
+	if err != nil {
+		return false
+	}
+	r, err := os.Open(local)
+	if err != nil {
+		return false
+	}
+	defer r.Close()
+	if info, err := r.Stat(); err != nil || !info.Mode().IsRegular() || info.Size() != f.Size {
+		return false
+	}
+	// The content is verified while copying, a file changed meanwhile is downloaded instead.
+	return writeContent(r, target, f) == nil
+}
+
+var errHashMismatch = errors.New("content hash mismatch")
+
+// writeContent writes the content of the manifest file read from r to target, verifying the content hash.
+// It writes to a temporary file and renames, so a failed write never leaves a truncated file.
+func writeContent(r io.Reader, target string, f *File) error {
+	tmp, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(tmp, h), r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if hash := hex.EncodeToString(h.Sum(nil)); hash != f.Hash {
+		return fmt.Errorf("%w, got hash %s", errHashMismatch, hash)
+	}
+	if err = os.Chmod(tmp.Name(), f.Mode.Perm()); err != nil {
+		return err
+	}
+	if err = os.Chtimes(tmp.Name(), f.ModTime, f.ModTime); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), target)
+}
+
+// restoreSymlink creates the symlink of the manifest in dst, replacing the existing entry unless it is the same link.
+func (s *Syncer) restoreSymlink(dst string, f *File) error {
+	target, err := checkedPath(dst, f.Path)
+	if err != nil {
+		return err
+	}
+	if link, err := os.Readlink(target); err == nil && link == f.Link {
+		return nil
+	}
+	if err = os.RemoveAll(target); err != nil {
+		return err
+	}
+	if err = os.Symlink(f.Link, target); err != nil {
+		return err
+	}
+	// The mode of symlinks is not used on linux, only the mtime is restored.
+	mtime := unix.NsecToTimespec(f.ModTime.UnixNano())
+	if err = unix.UtimesNanoAt(unix.AT_FDCWD, target, []unix.Timespec{mtime, mtime}, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		s.Logger.Warn("Change mtime of symlink failed.", "path", target, "error", err)
+	}
+	return nil
+}
+
+// upToDate reports whether the local file has the same content as the manifest file.
+// A symlink is never up to date, so the file is written in place of it rather than through it.
+func upToDate(target string, f *File) bool {
+	info, err := os.Lstat(target)
+	if err != nil || !info.Mode().IsRegular() || info.Size() != f.Size {
+		return false
+	}
+	hash, err := hashFile(target)
+	return err == nil && hash == f.Hash
+}
+
+// usage returns the number and the total size of the regular files in p, or p itself if it is a regular file.
+func usage(p string) (files int64, bytes int64) {
+	filepath.Walk(p, func(_ string, info fs.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			files++
+			bytes += info.Size()
+		}
+		return nil
+	})
+	return files, bytes
+}
+
+func hashFile(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checkedPath is targetPath which also rejects the paths reached through a symlink resolving outside dst.
+func checkedPath(dst string, p string) (string, error) {
+	target, err := targetPath(dst, p)
+	if err != nil {
+		return "", err
+	}
+	if err = tar.CheckTarget(dst, target); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// targetPath joins the manifest path to dst, rejecting the paths which escape dst or are dst itself.
+func targetPath(dst string, p string) (string, error) {
+	cleaned := path.Clean(p)
+	if p == "" || cleaned == "." || path.IsAbs(cleaned) || cleaned == ".." || len(cleaned) > 2 && cleaned[:3] == "../" {
+		return "", fmt.Errorf("manifest contains invalid path: %s", p)
+	}
+	return filepath.Join(dst, filepath.FromSlash(cleaned)), nil
+}
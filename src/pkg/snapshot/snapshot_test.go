@@ -0,0 +1,294 @@
+package snapshot
+
+import (
+	"aliyun/serverless/webide-server/pkg/storage"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name string, content string) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatalf("unable to create directory of %s: %v", name, err)
+	}
+	if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatalf("unable to write file %s: %v", name, err)
+	}
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	root, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Fatalf("unable to create temporary dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	backend, err := storage.NewLocal(filepath.Join(root, "storage"))
+	if err != nil {
+		t.Fatalf("unable to create local backend: %v", err)
+	}
+	const key = "tests/vscode-server/workspace.tar.gz"
+
+	// Prepare the mock workspace data.
+	srcDir := filepath.Join(root, "src")
+	writeFile(t, filepath.Join(srcDir, "file1.txt"), "this is file1.")
+	writeFile(t, filepath.Join(srcDir, "file2", "file2.txt"), "this is file2.")
+	writeFile(t, filepath.Join(srcDir, "file2", "copy.txt"), "this is file2.")
+	if err = os.MkdirAll(filepath.Join(srcDir, "empty"), 0755); err != nil {
+		t.Fatalf("unable to create directory: %v", err)
+	}
+	if err = os.Symlink("file2/file2.txt", filepath.Join(srcDir, "link")); err != nil {
+		t.Fatalf("unable to create symlink: %v", err)
+	}
+	if err = os.Symlink("/nonexistent", filepath.Join(srcDir, "dangling")); err != nil {
+		t.Fatalf("unable to create symlink: %v", err)
+	}
+
+	// The first save uploads every distinct content once.
+	var logs bytes.Buffer
+	syncer := NewSyncer(backend, 4)
+	syncer.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+	stats, err := syncer.Save(srcDir, key)
+	if err != nil {
+		t.Fatalf("unable to save snapshot: %v", err)
+	}
+	if stats.Files != 3 || stats.Transferred != 2 {
+		t.Fatalf("expected 3 files and 2 uploaded blobs, but got %+v", *stats)
+	}
+	if !strings.Contains(logs.String(), "Save snapshot succeeded.") {
+		t.Fatalf("expected the save logged by the logger of the syncer, but got %q", logs.String())
+	}
+
+	// Nothing changed, nothing uploaded.
+	if stats, err = syncer.Save(srcDir, key); err != nil {
+		t.Fatalf("unable to save snapshot: %v", err)
+	}
+	if stats.Transferred != 0 {
+		t.Fatalf("expected no uploaded blobs, but got %+v", *stats)
+	}
+
+	// Only the changed file is uploaded.
+	writeFile(t, filepath.Join(srcDir, "file1.txt"), "this is the new file1.")
+	os.Chtimes(filepath.Join(srcDir, "file1.txt"), time.Now(), time.Now().Add(time.Second))
+	if stats, err = syncer.Save(srcDir, key); err != nil {
+		t.Fatalf("unable to save snapshot: %v", err)
+	}
+	if stats.Transferred != 1 {
+		t.Fatalf("expected 1 uploaded blob, but got %+v", *stats)
+	}
+
+	// Load with a new syncer, like a new instance does.
+	dstDir := filepath.Join(root, "dst")
+	body, err := backend.Get(key)
+	if err != nil {
+		t.Fatalf("unable to get manifest: %v", err)
+	}
+	stats, err = NewSyncer(backend, 4).Load(context.Background(), body, key, dstDir, "", nil)
+	body.Close()
+	if err != nil {
+		t.Fatalf("unable to load snapshot: %v", err)
+	}
+	if stats.Transferred != 3 {
+		t.Fatalf("expected 3 downloaded blobs, but got %+v", *stats)
+	}
+	cmd := exec.Command("diff", "--recursive", "--no-dereference", srcDir, dstDir)
+	if err = cmd.Run(); err != nil {
+		t.Fatalf("The two directories are not equal.\nSrc dir: %s\nDst dir: %s\nError: %v", srcDir, dstDir, err)
+	}
+	for name, expected := range map[string]string{"link": "file2/file2.txt", "dangling": "/nonexistent"} {
+		if link, err := os.Readlink(filepath.Join(dstDir, name)); err != nil || link != expected {
+			t.Fatalf("expected symlink %s to %s, but got %q, error: %v", name, expected, link, err)
+		}
+	}
+
+	// Load again, the local files are up to date and nothing is downloaded.
+	body, _ = backend.Get(key)
+	stats, err = NewSyncer(backend, 4).Load(context.Background(), body, key, dstDir, "", nil)
+	body.Close()
+	if err != nil {
+		t.Fatalf("unable to load snapshot: %v", err)
+	}
+	if stats.Transferred != 0 {
+		t.Fatalf("expected no downloaded blobs, but got %+v", *stats)
+	}
+
+	// Load into an empty directory based on the loaded one, only the changed file is downloaded.
+	writeFile(t, filepath.Join(dstDir, "file1.txt"), "this is the local file1.")
+	emptyDir := filepath.Join(root, "empty")
+	body, _ = backend.Get(key)
+	stats, err = NewSyncer(backend, 4).Load(context.Background(), body, key, emptyDir, dstDir, nil)
+	body.Close()
+	if err != nil {
+		t.Fatalf("unable to load snapshot: %v", err)
+	}
+	if stats.Transferred != 1 {
+		t.Fatalf("expected 1 downloaded blob, but got %+v", *stats)
+	}
+	if err = exec.Command("diff", "--recursive", "--no-dereference", srcDir, emptyDir).Run(); err != nil {
+		t.Fatalf("The two directories are not equal.\nSrc dir: %s\nDst dir: %s\nError: %v", srcDir, emptyDir, err)
+	}
+}
+
+func TestLoadSymlinkEscape(t *testing.T) {
+	root := t.TempDir()
+	backend, err := storage.NewLocal(filepath.Join(root, "storage"))
+	if err != nil {
+		t.Fatalf("unable to create local backend: %v", err)
+	}
+	outside := filepath.Join(root, "outside")
+	writeFile(t, filepath.Join(outside, "secret"), "secret")
+	writeFile(t, filepath.Join(root, "evil"), "evil")
+	hash, _ := hashFile(filepath.Join(root, "evil"))
+	const key = "tests/workspace"
+	syncer := NewSyncer(backend, 2)
+	if err = syncer.putBlob(filepath.Join(root, "evil"), BlobPrefix(key)+hash); err != nil {
+		t.Fatalf("unable to put blob: %v", err)
+	}
+
+	dir := func(p string) File { return File{Path: p, Mode: fs.ModeDir | 0755, ModTime: time.Unix(1000, 0)} }
+	reg := func(p string) File { return File{Path: p, Mode: 0644, Size: 4, Hash: hash} }
+	symlink := func(p string, link string) File { return File{Path: p, Mode: fs.ModeSymlink | 0777, Link: link} }
+	load := func(dst string, files ...File) error {
+		data, _ := json.Marshal(&Manifest{Format: Format, Files: files})
+		_, err := syncer.Load(context.Background(), bytes.NewReader(data), key, dst, "", nil)
+		return err
+	}
+	assertOutside := func(name string) {
+		t.Helper()
+		if entries, _ := os.ReadDir(outside); len(entries) != 1 {
+			t.Fatalf("%s: expected nothing written outside, but got %v", name, entries)
+		}
+		if data, _ := os.ReadFile(filepath.Join(outside, "secret")); string(data) != "secret" {
+			t.Fatalf("%s: expected the outside file untouched, but got %q", name, data)
+		}
+	}
+
+	cases := []struct {
+		name     string
+		existing string // the symlink to outside existing in dst
+		files    []File
+	}{
+		{"write through absolute symlink", "", []File{symlink("a", outside), reg("a/evil")}},
+		{"write through relative symlink", "", []File{dir("dir"), symlink("dir/up", "../.."), reg("dir/up/outside/evil")}},
+		{"write through existing symlink", "a", []File{reg("a/evil")}},
+		{"path outside", "", []File{reg("../evil")}},
+		{"destination as symlink", "", []File{symlink(".", outside)}},
+	}
+	for _, c := range cases {
+		dst := filepath.Join(root, "dst")
+		os.MkdirAll(dst, 0755)
+		if c.existing != "" {
+			os.Symlink(outside, filepath.Join(dst, c.existing))
+		}
+		if err = load(dst, c.files...); err == nil {
+			t.Fatalf("%s: expected the loading failed", c.name)
+		}
+		assertOutside(c.name)
+		os.RemoveAll(dst)
+	}
+
+	// The existing symlinks are replaced by the loaded directory and file, instead of written through.
+	dst := filepath.Join(root, "dst")
+	os.MkdirAll(dst, 0755)
+	os.Symlink(outside, filepath.Join(dst, "dir"))
+	os.Symlink(filepath.Join(outside, "secret"), filepath.Join(dst, "file"))
+	before, _ := os.Stat(outside)
+	if err = load(dst, dir("dir"), reg("dir/evil"), reg("file")); err != nil {
+		t.Fatalf("unable to load: %v", err)
+	}
+	for _, name := range []string{"dir/evil", "file"} {
+		if info, err := os.Lstat(filepath.Join(dst, name)); err != nil || !info.Mode().IsRegular() {
+			t.Fatalf("expected the regular file %s, error: %v", name, err)
+		}
+	}
+	assertOutside("replaced")
+	if after, _ := os.Stat(outside); !after.ModTime().Equal(before.ModTime()) {
+		t.Fatalf("expected the outside directory untouched, but got mtime %v", after.ModTime())
+	}
+}
+
+func TestCollect(t *testing.T) {
+	root := t.TempDir()
+	backend, err := storage.NewLocal(filepath.Join(root, "storage"))
+	if err != nil {
+		t.Fatalf("unable to create local backend: %v", err)
+	}
+	writeFile(t, filepath.Join(root, "a", "shared.txt"), "shared")
+	writeFile(t, filepath.Join(root, "a", "a.txt"), "a")
+	writeFile(t, filepath.Join(root, "b", "shared.txt"), "shared")
+	writeFile(t, filepath.Join(root, "b", "b.txt"), "b")
+	syncer := NewSyncer(backend, 2)
+	save := func(dir string, key string) {
+		if _, err := syncer.Save(filepath.Join(root, dir), key); err != nil {
+			t.Fatalf("unable to save snapshot: %v", err)
+		}
+	}
+	// The copy of the manifest alice shares its blobs, like the workspace snapshots.
+	// The workspace bob in the same directory has its own blobs.
+	save("a", "tests/alice")
+	if err = backend.Copy("tests/alice", "tests/alice.snapshot"); err != nil {
+		t.Fatalf("unable to copy the manifest: %v", err)
+	}
+	save("b", "tests/alice")
+	save("a", "tests/bob")
+	if err = backend.Put("tests/archive", strings.NewReader("\x1f\x8b")); err != nil {
+		t.Fatalf("unable to put the archive: %v", err)
+	}
+
+	// The copy is gone, but its blob a.txt is new and may belong to a save in progress.
+	roots := []string{"tests/alice", "tests/archive", "tests/missing"}
+	deleted, err := syncer.Collect("tests/alice", roots)
+	if err != nil || deleted != 0 {
+		t.Fatalf("expected no blob deleted within the grace period, but got %d, error: %v", deleted, err)
+	}
+
+	// Only its own blob is collected. The archive and the missing object reference nothing.
+	syncer.Grace = 0
+	deleted, err = syncer.Collect("tests/alice", roots)
+	if err != nil || deleted != 1 {
+		t.Fatalf("expected 1 blob deleted, but got %d, error: %v", deleted, err)
+	}
+	blobs, _ := backend.List(BlobPrefix("tests/alice"))
+	if len(blobs) != 2 {
+		t.Fatalf("expected 2 blobs left, but got %+v", blobs)
+	}
+
+	// The other workspace still loads.
+	body, err := backend.Get("tests/bob")
+	if err != nil {
+		t.Fatalf("unable to get the manifest: %v", err)
+	}
+	defer body.Close()
+	dst := filepath.Join(root, "bob")
+	if _, err = NewSyncer(backend, 2).Load(context.Background(), body, "tests/bob", dst, "", nil); err != nil {
+		t.Fatalf("unable to load the other workspace: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dst, "a.txt")); string(data) != "a" {
+		t.Fatalf("expected a.txt loaded, but got %q", data)
+	}
+}
+
+func TestIsManifest(t *testing.T) {
+	tests := []struct {
+		Data     []byte
+		Expected bool
+	}{
+		{[]byte(`{"format":"webide-snapshot/v1"}`), true},
+		{[]byte("\n {"), true},
+		{[]byte{0x1f, 0x8b, 0x08}, false},
+		{nil, false},
+	}
+	for _, test := range tests {
+		if IsManifest(test.Data) != test.Expected {
+			t.Errorf("IsManifest(%q) expected %v", test.Data, test.Expected)
+		}
+	}
+}
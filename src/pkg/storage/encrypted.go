@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"aliyun/serverless/webide-server/pkg/encryption"
+	"bufio"
+	"io"
+)
+
+// Encrypted encrypts the objects put to the backend, and decrypts the encrypted objects got from it.
+// The objects are detected by the encryption header, so the plaintext objects saved before the encryption
+// is enabled are still readable, and encrypted by the next save.
+type Encrypted struct {
+	Backend
+	Keys encryption.KeyProvider
+}
+
+// NewEncrypted wraps the backend with the encryption by the keys.
+func NewEncrypted(backend Backend, keys encryption.KeyProvider) *Encrypted {
+	return &Encrypted{Backend: backend, Keys: keys}
+}
+
+func (e *Encrypted) Get(key string) (io.ReadCloser, error) {
+	body, err := e.Backend.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(body)
+	if header, _ := r.Peek(len(encryption.Magic)); !encryption.IsEncrypted(header) {
+		return readCloser{r, body}, nil
+	}
+	decrypted, err := encryption.NewReader(r, e.Keys)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	return readCloser{decrypted, body}, nil
+}
+
+// Put encrypts the content while it is streamed to the backend.
+func (e *Encrypted) Put(key string, r io.Reader) error {
+	return e.encrypt(r, func(encrypted io.Reader) error {
+		return e.Backend.Put(key, encrypted)
+	})
+}
+
+// PutIf is Put with the precondition, the ETag is the one of the encrypted object.
+func (e *Encrypted) PutIf(key string, r io.Reader, etag string) (string, error) {
+	var newETag string
+	err := e.encrypt(r, func(encrypted io.Reader) (err error) {
+		newETag, err = e.Backend.PutIf(key, encrypted, etag)
+		return err
+	})
+	return newETag, err
+}
+
+// encrypt streams the encrypted content of r to put.
+func (e *Encrypted) encrypt(r io.Reader, put func(io.Reader) error) error {
+	pr, pw := io.Pipe()
+	go func() {
+		w, err := encryption.NewWriter(pw, e.Keys)
+		if err == nil {
+			if _, err = io.Copy(w, r); err == nil {
+				err = w.Close()
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	err := put(pr)
+	// Unblock the encrypting goroutine if the upload failed before reading all the data.
+	pr.CloseWithError(err)
+	return err
+}
+
+// readCloser reads from the reader, and closes the closer.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
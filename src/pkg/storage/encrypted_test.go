@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"aliyun/serverless/webide-server/pkg/encryption"
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncrypted(t *testing.T) {
+	root, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Fatalf("unable to create temporary dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	local, err := NewLocal(root)
+	if err != nil {
+		t.Fatalf("unable to create local backend: %v", err)
+	}
+	key := make([]byte, encryption.DataKeySize)
+	rand.Read(key)
+	keys, err := encryption.NewStaticKeyProvider("default", key, nil)
+	if err != nil {
+		t.Fatalf("unable to create key provider: %v", err)
+	}
+	backend := NewEncrypted(local, keys)
+
+	// The object is encrypted in the underlying backend.
+	content := strings.Repeat("secret source code\n", 10000)
+	if err = backend.Put("workspace.tar.gz", strings.NewReader(content)); err != nil {
+		t.Fatalf("unable to put: %v", err)
+	}
+	raw, err := os.ReadFile(filepath.Join(root, "workspace.tar.gz"))
+	if err != nil || !encryption.IsEncrypted(raw) || bytes.Contains(raw, []byte("secret")) {
+		t.Fatalf("expected the encrypted object, error: %v", err)
+	}
+
+	// Both the encrypted and the plaintext objects are readable.
+	if err = local.Put("plain.tar.gz", strings.NewReader("saved before the encryption")); err != nil {
+		t.Fatalf("unable to put: %v", err)
+	}
+	for key, expected := range map[string]string{"workspace.tar.gz": content, "plain.tar.gz": "saved before the encryption"} {
+		body, err := backend.Get(key)
+		if err != nil {
+			t.Fatalf("unable to get %s: %v", key, err)
+		}
+		data, err := io.ReadAll(body)
+		body.Close()
+		if err != nil || string(data) != expected {
+			t.Fatalf("unexpected content of %s, error: %v", key, err)
+		}
+	}
+}
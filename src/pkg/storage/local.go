@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Local is the storage backend which stores the objects as files under a local directory.
+// It is useful for running the web ide on a laptop or a VM without any cloud service.
+type Local struct {
+	Root string // the directory where the objects are stored
+}
+
+// NewLocal creates the local backend. The root directory is created if it does not exist.
+func NewLocal(root string) (*Local, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		slog.Error("Create local storage directory failed.", "dir", root, "error", err)
+		return nil, err
+	}
+	return &Local{Root: root}, nil
+}
+
+// tempFileSuffix marks the in-progress files written by Put.
+const tempFileSuffix = ".webide-tmp-"
+
+// isTempFile reports whether p is an in-progress file written by Put.
+func isTempFile(p string) bool {
+	base := filepath.Base(p)
+	return strings.HasPrefix(base, ".") && strings.Contains(base, tempFileSuffix)
+}
+
+// path converts the object key to the local file path.
+func (l *Local) path(key string) (string, error) {
+	cleaned := path.Clean("/" + key)
+	if key == "" || cleaned == "/" || strings.Contains(key, `\`) {
+		return "", fmt.Errorf("invalid object key: %q", key)
+	}
+	return filepath.Join(l.Root, filepath.FromSlash(cleaned)), nil
+}
+
+func (l *Local) Get(key string) (io.ReadCloser, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+// Put writes the object to a temporary file first and then renames it,
+// so the readers never see a partially written object.
+func (l *Local) Put(key string, r io.Reader) error {
+	return l.put(key, r, nil)
+}
+
+// localLock serializes the conditional writes of the local backends in the process.
+var localLock sync.Mutex
+
+// PutIf checks the precondition right before the temporary file is renamed. The check and the rename are atomic
+// within the process, which is enough for the local development.
+func (l *Local) PutIf(key string, r io.Reader, etag string) (string, error) {
+	var info *ObjectInfo
+	err := l.put(key, r, func(tmp string, p string) error {
+		localLock.Lock()
+		defer localLock.Unlock()
+		if err := (&condition{etag: etag}).check(l.Stat, key); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, p); err != nil {
+			return err
+		}
+		var err error
+		info, err = l.Stat(key)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return info.ETag, nil
+}
+
+// put writes the content to a temporary file, and commits it to the object file p. commit nil renames it to p.
+func (l *Local) put(key string, r io.Reader, commit func(tmp string, p string) error) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), "."+filepath.Base(p)+tempFileSuffix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if commit != nil {
+		return commit(tmp.Name(), p)
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (l *Local) Stat(key string) (*ObjectInfo, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(p)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && fi.IsDir()) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return l.objectInfo(key, fi), nil
+}
+
+func (l *Local) Delete(key string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (l *Local) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := filepath.Walk(l.Root, func(p string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(l.Root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if info.IsDir() {
+			// Skip the directories which can not contain any matched key.
+			if rel != "." && !strings.HasPrefix(key+"/", prefix) && !strings.HasPrefix(prefix, key+"/") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(key, prefix) && !isTempFile(p) {
+			objects = append(objects, *l.objectInfo(key, info))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+func (l *Local) Copy(src string, dst string) error {
+	r, err := l.Get(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return l.Put(dst, r)
+}
+
+// objectInfo builds the object info from the file info.
+// The ETag is derived from the modification time, size and inode, which changes on every Put, as the temporary file
+// renamed to the object is a new inode, even if the modification time is not changed by the coarse clock of the file system.
+func (l *Local) objectInfo(key string, fi fs.FileInfo) *ObjectInfo {
+	var ino uint64
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		ino = uint64(st.Ino)
+	}
+	return &ObjectInfo{
+		Key:          key,
+		Size:         fi.Size(),
+		ETag:         fmt.Sprintf("%x-%x-%x", fi.ModTime().UnixNano(), fi.Size(), ino),
+		LastModified: fi.ModTime(),
+	}
+}
@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"aliyun/serverless/webide-server/pkg/context"
+	"aliyun/serverless/webide-server/pkg/encryption"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestLocal(t *testing.T) {
+	root, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Fatalf("unable to create temporary dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	backend, err := NewLocal(root)
+	if err != nil {
+		t.Fatalf("unable to create local backend: %v", err)
+	}
+
+	// Missing object.
+	if _, err = backend.Get("tests/missing.tar.gz"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, but got %v", err)
+	}
+	if _, err = backend.Stat("tests/missing.tar.gz"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, but got %v", err)
+	}
+
+	// Put and get.
+	objects := map[string]string{
+		"tests/vscode-server/workspace.tar.gz":          "workspace",
+		"tests/vscode-server/vscode-server-data.tar.gz": "vscode server data",
+		"tests/other.tar.gz":                            "other",
+	}
+	for key, content := range objects {
+		if err = backend.Put(key, strings.NewReader(content)); err != nil {
+			t.Fatalf("unable to put %s: %v", key, err)
+		}
+	}
+	for key, content := range objects {
+		body, err := backend.Get(key)
+		if err != nil {
+			t.Fatalf("unable to get %s: %v", key, err)
+		}
+		data, _ := io.ReadAll(body)
+		body.Close()
+		if !bytes.Equal(data, []byte(content)) {
+			t.Errorf("expected %q, but got %q", content, data)
+		}
+
+		info, err := backend.Stat(key)
+		if err != nil {
+			t.Fatalf("unable to stat %s: %v", key, err)
+		}
+		if info.Size != int64(len(content)) || info.ETag == "" {
+			t.Errorf("unexpected object info of %s: %+v", key, info)
+		}
+	}
+
+	// List.
+	list, err := backend.List("tests/vscode-server/")
+	if err != nil {
+		t.Fatalf("unable to list: %v", err)
+	}
+	var keys []string
+	for _, obj := range list {
+		keys = append(keys, obj.Key)
+	}
+	sort.Strings(keys)
+	expected := []string{"tests/vscode-server/vscode-server-data.tar.gz", "tests/vscode-server/workspace.tar.gz"}
+	if strings.Join(keys, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected %v, but got %v", expected, keys)
+	}
+
+	// Delete.
+	if err = backend.Delete("tests/other.tar.gz"); err != nil {
+		t.Fatalf("unable to delete: %v", err)
+	}
+	if err = backend.Delete("tests/other.tar.gz"); err != nil {
+		t.Fatalf("delete a non-existent object should succeed, but got %v", err)
+	}
+	if _, err = backend.Stat("tests/other.tar.gz"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, but got %v", err)
+	}
+
+	// Keys can not escape the root directory.
+	if err = backend.Put("../../escape", strings.NewReader("")); err != nil {
+		t.Fatalf("unable to put: %v", err)
+	}
+	if _, err = os.Stat(root + "/escape"); err != nil {
+		t.Fatalf("expected the object under the root directory, but got %v", err)
+	}
+}
+
+func TestLocalPutIf(t *testing.T) {
+	local, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatalf("unable to create local backend: %v", err)
+	}
+	key := make([]byte, encryption.DataKeySize)
+	keys, _ := encryption.NewStaticKeyProvider("default", key, nil)
+
+	for _, backend := range []Backend{local, NewEncrypted(local, keys)} {
+		local.Delete("workspace.tar.gz")
+		etag, err := backend.PutIf("workspace.tar.gz", strings.NewReader("v1"), "")
+		if err != nil {
+			t.Fatalf("unable to create: %v", err)
+		}
+		if etag, err = backend.PutIf("workspace.tar.gz", strings.NewReader("v2"), etag); err != nil {
+			t.Fatalf("unable to update: %v", err)
+		}
+		if info, err := backend.Stat("workspace.tar.gz"); err != nil || info.ETag != etag {
+			t.Fatalf("expected etag %s, but got %+v, error: %v", etag, info, err)
+		}
+
+		// Changed by others, with the same size.
+		if err = local.Put("workspace.tar.gz", strings.NewReader("xx")); err != nil {
+			t.Fatalf("unable to put: %v", err)
+		}
+		for _, expected := range []string{"", etag} {
+			if _, err = backend.PutIf("workspace.tar.gz", strings.NewReader("v3"), expected); !errors.Is(err, ErrPreconditionFailed) {
+				t.Fatalf("expected ErrPreconditionFailed, but got %v", err)
+			}
+		}
+		if body, err := local.Get("workspace.tar.gz"); err == nil {
+			data, _ := io.ReadAll(body)
+			body.Close()
+			if string(data) != "xx" {
+				t.Fatalf("expected the object not overwritten, but got %q", data)
+			}
+		}
+	}
+}
+
+func TestNewLocalContext(t *testing.T) {
+	root, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Fatalf("unable to create temporary dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	// The local context has no credentials, the oss driver falls back to the local one.
+	viper.Set("storage.driver", DriverOss)
+	viper.Set("storage.local.directory", root)
+	defer viper.Reset()
+
+	backend, err := New(context.NewLocal())
+	if err != nil {
+		t.Fatalf("unable to create backend: %v", err)
+	}
+	if _, ok := backend.(*Local); !ok {
+		t.Fatalf("expected the local backend, but got %T", backend)
+	}
+}
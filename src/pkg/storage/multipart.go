@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"sync"
+)
+
+const (
+	DefaultPartSize = 16 << 20 // default part size of the multipart upload
+	DefaultParallel = 4        // default number of the parts uploaded concurrently
+	MinPartSize     = 5 << 20  // min part size accepted by the object storage services
+)
+
+// Part is an uploaded part of the multipart upload.
+type Part struct {
+	Number int
+	ETag   string
+}
+
+// multipartUploader is implemented by the drivers which support the multipart upload.
+// putSingle and complete write the object, they return its ETag, and send cond to the service if it is supported.
+type multipartUploader interface {
+	// putSingle uploads the object with a single request.
+	putSingle(key string, data []byte, cond *condition) (string, error)
+	initiate(key string) (uploadId string, err error)
+	uploadPart(key string, uploadId string, number int, data []byte) (Part, error)
+	complete(key string, uploadId string, parts []Part, cond *condition) (string, error)
+	abort(key string, uploadId string) error
+	Stat(key string) (*ObjectInfo, error)
+}
+
+// condition is the precondition of a conditional write, nil for the unconditional ones.
+type condition struct {
+	etag string // the expected ETag of the object, empty if the object must not exist
+}
+
+// check returns ErrPreconditionFailed if the object does not match the condition.
+func (c *condition) check(stat func(key string) (*ObjectInfo, error), key string) error {
+	if c == nil {
+		return nil
+	}
+	info, err := stat(key)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		if c.etag != "" {
+			return fmt.Errorf("%w: %s is deleted", ErrPreconditionFailed, key)
+		}
+	case err != nil:
+		return err
+	case info.ETag != c.etag:
+		return fmt.Errorf("%w: the ETag of %s is %s, but %q is expected", ErrPreconditionFailed, key, info.ETag, c.etag)
+	}
+	return nil
+}
+
+// putMultipart streams the content of r to the object.
+// Content smaller than partSize is uploaded with a single request, otherwise it is split into parts
+// and uploaded with at most parallel parts in flight. The memory used is bounded by
+// partSize * (parallel + 1) no matter how large the content is.
+// Any error returned by r, e.g. from the writer of an io.Pipe, aborts the upload.
+// The object is written only if it matches cond, which is checked before the upload and again before the object is
+// written, and sent to the service if supported. It returns the ETag of the written object.
+func putMultipart(u multipartUploader, key string, r io.Reader, partSize int64, parallel int, cond *condition) (string, error) {
+	if err := cond.check(u.Stat, key); err != nil {
+		return "", err
+	}
+	data, err := readPart(r, partSize)
+	if err != nil {
+		return "", err
+	}
+	if int64(len(data)) < partSize {
+		if err = cond.check(u.Stat, key); err != nil {
+			return "", err
+		}
+		return u.putSingle(key, data, cond)
+	}
+
+	uploadId, err := u.initiate(key)
+	if err != nil {
+		slog.Error("Initiate multipart upload failed.", "key", key, "error", err)
+		return "", err
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		parts    []Part
+		firstErr error
+		sem      = make(chan struct{}, parallel)
+	)
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr != nil
+	}
+	setErr := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	for number := 1; len(data) > 0 && !failed(); number++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(number int, data []byte) {
+			defer func() { <-sem; wg.Done() }()
+			part, err := u.uploadPart(key, uploadId, number, data)
+			if err != nil {
+				setErr(err)
+				return
+			}
+			mu.Lock()
+			parts = append(parts, part)
+			mu.Unlock()
+		}(number, data)
+
+		if int64(len(data)) < partSize {
+			break
+		}
+		if data, err = readPart(r, partSize); err != nil {
+			setErr(err)
+		}
+	}
+	wg.Wait()
+
+	var etag string
+	if firstErr == nil {
+		firstErr = cond.check(u.Stat, key)
+	}
+	if firstErr == nil {
+		sort.Slice(parts, func(i, j int) bool { return parts[i].Number < parts[j].Number })
+		etag, firstErr = u.complete(key, uploadId, parts, cond)
+	}
+	if firstErr != nil {
+		slog.Error("Multipart upload failed.", "key", key, "error", firstErr)
+		if err := u.abort(key, uploadId); err != nil {
+			slog.Error("Abort multipart upload failed.", "key", key, "error", err)
+		}
+		return "", firstErr
+	}
+	slog.Info("Multipart upload succeeded.", "key", key, "parts", len(parts))
+	return etag, nil
+}
+
+// readPart reads up to size bytes from r. It returns less than size bytes only at the end of r.
+func readPart(r io.Reader, size int64) ([]byte, error) {
+	buf := make([]byte, size)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return buf[:n], nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeUploader records the multipart upload calls in memory.
+type fakeUploader struct {
+	mu       sync.Mutex
+	inFlight int
+	maxSeen  int
+	single   []byte
+	parts    map[int][]byte
+	result   []byte
+	aborted  bool
+	etag     string // ETag of the object, empty if it does not exist
+	written  int    // number of the object writes
+	// onPart is called after a part is uploaded, e.g. to change the object by others.
+	onPart func()
+}
+
+func (f *fakeUploader) putSingle(key string, data []byte, cond *condition) (string, error) {
+	f.single = data
+	return f.write(), nil
+}
+
+func (f *fakeUploader) write() string {
+	f.written++
+	f.etag = fmt.Sprintf("etag-%d", f.written)
+	return f.etag
+}
+
+func (f *fakeUploader) Stat(key string) (*ObjectInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.etag == "" {
+		return nil, ErrNotFound
+	}
+	return &ObjectInfo{Key: key, ETag: f.etag}, nil
+}
+
+func (f *fakeUploader) initiate(key string) (string, error) {
+	f.parts = map[int][]byte{}
+	return "upload-id", nil
+}
+
+func (f *fakeUploader) uploadPart(key string, uploadId string, number int, data []byte) (Part, error) {
+	f.mu.Lock()
+	f.inFlight++
+	if f.inFlight > f.maxSeen {
+		f.maxSeen = f.inFlight
+	}
+	f.parts[number] = data
+	f.mu.Unlock()
+
+	// Keep the part in flight for a while to detect the concurrent uploads.
+	time.Sleep(time.Millisecond)
+	f.mu.Lock()
+	f.inFlight--
+	if f.onPart != nil {
+		f.onPart()
+	}
+	f.mu.Unlock()
+	return Part{Number: number, ETag: fmt.Sprint(number)}, nil
+}
+
+func (f *fakeUploader) complete(key string, uploadId string, parts []Part, cond *condition) (string, error) {
+	for i, part := range parts {
+		if part.Number != i+1 {
+			return "", fmt.Errorf("unexpected part %d at %d", part.Number, i)
+		}
+		f.result = append(f.result, f.parts[part.Number]...)
+	}
+	return f.write(), nil
+}
+
+func (f *fakeUploader) abort(key string, uploadId string) error {
+	f.aborted = true
+	return nil
+}
+
+func TestPutMultipart(t *testing.T) {
+	tests := []struct {
+		Name      string
+		Size      int
+		PartSize  int64
+		Multipart bool
+	}{
+		{"empty", 0, 10, false},
+		{"single", 9, 10, false},
+		{"exact-one-part", 10, 10, true},
+		{"multiple-parts", 95, 10, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			content := make([]byte, test.Size)
+			for i := range content {
+				content[i] = byte(i)
+			}
+
+			u := &fakeUploader{}
+			if _, err := putMultipart(u, "key", bytes.NewReader(content), test.PartSize, 3, nil); err != nil {
+				t.Fatalf("unable to put: %v", err)
+			}
+			got := u.single
+			if test.Multipart {
+				got = u.result
+			}
+			if !bytes.Equal(got, content) {
+				t.Fatalf("expected %v, but got %v", content, got)
+			}
+			if u.maxSeen > 3 {
+				t.Fatalf("expected at most 3 parts in flight, but got %d", u.maxSeen)
+			}
+		})
+	}
+}
+
+func TestPutMultipartReaderError(t *testing.T) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write(make([]byte, 25))
+		pw.CloseWithError(errors.New("archive failed"))
+	}()
+
+	u := &fakeUploader{}
+	_, err := putMultipart(u, "key", pr, 10, 2, nil)
+	if err == nil || err.Error() != "archive failed" {
+		t.Fatalf("expected the reader error, but got %v", err)
+	}
+	if !u.aborted {
+		t.Fatalf("expected the upload aborted")
+	}
+}
+
+func TestPutMultipartCondition(t *testing.T) {
+	u := &fakeUploader{}
+	for _, size := range []int{5, 25} {
+		// Created only if not exists, then updated only if not changed.
+		etag, err := putMultipart(u, "key", bytes.NewReader(make([]byte, size)), 10, 2, &condition{})
+		if err != nil || etag != u.etag {
+			t.Fatalf("size %d: unexpected etag %s, error: %v", size, etag, err)
+		}
+		if _, err = putMultipart(u, "key", bytes.NewReader(make([]byte, size)), 10, 2, &condition{etag: etag}); err != nil {
+			t.Fatalf("size %d: unable to put: %v", size, err)
+		}
+		written := u.written
+		for _, cond := range []*condition{{}, {etag: etag}} {
+			if _, err = putMultipart(u, "key", bytes.NewReader(make([]byte, size)), 10, 2, cond); !errors.Is(err, ErrPreconditionFailed) {
+				t.Fatalf("size %d: expected ErrPreconditionFailed, but got %v", size, err)
+			}
+		}
+		if u.written != written {
+			t.Fatalf("size %d: expected the object not written", size)
+		}
+		u.etag = ""
+	}
+
+	// Changed by others during the upload.
+	u = &fakeUploader{onPart: func() { u.etag = "other" }}
+	if _, err := putMultipart(u, "key", bytes.NewReader(make([]byte, 25)), 10, 2, &condition{}); !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("expected ErrPreconditionFailed, but got %v", err)
+	}
+	if !u.aborted || u.written != 0 {
+		t.Fatalf("expected the upload aborted")
+	}
+}
@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"aliyun/serverless/webide-server/pkg/context"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+// Oss is the storage backend based on Alibaba Cloud OSS.
+type Oss struct {
+	Client   *oss.Client
+	Bucket   *oss.Bucket
+	PartSize int64 // part size of the multipart upload
+	Parallel int   // number of the parts uploaded concurrently
+}
+
+// NewOss creates the oss backend.
+// endpoint is the oss service endpoint, e.g. https://oss-cn-hangzhou.aliyuncs.com
+// bucketName is the bucket where the objects are stored.
+func NewOss(endpoint string, bucketName string, ctx *context.Context) (*Oss, error) {
+	// The credentials are got for every request, so the refreshed ones are used after the STS token expires.
+	c, err := oss.New(endpoint, "", "", oss.SetCredentialsProvider(ossCredentialsProvider{ctx.Credentials}))
+	if err != nil {
+		slog.Error("Create oss client failed.", "endpoint", endpoint, "error", err)
+		return nil, err
+	}
+	bucket, err := c.Bucket(bucketName)
+	if err != nil {
+		slog.Error("Get oss bucket failed.", "bucket", bucketName, "error", err)
+		return nil, err
+	}
+	return &Oss{Client: c, Bucket: bucket, PartSize: DefaultPartSize, Parallel: DefaultParallel}, nil
+}
+
+// ossCredentialsProvider adapts the credentials cache to the oss sdk.
+type ossCredentialsProvider struct {
+	cache *context.CredentialCache
+}
+
+func (p ossCredentialsProvider) GetCredentials() oss.Credentials {
+	c, err := p.cache.Get()
+	if err != nil {
+		// The request is sent without the credentials, and fails with the access denied error.
+		slog.Error("Get credentials failed.", "error", err)
+		return ossCredentials{&context.Credentials{}}
+	}
+	return ossCredentials{c}
+}
+
+type ossCredentials struct {
+	c *context.Credentials
+}
+
+func (c ossCredentials) GetAccessKeyID() string     { return c.c.AccessKeyId }
+func (c ossCredentials) GetAccessKeySecret() string { return c.c.AccessKeySecret }
+func (c ossCredentials) GetSecurityToken() string   { return c.c.SecurityToken }
+
+func (o *Oss) Get(key string) (io.ReadCloser, error) {
+	body, err := o.Bucket.GetObject(key)
+	if err != nil {
+		return nil, ossError(err)
+	}
+	return body, nil
+}
+
+// Put streams the content to oss with multipart upload, see putMultipart.
+func (o *Oss) Put(key string, r io.Reader) error {
+	_, err := putMultipart(o, key, r, o.PartSize, o.Parallel, nil)
+	return ossError(err)
+}
+
+// PutIf checks the precondition before the object is written, and sends it as If-Match, or x-oss-forbid-overwrite
+// if the object must not exist, so the write fails on the service if the object is changed in between.
+func (o *Oss) PutIf(key string, r io.Reader, etag string) (string, error) {
+	etag, err := putMultipart(o, key, r, o.PartSize, o.Parallel, &condition{etag: etag})
+	return etag, ossError(err)
+}
+
+// conditionOptions returns the request options of the precondition.
+func conditionOptions(cond *condition) []oss.Option {
+	switch {
+	case cond == nil:
+		return nil
+	case cond.etag == "":
+		return []oss.Option{oss.ForbidOverWrite(true)}
+	default:
+		return []oss.Option{oss.IfMatch(`"` + cond.etag + `"`)}
+	}
+}
+
+func (o *Oss) putSingle(key string, data []byte, cond *condition) (string, error) {
+	var header http.Header
+	err := o.Bucket.PutObject(key, bytes.NewReader(data), append(conditionOptions(cond), oss.GetResponseHeader(&header))...)
+	return strings.Trim(header.Get(oss.HTTPHeaderEtag), `"`), err
+}
+
+func (o *Oss) initiate(key string) (string, error) {
+	imur, err := o.Bucket.InitiateMultipartUpload(key)
+	return imur.UploadID, err
+}
+
+func (o *Oss) uploadPart(key string, uploadId string, number int, data []byte) (Part, error) {
+	imur := oss.InitiateMultipartUploadResult{Bucket: o.Bucket.BucketName, Key: key, UploadID: uploadId}
+	part, err := o.Bucket.UploadPart(imur, bytes.NewReader(data), int64(len(data)), number)
+	return Part{Number: part.PartNumber, ETag: part.ETag}, err
+}
+
+func (o *Oss) complete(key string, uploadId string, parts []Part, cond *condition) (string, error) {
+	imur := oss.InitiateMultipartUploadResult{Bucket: o.Bucket.BucketName, Key: key, UploadID: uploadId}
+	ossParts := make([]oss.UploadPart, len(parts))
+	for i, part := range parts {
+		ossParts[i] = oss.UploadPart{PartNumber: part.Number, ETag: part.ETag}
+	}
+	result, err := o.Bucket.CompleteMultipartUpload(imur, ossParts, conditionOptions(cond)...)
+	return strings.Trim(result.ETag, `"`), err
+}
+
+func (o *Oss) abort(key string, uploadId string) error {
+	imur := oss.InitiateMultipartUploadResult{Bucket: o.Bucket.BucketName, Key: key, UploadID: uploadId}
+	return o.Bucket.AbortMultipartUpload(imur)
+}
+
+func (o *Oss) Stat(key string) (*ObjectInfo, error) {
+	header, err := o.Bucket.GetObjectDetailedMeta(key)
+	if err != nil {
+		return nil, ossError(err)
+	}
+	info := &ObjectInfo{
+		Key:  key,
+		ETag: strings.Trim(header.Get(oss.HTTPHeaderEtag), `"`),
+	}
+	info.Size, _ = strconv.ParseInt(header.Get(oss.HTTPHeaderContentLength), 10, 64)
+	info.LastModified, _ = http.ParseTime(header.Get(oss.HTTPHeaderLastModified))
+	return info, nil
+}
+
+func (o *Oss) Delete(key string) error {
+	return ossError(o.Bucket.DeleteObject(key))
+}
+
+func (o *Oss) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	token := ""
+	for {
+		result, err := o.Bucket.ListObjectsV2(oss.Prefix(prefix), oss.ContinuationToken(token))
+		if err != nil {
+			return nil, ossError(err)
+		}
+		for _, obj := range result.Objects {
+			objects = append(objects, ObjectInfo{
+				Key:          obj.Key,
+				Size:         obj.Size,
+				ETag:         strings.Trim(obj.ETag, `"`),
+				LastModified: obj.LastModified,
+			})
+		}
+		if !result.IsTruncated {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (o *Oss) Copy(src string, dst string) error {
+	_, err := o.Bucket.CopyObject(src, dst)
+	return ossError(err)
+}
+
+// ossError converts the oss service errors to the storage errors.
+func ossError(err error) error {
+	var srvErr oss.ServiceError
+	if !errors.As(err, &srvErr) {
+		return err
+	}
+	switch {
+	case srvErr.StatusCode == http.StatusNotFound && (srvErr.Code == "NoSuchKey" || srvErr.Code == ""):
+		return ErrNotFound
+	case srvErr.StatusCode == http.StatusPreconditionFailed || srvErr.Code == "FileAlreadyExists":
+		return fmt.Errorf("%w: %v", ErrPreconditionFailed, err)
+	}
+	return err
+}
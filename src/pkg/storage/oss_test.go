@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"aliyun/serverless/webide-server/pkg/context"
+	"aliyun/serverless/webide-server/pkg/storage/osstest"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+func newTestOss(t *testing.T, server *osstest.Server, accessKeyId string) *Oss {
+	ctx := &context.Context{Credentials: context.NewCredentialCache(&context.StaticProvider{
+		Credentials: context.Credentials{AccessKeyId: accessKeyId, AccessKeySecret: "secret"},
+	}, 0)}
+	backend, err := NewOss(server.Endpoint(), server.Bucket, ctx)
+	if err != nil {
+		t.Fatalf("unable to create oss backend: %v", err)
+	}
+	backend.PartSize, backend.Parallel = MinPartSize, 2
+	return backend
+}
+
+func TestOss(t *testing.T) {
+	server := osstest.NewServer("webide")
+	defer server.Close()
+	server.AccessKeyId = "id"
+	backend := newTestOss(t, server, "id")
+
+	// Missing object.
+	if _, err := backend.Get("tests/missing.tar.gz"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, but got %v", err)
+	}
+	if _, err := backend.Stat("tests/missing.tar.gz"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, but got %v", err)
+	}
+	if err := backend.Copy("tests/missing.tar.gz", "tests/copy.tar.gz"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, but got %v", err)
+	}
+
+	// Put with a single request, and with the multipart upload.
+	large := make([]byte, MinPartSize*2+1)
+	rand.Read(large)
+	objects := map[string][]byte{
+		"tests/small.tar.gz":   []byte("small"),
+		"tests/large.tar.gz":   large,
+		"tests/with space.txt": []byte("space"),
+	}
+	for key, content := range objects {
+		if err := backend.Put(key, bytes.NewReader(content)); err != nil {
+			t.Fatalf("unable to put %s: %v", key, err)
+		}
+	}
+	if n := server.Requests("UploadPart"); n != 3 {
+		t.Fatalf("expected 3 parts uploaded, but got %d", n)
+	}
+	for key, content := range objects {
+		body, err := backend.Get(key)
+		if err != nil {
+			t.Fatalf("unable to get %s: %v", key, err)
+		}
+		data, err := io.ReadAll(body)
+		body.Close()
+		if err != nil || !bytes.Equal(data, content) {
+			t.Fatalf("unexpected content of %s, error: %v", key, err)
+		}
+		info, err := backend.Stat(key)
+		if err != nil || info.Size != int64(len(content)) || info.ETag == "" || info.LastModified.IsZero() {
+			t.Fatalf("unexpected object info of %s: %+v, error: %v", key, info, err)
+		}
+	}
+
+	// Copy and delete.
+	if err := backend.Copy("tests/small.tar.gz", "tests/copy.tar.gz"); err != nil {
+		t.Fatalf("unable to copy: %v", err)
+	}
+	if data, _ := server.GetObject("tests/copy.tar.gz"); string(data) != "small" {
+		t.Fatalf("unexpected copied content %q", data)
+	}
+	if err := backend.Delete("tests/copy.tar.gz"); err != nil {
+		t.Fatalf("unable to delete: %v", err)
+	}
+	if err := backend.Delete("tests/copy.tar.gz"); err != nil {
+		t.Fatalf("delete a non-existent object should succeed, but got %v", err)
+	}
+
+	// List more objects than a page.
+	for i := 0; i < osstest.DefaultMaxKeys+10; i++ {
+		server.PutObject(fmt.Sprintf("tests/blobs/%03d", i), []byte{byte(i)})
+	}
+	list, err := backend.List("tests/blobs/")
+	if err != nil || len(list) != osstest.DefaultMaxKeys+10 {
+		t.Fatalf("expected %d objects, but got %d, error: %v", osstest.DefaultMaxKeys+10, len(list), err)
+	}
+	if list, err = backend.List("tests/with "); err != nil || len(list) != 1 || list[0].Key != "tests/with space.txt" {
+		t.Fatalf("unexpected list %+v, error: %v", list, err)
+	}
+}
+
+func TestOssPutIf(t *testing.T) {
+	server := osstest.NewServer("webide")
+	defer server.Close()
+	backend := newTestOss(t, server, "id")
+
+	for _, size := range []int{5, MinPartSize + 1} {
+		key := fmt.Sprintf("tests/%d.tar.gz", size)
+		content := make([]byte, size)
+		etag, err := backend.PutIf(key, bytes.NewReader(content), "")
+		if err != nil {
+			t.Fatalf("size %d: unable to create: %v", size, err)
+		}
+		if info, err := backend.Stat(key); err != nil || info.ETag != etag {
+			t.Fatalf("size %d: expected etag %s, but got %+v, error: %v", size, etag, info, err)
+		}
+		if etag, err = backend.PutIf(key, bytes.NewReader(content), etag); err != nil {
+			t.Fatalf("size %d: unable to update: %v", size, err)
+		}
+
+		// Changed by others.
+		server.PutObject(key, []byte("others"))
+		for _, expected := range []string{"", etag} {
+			if _, err = backend.PutIf(key, bytes.NewReader(content), expected); !errors.Is(err, ErrPreconditionFailed) {
+				t.Fatalf("size %d: expected ErrPreconditionFailed, but got %v", size, err)
+			}
+		}
+		if data, _ := server.GetObject(key); string(data) != "others" {
+			t.Fatalf("size %d: expected the object not overwritten, but got %d bytes", size, len(data))
+		}
+	}
+	if server.Uploads() != 0 {
+		t.Fatalf("expected the failed uploads aborted, but got %d", server.Uploads())
+	}
+
+	// The service rejects the write if the object is changed after the check.
+	for _, cond := range []*condition{{}, {etag: "stale"}} {
+		if _, err := backend.putSingle("tests/5.tar.gz", []byte("x"), cond); !errors.Is(ossError(err), ErrPreconditionFailed) {
+			t.Fatalf("expected ErrPreconditionFailed, but got %v", err)
+		}
+	}
+}
+
+func TestOssErrors(t *testing.T) {
+	server := osstest.NewServer("webide")
+	defer server.Close()
+	server.AccessKeyId = "id"
+	server.PutObject("tests/workspace.tar.gz", []byte("workspace"))
+
+	// The denied errors are not ErrNotFound, otherwise the stored data would be taken as empty and overwritten.
+	invalid := newTestOss(t, server, "invalid")
+	if _, err := invalid.Get("tests/workspace.tar.gz"); !isOssError(err, "InvalidAccessKeyId") {
+		t.Fatalf("expected InvalidAccessKeyId, but got %v", err)
+	}
+
+	backend := newTestOss(t, server, "id")
+	server.Deny("tests/")
+	if _, err := backend.Get("tests/workspace.tar.gz"); !isOssError(err, "AccessDenied") {
+		t.Fatalf("expected AccessDenied, but got %v", err)
+	}
+	if _, err := backend.Stat("tests/workspace.tar.gz"); errors.Is(err, ErrNotFound) || err == nil {
+		t.Fatalf("expected the access denied error, but got %v", err)
+	}
+	if err := backend.Put("tests/workspace.tar.gz", strings.NewReader("overwritten")); !isOssError(err, "AccessDenied") {
+		t.Fatalf("expected AccessDenied, but got %v", err)
+	}
+	if _, err := backend.List("tests/"); !isOssError(err, "AccessDenied") {
+		t.Fatalf("expected AccessDenied, but got %v", err)
+	}
+	if data, _ := server.GetObject("tests/workspace.tar.gz"); string(data) != "workspace" {
+		t.Fatalf("expected the object not overwritten, but got %q", data)
+	}
+
+	// The multipart upload failed by the reader is aborted.
+	server.Allow()
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write(make([]byte, MinPartSize*2))
+		pw.CloseWithError(errors.New("archive failed"))
+	}()
+	if err := backend.Put("tests/large.tar.gz", pr); err == nil || err.Error() != "archive failed" {
+		t.Fatalf("expected the reader error, but got %v", err)
+	}
+	if server.Requests("InitiateMultipartUpload") != 1 || server.Requests("AbortMultipartUpload") != 1 || server.Uploads() != 0 {
+		t.Fatalf("expected the upload aborted, but got %d uploads", server.Uploads())
+	}
+	if _, ok := server.GetObject("tests/large.tar.gz"); ok {
+		t.Fatalf("expected no object of the aborted upload")
+	}
+}
+
+func isOssError(err error, code string) bool {
+	var srvErr oss.ServiceError
+	return errors.As(err, &srvErr) && srvErr.Code == code
+}
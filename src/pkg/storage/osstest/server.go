@@ -0,0 +1,501 @@
+// Package osstest provides an in-memory OSS compatible server for the tests of the oss storage backend.
+//
+// The server implements the object APIs used by the backend: GetObject, PutObject, HeadObject, DeleteObject,
+// CopyObject, ListObjectsV2 and the multipart upload, with the OSS error responses such as NoSuchKey.
+// PutObject and CompleteMultipartUpload honor the If-Match and x-oss-forbid-overwrite preconditions.
+// The bucket is addressed in path style, which the oss sdk uses for the IP endpoints, e.g. http://127.0.0.1:port/bucket/key
+package osstest
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxKeys is the max number of objects returned by a ListObjectsV2 request, the same as OSS.
+const DefaultMaxKeys = 100
+
+var crcTable = crc64.MakeTable(crc64.ECMA)
+
+// Server is the fake OSS server serving a single bucket.
+type Server struct {
+	*httptest.Server
+	Bucket string
+	// AccessKeyId is the only access key accepted if not empty, the others are rejected with InvalidAccessKeyId.
+	// The signature is not verified.
+	AccessKeyId string
+
+	mu       sync.Mutex
+	objects  map[string]*object
+	uploads  map[string]*upload
+	denied   []string       // the key prefixes which are denied
+	requests map[string]int // number of the requests by the operation name
+	nextId   int
+}
+
+type object struct {
+	data         []byte
+	etag         string
+	lastModified time.Time
+}
+
+type upload struct {
+	key   string
+	parts map[int]*object
+}
+
+// NewServer starts the server of the bucket. The caller should call Close when finished.
+func NewServer(bucket string) *Server {
+	s := &Server{
+		Bucket:   bucket,
+		objects:  map[string]*object{},
+		uploads:  map[string]*upload{},
+		requests: map[string]int{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Endpoint returns the endpoint passed to the oss client.
+func (s *Server) Endpoint() string {
+	return s.URL
+}
+
+// PutObject stores the object directly, e.g. to prepare the data of the tests.
+func (s *Server) PutObject(key string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = newObject(data)
+}
+
+// GetObject returns the content of the object, or false if it does not exist.
+func (s *Server) GetObject(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[key]
+	if !ok {
+		return nil, false
+	}
+	return obj.data, true
+}
+
+// Keys returns the sorted keys of all the objects.
+func (s *Server) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.objects))
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Deny makes the requests on the keys with the prefix fail with AccessDenied, like a RAM policy denying them.
+// The empty prefix denies all the requests.
+func (s *Server) Deny(prefix string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.denied = append(s.denied, prefix)
+}
+
+// Allow removes all the denied prefixes.
+func (s *Server) Allow() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.denied = nil
+}
+
+// Requests returns the number of the requests of the operation, e.g. PutObject or UploadPart.
+func (s *Server) Requests(operation string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[operation]
+}
+
+// Uploads returns the number of the multipart uploads which are neither completed nor aborted.
+func (s *Server) Uploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.uploads)
+}
+
+func newObject(data []byte) *object {
+	sum := md5.Sum(data)
+	return &object{
+		data:         data,
+		etag:         strings.ToUpper(hex.EncodeToString(sum[:])),
+		lastModified: time.Now().UTC().Truncate(time.Second),
+	}
+}
+
+// serviceError is the error response of OSS.
+type serviceError struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+	status  int
+}
+
+func newError(status int, code string, message string) *serviceError {
+	return &serviceError{Code: code, Message: message, status: status}
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextId++
+	w.Header().Set("X-Oss-Request-Id", fmt.Sprintf("%024X", s.nextId))
+
+	// /<bucket>/<key>
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	bucket, key := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		bucket, key = path[:i], path[i+1:]
+	}
+
+	operation, handler := s.route(r, key)
+	s.requests[operation]++
+
+	var err *serviceError
+	if bucket != s.Bucket {
+		err = newError(http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist.")
+	} else if err = s.authorize(r, key); err == nil {
+		err = handler(w, r, key)
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(err.status)
+		// The HEAD responses have no body.
+		if r.Method != http.MethodHead {
+			xml.NewEncoder(w).Encode(err)
+		}
+	}
+}
+
+type handlerFunc func(w http.ResponseWriter, r *http.Request, key string) *serviceError
+
+// route returns the operation name and the handler of the request.
+func (s *Server) route(r *http.Request, key string) (string, handlerFunc) {
+	query := r.URL.Query()
+	_, isUploads := query["uploads"]
+	_, hasUploadId := query["uploadId"]
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		return "ListObjectsV2", s.listObjects
+	case key == "":
+	case r.Method == http.MethodGet:
+		return "GetObject", s.getObject
+	case r.Method == http.MethodHead:
+		return "HeadObject", s.headObject
+	case r.Method == http.MethodPut && hasUploadId:
+		return "UploadPart", s.uploadPart
+	case r.Method == http.MethodPut && r.Header.Get("X-Oss-Copy-Source") != "":
+		return "CopyObject", s.copyObject
+	case r.Method == http.MethodPut:
+		return "PutObject", s.putObject
+	case r.Method == http.MethodPost && isUploads:
+		return "InitiateMultipartUpload", s.initiateMultipartUpload
+	case r.Method == http.MethodPost && hasUploadId:
+		return "CompleteMultipartUpload", s.completeMultipartUpload
+	case r.Method == http.MethodDelete && hasUploadId:
+		return "AbortMultipartUpload", s.abortMultipartUpload
+	case r.Method == http.MethodDelete:
+		return "DeleteObject", s.deleteObject
+	}
+	return "Unsupported", func(w http.ResponseWriter, r *http.Request, key string) *serviceError {
+		return newError(http.StatusNotImplemented, "NotImplemented", r.Method+" "+r.URL.String()+" is not supported by the fake server.")
+	}
+}
+
+func (s *Server) authorize(r *http.Request, key string) *serviceError {
+	if s.AccessKeyId != "" {
+		// Authorization: OSS <access key id>:<signature>
+		id := strings.SplitN(strings.TrimPrefix(r.Header.Get("Authorization"), "OSS "), ":", 2)[0]
+		if id != s.AccessKeyId {
+			return newError(http.StatusForbidden, "InvalidAccessKeyId", "The OSS Access Key Id you provided does not exist in our records.")
+		}
+	}
+	if key == "" {
+		key = r.URL.Query().Get("prefix")
+	}
+	for _, prefix := range s.denied {
+		if strings.HasPrefix(key, prefix) {
+			return newError(http.StatusForbidden, "AccessDenied", "You have no right to access this object because of bucket acl.")
+		}
+	}
+	return nil
+}
+
+func (s *Server) writeObjectHeader(w http.ResponseWriter, obj *object) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+	w.Header().Set("ETag", `"`+obj.etag+`"`)
+	w.Header().Set("Last-Modified", obj.lastModified.Format(http.TimeFormat))
+	w.Header().Set("X-Oss-Hash-Crc64ecma", strconv.FormatUint(crc64.Checksum(obj.data, crcTable), 10))
+}
+
+func (s *Server) getObject(w http.ResponseWriter, r *http.Request, key string) *serviceError {
+	obj, ok := s.objects[key]
+	if !ok {
+		return newError(http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+	}
+	s.writeObjectHeader(w, obj)
+	w.WriteHeader(http.StatusOK)
+	w.Write(obj.data)
+	return nil
+}
+
+func (s *Server) headObject(w http.ResponseWriter, r *http.Request, key string) *serviceError {
+	obj, ok := s.objects[key]
+	if !ok {
+		return newError(http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+	}
+	s.writeObjectHeader(w, obj)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// checkCondition returns the error if the object does not match the precondition of the write.
+func (s *Server) checkCondition(r *http.Request, key string) *serviceError {
+	obj, ok := s.objects[key]
+	if ok && strings.EqualFold(r.Header.Get("X-Oss-Forbid-Overwrite"), "true") {
+		return newError(http.StatusConflict, "FileAlreadyExists", "The object you specified already exists and can not be overwritten.")
+	}
+	if etag := r.Header.Get("If-Match"); etag != "" && (!ok || strings.Trim(etag, `"`) != obj.etag) {
+		return newError(http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold.")
+	}
+	return nil
+}
+
+func (s *Server) putObject(w http.ResponseWriter, r *http.Request, key string) *serviceError {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return newError(http.StatusBadRequest, "IncompleteBody", err.Error())
+	}
+	if serr := s.checkCondition(r, key); serr != nil {
+		return serr
+	}
+	obj := newObject(data)
+	s.objects[key] = obj
+	w.Header().Set("ETag", `"`+obj.etag+`"`)
+	w.Header().Set("X-Oss-Hash-Crc64ecma", strconv.FormatUint(crc64.Checksum(data, crcTable), 10))
+	return nil
+}
+
+func (s *Server) deleteObject(w http.ResponseWriter, r *http.Request, key string) *serviceError {
+	delete(s.objects, key)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *Server) copyObject(w http.ResponseWriter, r *http.Request, key string) *serviceError {
+	// X-Oss-Copy-Source: /<bucket>/<url encoded key>
+	source := strings.TrimPrefix(r.Header.Get("X-Oss-Copy-Source"), "/"+s.Bucket+"/")
+	srcKey, err := url.QueryUnescape(source)
+	if err != nil {
+		return newError(http.StatusBadRequest, "InvalidArgument", "Invalid copy source.")
+	}
+	src, ok := s.objects[srcKey]
+	if !ok {
+		return newError(http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+	}
+	obj := newObject(src.data)
+	s.objects[key] = obj
+	return writeXML(w, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		LastModified string   `xml:"LastModified"`
+		ETag         string   `xml:"ETag"`
+	}{LastModified: obj.lastModified.Format(time.RFC3339), ETag: `"` + obj.etag + `"`})
+}
+
+type listedObject struct {
+	Key          string `xml:"Key"`
+	Type         string `xml:"Type"`
+	Size         int    `xml:"Size"`
+	ETag         string `xml:"ETag"`
+	LastModified string `xml:"LastModified"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+func (s *Server) listObjects(w http.ResponseWriter, r *http.Request, key string) *serviceError {
+	query := r.URL.Query()
+	if query.Get("list-type") != "2" {
+		return newError(http.StatusNotImplemented, "NotImplemented", "Only ListObjectsV2 is supported by the fake server.")
+	}
+	prefix := query.Get("prefix")
+	maxKeys := DefaultMaxKeys
+	if v := query.Get("max-keys"); v != "" {
+		maxKeys, _ = strconv.Atoi(v)
+	}
+	// The continuation token is the last key of the previous page.
+	after := query.Get("continuation-token")
+	if after == "" {
+		after = query.Get("start-after")
+	}
+	escape := func(s string) string { return s }
+	if query.Get("encoding-type") == "url" {
+		escape = url.QueryEscape
+	}
+
+	var keys []string
+	for k := range s.objects {
+		if strings.HasPrefix(k, prefix) && k > after {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	result := struct {
+		XMLName               xml.Name       `xml:"ListBucketResult"`
+		Name                  string         `xml:"Name"`
+		Prefix                string         `xml:"Prefix"`
+		ContinuationToken     string         `xml:"ContinuationToken"`
+		MaxKeys               int            `xml:"MaxKeys"`
+		KeyCount              int            `xml:"KeyCount"`
+		IsTruncated           bool           `xml:"IsTruncated"`
+		NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+		Contents              []listedObject `xml:"Contents"`
+	}{Name: s.Bucket, Prefix: escape(prefix), ContinuationToken: escape(query.Get("continuation-token")), MaxKeys: maxKeys}
+	if len(keys) > maxKeys {
+		keys = keys[:maxKeys]
+		result.IsTruncated = true
+		result.NextContinuationToken = escape(keys[len(keys)-1])
+	}
+	for _, k := range keys {
+		obj := s.objects[k]
+		result.Contents = append(result.Contents, listedObject{
+			Key:          escape(k),
+			Type:         "Normal",
+			Size:         len(obj.data),
+			ETag:         `"` + obj.etag + `"`,
+			LastModified: obj.lastModified.Format(time.RFC3339),
+			StorageClass: "Standard",
+		})
+	}
+	result.KeyCount = len(result.Contents)
+	return writeXML(w, result)
+}
+
+func (s *Server) initiateMultipartUpload(w http.ResponseWriter, r *http.Request, key string) *serviceError {
+	s.nextId++
+	id := fmt.Sprintf("%032X", s.nextId)
+	s.uploads[id] = &upload{key: key, parts: map[int]*object{}}
+	return writeXML(w, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		UploadId string   `xml:"UploadId"`
+	}{Bucket: s.Bucket, Key: key, UploadId: id})
+}
+
+// findUpload returns the upload of the request, or NoSuchUpload.
+func (s *Server) findUpload(r *http.Request, key string) (string, *upload, *serviceError) {
+	id := r.URL.Query().Get("uploadId")
+	u, ok := s.uploads[id]
+	if !ok || u.key != key {
+		return "", nil, newError(http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+	}
+	return id, u, nil
+}
+
+func (s *Server) uploadPart(w http.ResponseWriter, r *http.Request, key string) *serviceError {
+	_, u, serr := s.findUpload(r, key)
+	if serr != nil {
+		return serr
+	}
+	number, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || number < 1 || number > 10000 {
+		return newError(http.StatusBadRequest, "InvalidArgument", "Part number must be an integer between 1 and 10000.")
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return newError(http.StatusBadRequest, "IncompleteBody", err.Error())
+	}
+	part := newObject(data)
+	u.parts[number] = part
+	w.Header().Set("ETag", `"`+part.etag+`"`)
+	w.Header().Set("X-Oss-Hash-Crc64ecma", strconv.FormatUint(crc64.Checksum(data, crcTable), 10))
+	return nil
+}
+
+func (s *Server) completeMultipartUpload(w http.ResponseWriter, r *http.Request, key string) *serviceError {
+	id, u, serr := s.findUpload(r, key)
+	if serr != nil {
+		return serr
+	}
+	if serr = s.checkCondition(r, key); serr != nil {
+		return serr
+	}
+	var body struct {
+		Parts []struct {
+			PartNumber int    `xml:"PartNumber"`
+			ETag       string `xml:"ETag"`
+		} `xml:"Part"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Parts) == 0 {
+		return newError(http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed.")
+	}
+
+	var data bytes.Buffer
+	etags := md5.New()
+	for i, p := range body.Parts {
+		if i > 0 && p.PartNumber <= body.Parts[i-1].PartNumber {
+			return newError(http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order.")
+		}
+		part, ok := u.parts[p.PartNumber]
+		if !ok || strings.Trim(p.ETag, `"`) != part.etag {
+			return newError(http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found.")
+		}
+		data.Write(part.data)
+		sum, _ := hex.DecodeString(part.etag)
+		etags.Write(sum)
+	}
+	delete(s.uploads, id)
+
+	obj := newObject(data.Bytes())
+	obj.etag = fmt.Sprintf("%X-%d", etags.Sum(nil), len(body.Parts))
+	s.objects[key] = obj
+	w.Header().Set("X-Oss-Hash-Crc64ecma", strconv.FormatUint(crc64.Checksum(obj.data, crcTable), 10))
+	return writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Bucket  string   `xml:"Bucket"`
+		Key     string   `xml:"Key"`
+		ETag    string   `xml:"ETag"`
+	}{Bucket: s.Bucket, Key: key, ETag: `"` + obj.etag + `"`})
+}
+
+func (s *Server) abortMultipartUpload(w http.ResponseWriter, r *http.Request, key string) *serviceError {
+	id, _, serr := s.findUpload(r, key)
+	if serr != nil {
+		return serr
+	}
+	delete(s.uploads, id)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) *serviceError {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		return newError(http.StatusInternalServerError, "InternalError", err.Error())
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+	return nil
+}
@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Config is the configuration of the S3 compatible backend.
+type S3Config struct {
+	Endpoint        string // host[:port] of the service, without scheme
+	Bucket          string // bucket where the objects are stored
+	Region          string // optional region of the bucket
+	AccessKeyId     string // if empty, read from the AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY environment variables
+	SecretAccessKey string
+	UseSSL          bool  // use https to access the service
+	PartSize        int64 // part size of the multipart upload
+	Parallel        int   // number of the parts uploaded concurrently
+}
+
+// S3 is the storage backend for the S3 compatible object storage, such as AWS S3 and MinIO.
+type S3 struct {
+	Client   *minio.Client
+	Bucket   string
+	PartSize int64
+	Parallel int
+}
+
+// NewS3 creates the S3 compatible backend.
+func NewS3(cfg S3Config) (*S3, error) {
+	creds := credentials.NewEnvAWS()
+	if cfg.AccessKeyId != "" {
+		creds = credentials.NewStaticV4(cfg.AccessKeyId, cfg.SecretAccessKey, "")
+	}
+	c, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: cfg.UseSSL,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		slog.Error("Create s3 client failed.", "endpoint", cfg.Endpoint, "error", err)
+		return nil, err
+	}
+	backend := &S3{Client: c, Bucket: cfg.Bucket, PartSize: cfg.PartSize, Parallel: cfg.Parallel}
+	if backend.PartSize <= 0 {
+		backend.PartSize = DefaultPartSize
+	}
+	if backend.Parallel <= 0 {
+		backend.Parallel = DefaultParallel
+	}
+	return backend, nil
+}
+
+func (s *S3) Get(key string) (io.ReadCloser, error) {
+	obj, err := s.Client.GetObject(context.Background(), s.Bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	// GetObject is lazy, stat the object to find out whether it exists.
+	if _, err = obj.Stat(); err != nil {
+		obj.Close()
+		return nil, s3Error(err)
+	}
+	return obj, nil
+}
+
+// Put streams the content with multipart upload, see putMultipart.
+func (s *S3) Put(key string, r io.Reader) error {
+	_, err := putMultipart(s, key, r, s.PartSize, s.Parallel, nil)
+	return s3Error(err)
+}
+
+// PutIf checks the precondition before the object is written, the sdk does not send the conditional headers,
+// so a write by others right before the object is written may be overwritten.
+func (s *S3) PutIf(key string, r io.Reader, etag string) (string, error) {
+	etag, err := putMultipart(s, key, r, s.PartSize, s.Parallel, &condition{etag: etag})
+	return etag, s3Error(err)
+}
+
+func (s *S3) core() minio.Core {
+	return minio.Core{Client: s.Client}
+}
+
+func (s *S3) putSingle(key string, data []byte, _ *condition) (string, error) {
+	info, err := s.core().PutObject(context.Background(), s.Bucket, key, bytes.NewReader(data), int64(len(data)), "", "", minio.PutObjectOptions{})
+	return info.ETag, err
+}
+
+func (s *S3) initiate(key string) (string, error) {
+	return s.core().NewMultipartUpload(context.Background(), s.Bucket, key, minio.PutObjectOptions{})
+}
+
+func (s *S3) uploadPart(key string, uploadId string, number int, data []byte) (Part, error) {
+	part, err := s.core().PutObjectPart(context.Background(), s.Bucket, key, uploadId, number, bytes.NewReader(data), int64(len(data)), "", "", nil)
+	return Part{Number: part.PartNumber, ETag: part.ETag}, err
+}
+
+func (s *S3) complete(key string, uploadId string, parts []Part, _ *condition) (string, error) {
+	completeParts := make([]minio.CompletePart, len(parts))
+	for i, part := range parts {
+		completeParts[i] = minio.CompletePart{PartNumber: part.Number, ETag: part.ETag}
+	}
+	return s.core().CompleteMultipartUpload(context.Background(), s.Bucket, key, uploadId, completeParts, minio.PutObjectOptions{})
+}
+
+func (s *S3) abort(key string, uploadId string) error {
+	return s.core().AbortMultipartUpload(context.Background(), s.Bucket, key, uploadId)
+}
+
+func (s *S3) Stat(key string) (*ObjectInfo, error) {
+	obj, err := s.Client.StatObject(context.Background(), s.Bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	return &ObjectInfo{Key: key, Size: obj.Size, ETag: obj.ETag, LastModified: obj.LastModified}, nil
+}
+
+func (s *S3) Delete(key string) error {
+	err := s.Client.RemoveObject(context.Background(), s.Bucket, key, minio.RemoveObjectOptions{})
+	if err = s3Error(err); err == ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func (s *S3) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	opts := minio.ListObjectsOptions{Prefix: prefix, Recursive: true}
+	for obj := range s.Client.ListObjects(context.Background(), s.Bucket, opts) {
+		if obj.Err != nil {
+			return nil, s3Error(obj.Err)
+		}
+		objects = append(objects, ObjectInfo{Key: obj.Key, Size: obj.Size, ETag: obj.ETag, LastModified: obj.LastModified})
+	}
+	return objects, nil
+}
+
+func (s *S3) Copy(src string, dst string) error {
+	_, err := s.Client.CopyObject(context.Background(),
+		minio.CopyDestOptions{Bucket: s.Bucket, Object: dst},
+		minio.CopySrcOptions{Bucket: s.Bucket, Object: src})
+	return s3Error(err)
+}
+
+// s3Error converts the s3 service errors to the storage errors.
+func s3Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	resp := minio.ToErrorResponse(err)
+	if resp.Code == "NoSuchKey" || (resp.StatusCode == http.StatusNotFound && resp.Code != "NoSuchBucket") {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"aliyun/serverless/webide-server/pkg/context"
+	"aliyun/serverless/webide-server/pkg/encryption"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/viper"
+)
+
+// ErrNotFound is returned by the backends when the requested object does not exist.
+var ErrNotFound = errors.New("object not found")
+
+// ErrPreconditionFailed is returned by PutIf when the object is changed since the expected version.
+var ErrPreconditionFailed = errors.New("object is changed by others")
+
+// ObjectInfo describes an object stored in the backend.
+type ObjectInfo struct {
+	Key          string    // object key
+	Size         int64     // object size in bytes
+	ETag         string    // entity tag of the object content
+	LastModified time.Time // last modified time of the object
+}
+
+// Backend is the persistence layer where the vscode server data and the workspace data are stored.
+// Keys are slash separated paths, like the oss object path.
+type Backend interface {
+	// Get opens the object for reading. It returns ErrNotFound if the object does not exist.
+	Get(key string) (io.ReadCloser, error)
+	// Put writes the content of r to the object, overwriting the existing one.
+	Put(key string, r io.Reader) error
+	// PutIf writes the content of r to the object only if the object is not changed: its ETag is etag,
+	// or it does not exist if etag is empty. It returns the ETag of the written object,
+	// or ErrPreconditionFailed if the object is changed.
+	PutIf(key string, r io.Reader, etag string) (string, error)
+	// Stat returns the object info. It returns ErrNotFound if the object does not exist.
+	Stat(key string) (*ObjectInfo, error)
+	// Delete removes the object. Deleting a non-existent object is not an error.
+	Delete(key string) error
+	// List returns all the objects whose key starts with prefix.
+	List(prefix string) ([]ObjectInfo, error)
+	// Copy copies the object src to dst in the backend, overwriting the existing one.
+	// It returns ErrNotFound if src does not exist.
+	Copy(src string, dst string) error
+}
+
+const (
+	DriverOss   = "oss"   // Alibaba Cloud OSS
+	DriverLocal = "local" // local file system directory
+	DriverS3    = "s3"    // S3 compatible object storage, such as MinIO
+)
+
+// New creates the storage backend selected by the `storage.driver` config item.
+// ctx provides the credential info which is required by the oss driver.
+// The local context has no credentials, so the local driver is used instead of the oss driver.
+// The backend is wrapped by Encrypted if the `encryption` is enabled.
+func New(ctx *context.Context) (Backend, error) {
+	backend, err := newBackend(ctx)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := encryption.New()
+	if err != nil {
+		slog.Error("Create encryption key provider failed.", "error", err)
+		return nil, err
+	}
+	if keys == nil {
+		return backend, nil
+	}
+	slog.Info("The objects are encrypted.", "provider", viper.GetString("encryption.provider"))
+	return NewEncrypted(backend, keys), nil
+}
+
+// newBackend creates the backend of the storage driver.
+func newBackend(ctx *context.Context) (Backend, error) {
+	viper.SetDefault("storage.driver", DriverOss)
+	viper.SetDefault("storage.local.directory", "~/.webide/storage")
+	viper.SetDefault("storage.s3.region", "")
+	viper.SetDefault("storage.s3.useSSL", false)
+	viper.SetDefault("storage.oss.endpoint", "")
+	viper.SetDefault("storage.partSize", "16MB")
+	viper.SetDefault("storage.parallel", DefaultParallel)
+	viper.SetDefault("ossBucketName", "")
+
+	partSize := int64(viper.GetSizeInBytes("storage.partSize"))
+	if partSize < MinPartSize {
+		partSize = MinPartSize
+	}
+	parallel := viper.GetInt("storage.parallel")
+	if parallel <= 0 {
+		parallel = 1
+	}
+
+	driver := viper.GetString("storage.driver")
+	if ctx.Source == context.SourceLocal && driver == DriverOss {
+		slog.Info("No oss credentials in the local context, use the local storage driver instead.")
+		driver = DriverLocal
+	}
+	switch driver {
+	case DriverOss:
+		bucketName := viper.GetString("ossBucketName")
+		// high priority env
+		if name := os.Getenv("OSS_BUCKET_NAME"); name != "" {
+			bucketName = name
+		}
+		endpoint := viper.GetString("storage.oss.endpoint")
+		if endpoint == "" {
+			endpoint = "https://oss-" + ctx.Region + ".aliyuncs.com"
+		}
+		backend, err := NewOss(endpoint, bucketName, ctx)
+		if err != nil {
+			return nil, err
+		}
+		backend.PartSize, backend.Parallel = partSize, parallel
+		return backend, nil
+	case DriverLocal:
+		dir, err := homedir.Expand(viper.GetString("storage.local.directory"))
+		if err != nil {
+			slog.Error("Expand local storage directory failed.", "error", err)
+			return nil, err
+		}
+		return NewLocal(dir)
+	case DriverS3:
+		return NewS3(S3Config{
+			Endpoint:        viper.GetString("storage.s3.endpoint"),
+			Bucket:          viper.GetString("storage.s3.bucket"),
+			Region:          viper.GetString("storage.s3.region"),
+			AccessKeyId:     viper.GetString("storage.s3.accessKeyId"),
+			SecretAccessKey: viper.GetString("storage.s3.secretAccessKey"),
+			UseSSL:          viper.GetBool("storage.s3.useSSL"),
+			PartSize:        partSize,
+			Parallel:        parallel,
+		})
+	default:
+		return nil, fmt.Errorf("unsupported storage driver: %s", driver)
+	}
+}
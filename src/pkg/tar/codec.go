@@ -0,0 +1,125 @@
+package tar
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+)
+
+// The codecs compressing the tar stream. The codec of an archive is detected from its magic bytes on extraction,
+// so the archives in any codec can be extracted regardless of the configured one.
+const (
+	CodecGzip  = "gzip"  // single-threaded gzip
+	CodecPgzip = "pgzip" // gzip compressed by blocks in parallel, which is readable by any gzip reader
+	CodecZstd  = "zstd"  // zstandard, faster and smaller than gzip
+	CodecNone  = "none"  // uncompressed tar
+
+	DefaultCodec = CodecPgzip
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	// The ustar, pax and gnu tar headers have "ustar" at the offset 257.
+	tarMagic       = []byte("ustar")
+	tarMagicOffset = 257
+)
+
+// ValidateCodec checks the codec and its level. Level 0 is the default level of the codec,
+// otherwise it is 1-9 for gzip and pgzip, and 1-22 for zstd, which is mapped to the nearest zstd encoder level.
+// The level of none is ignored.
+func ValidateCodec(codec string, level int) error {
+	max := 0
+	switch codec {
+	case CodecGzip, CodecPgzip:
+		max = gzip.BestCompression
+	case CodecZstd:
+		max = 22
+	case CodecNone:
+		return nil
+	default:
+		return fmt.Errorf("unsupported compression codec: %s", codec)
+	}
+	if level < 0 || level > max {
+		return fmt.Errorf("compression level of %s must be 0-%d, but got %d", codec, max, level)
+	}
+	return nil
+}
+
+// nopWriteCloser does not close the underlying writer of the uncompressed tar stream.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// newCompressor returns the writer compressing to w by the codec. Close flushes the compressed data,
+// but does not close w.
+func newCompressor(w io.Writer, codec string, level int) (io.WriteCloser, error) {
+	if err := ValidateCodec(codec, level); err != nil {
+		return nil, err
+	}
+	switch codec {
+	case CodecGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case CodecPgzip:
+		if level == 0 {
+			level = pgzip.DefaultCompression
+		}
+		return pgzip.NewWriterLevel(w, level)
+	case CodecZstd:
+		opts := []zstd.EOption{}
+		if level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		return zstd.NewWriter(w, opts...)
+	default:
+		return nopWriteCloser{w}, nil
+	}
+}
+
+// newDecompressor detects the codec from the magic bytes of r, and returns the reader of the tar stream.
+// It returns io.EOF if r is empty. Close releases the resources of the decompression, but does not close r.
+func newDecompressor(r io.Reader) (io.ReadCloser, string, error) {
+	br := bufio.NewReaderSize(r, 1024)
+	header, err := br.Peek(tarMagicOffset + len(tarMagic))
+	if len(header) == 0 {
+		if err == nil {
+			err = io.EOF
+		}
+		return nil, "", err
+	}
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		// pgzip reads ahead and verifies the checksum in the background, which is faster than compress/gzip.
+		gr, err := pgzip.NewReader(br)
+		if err != nil {
+			return nil, "", err
+		}
+		return gr, CodecGzip, nil
+	case bytes.HasPrefix(header, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, "", err
+		}
+		return zr.IOReadCloser(), CodecZstd, nil
+	case len(header) == tarMagicOffset+len(tarMagic) && bytes.Equal(header[tarMagicOffset:], tarMagic),
+		len(bytes.Trim(header, "\x00")) == 0: // an empty tar is only the zero end blocks
+		return io.NopCloser(br), CodecNone, nil
+	default:
+		if len(header) > 8 {
+			header = header[:8]
+		}
+		return nil, "", fmt.Errorf("unknown archive format, the header is %x", header)
+	}
+}
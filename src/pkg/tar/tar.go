@@ -8,48 +8,175 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 
-	//gzip "github.com/klauspost/pgzip"
-	"compress/gzip"
-
-	"github.com/golang/glog"
+	"golang.org/x/sys/unix"
 )
 
-// Check for path traversal and correct forward slashes
+// ErrLimitExceeded is returned when the archive exceeds the Limits of the extraction.
+var ErrLimitExceeded = errors.New("archive exceeds the extraction limit")
+
+// validRelPath reports whether p is a relative slash separated path which stays within the root directory:
+// it is not absolute, has no ".." component, and contains neither backslashes nor NUL.
 func validRelPath(p string) bool {
-	if p == "" || strings.Contains(p, `\`) || strings.HasPrefix(p, "/") || strings.Contains(p, "../") {
+	if p == "" || strings.HasPrefix(p, "/") || strings.ContainsAny(p, "\\\x00") {
 		return false
 	}
+	for _, part := range strings.Split(p, "/") {
+		if part == ".." {
+			return false
+		}
+	}
 	return true
 }
 
+// Limits bounds the extraction, so a crafted or corrupted archive can not exhaust the disk. Zero means no limit.
+type Limits struct {
+	MaxBytes    int64 // total size of the regular files
+	MaxFiles    int64 // number of the entries
+	MaxFileSize int64 // size of a single regular file
+}
+
+// check returns ErrLimitExceeded if the entry would exceed the limits. files and bytes are extracted before it.
+func (l Limits) check(header *tar.Header, files int64, bytes int64) error {
+	switch {
+	case l.MaxFiles > 0 && files >= l.MaxFiles:
+		return fmt.Errorf("%w: more than %d entries", ErrLimitExceeded, l.MaxFiles)
+	case header.Typeflag != tar.TypeReg:
+		return nil
+	case l.MaxFileSize > 0 && header.Size > l.MaxFileSize:
+		return fmt.Errorf("%w: %s is %d bytes, larger than %d", ErrLimitExceeded, header.Name, header.Size, l.MaxFileSize)
+	case l.MaxBytes > 0 && bytes+header.Size > l.MaxBytes:
+		return fmt.Errorf("%w: more than %d bytes", ErrLimitExceeded, l.MaxBytes)
+	}
+	return nil
+}
+
+// Option configures the archive operations.
+type Option func(*options)
+
+type options struct {
+	progress func(files int64, bytes int64)
+	owner    bool
+	exclude  func(path string, isDir bool) bool
+	skipped  func(path string, files int64, bytes int64)
+	codec    string
+	level    int
+	limits   Limits
+	logger   *slog.Logger
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{codec: DefaultCodec, logger: slog.Default()}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithProgress reports the number of the extracted entries and bytes to fn after each entry.
+func WithProgress(fn func(files int64, bytes int64)) Option {
+	return func(o *options) {
+		o.progress = fn
+	}
+}
+
+// WithOwner restores the uid and gid of the extracted entries, which usually requires the root privilege.
+// The failures to change the owner are logged and ignored.
+func WithOwner() Option {
+	return func(o *options) {
+		o.owner = true
+	}
+}
+
+// WithExclude leaves out of the archive the entries for which exclude returns true.
+// The path is slash separated and relative to the archived directory, and the excluded directories are not walked into.
+func WithExclude(exclude func(path string, isDir bool) bool) Option {
+	return func(o *options) {
+		o.exclude = exclude
+	}
+}
+
+// WithSkipped reports each entry left out by WithExclude to fn, with the number and the total size of the regular files
+// it contains, which are the file itself for a regular file.
+func WithSkipped(fn func(path string, files int64, bytes int64)) Option {
+	return func(o *options) {
+		o.skipped = fn
+	}
+}
+
+// WithLimits bounds the number and the size of the extracted files.
+func WithLimits(limits Limits) Option {
+	return func(o *options) {
+		o.limits = limits
+	}
+}
+
+// WithCompression compresses the archive by the codec at the level, see ValidateCodec. The default is DefaultCodec
+// at its default level.
+func WithCompression(codec string, level int) Option {
+	return func(o *options) {
+		o.codec, o.level = codec, level
+	}
+}
+
+// WithLogger logs the archive operations to logger instead of the default logger.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// modeMask is the file mode bits restored by the extraction. The setuid and setgid bits of the untrusted archives
+// are dropped.
+const modeMask = fs.ModePerm | fs.ModeSticky
+
 // Extract the tar.gz stream data and write to the local file.
-// src is the source of the tar.gz stream
+// src is the source of the tar stream, compressed by any of the codecs or uncompressed, which is detected from the magic bytes.
 // dst is the destination of the local directory. If dst directory does not exist, then create it.
-func ExtractTarGz(src io.Reader, dst string) error {
+// Directories, regular files, symlinks, hardlinks and FIFOs are restored with their mode and mtime.
+// Symlinks may point anywhere, but no entry is written through a symlink resolving outside dst,
+// and hardlinks must link to regular files within dst. Device files are rejected.
+// Regular files are written to temporary files and renamed over the existing ones, so an existing file is
+// replaced as a whole, and never written through when it is a link.
+func ExtractTarGz(src io.Reader, dst string, opts ...Option) error {
+	o := newOptions(opts)
+	var files, bytes int64
+
 	if _, err := os.Stat(dst); err != nil {
 		// Create the directory if necessary.
 		if errors.Is(err, fs.ErrNotExist) {
 			if err = os.MkdirAll(dst, 0755); err != nil {
-				glog.Errorf("Create directory failed: %s Error: %v", dst, err)
+				o.logger.Error("Create directory failed.", "dir", dst, "error", err)
 				return err
 			}
-			glog.Infof("Create directory %s succeeded.", dst)
+			o.logger.Info("Create directory succeeded.", "dir", dst)
 		}
 	}
-	uncompressedStream, err := gzip.NewReader(src)
+	realDst, err := resolve(dst)
+	if err != nil {
+		o.logger.Error("Resolve directory failed.", "dir", dst, "error", err)
+		return err
+	}
+	uncompressedStream, codec, err := newDecompressor(src)
 	if err == io.EOF {
-		glog.Infof("The source is empty: %+v", src)
+		o.logger.Info("The archive is empty.", "dir", dst)
 		return nil
 	} else if err != nil {
-		glog.Errorf("New gzip reader %+v failed: %v", src, err)
+		o.logger.Error("New decompressor failed.", "error", err)
 		return err
 	}
+	defer uncompressedStream.Close()
+	o.logger.Info("Extract the archive.", "codec", codec, "dir", dst)
 
 	tarReader := tar.NewReader(uncompressedStream)
+	// The directories get their mode and mtime after the entries inside are extracted,
+	// so a read-only directory can be populated, and its mtime is not changed by the entries.
+	var dirs []*tar.Header
 
 	for {
 		header, err := tarReader.Next()
@@ -59,129 +186,446 @@ func ExtractTarGz(src io.Reader, dst string) error {
 		}
 
 		if err != nil {
-			glog.Errorf("New tar reader %+v failed: %v", uncompressedStream, err)
+			o.logger.Error("Read tar header failed.", "error", err)
 			return err
 		}
 
 		if !validRelPath(header.Name) {
-			glog.Errorf("Tar conained invalid name: %s", header.Name)
+			o.logger.Error("Tar contained invalid name.", "name", header.Name)
 			return fmt.Errorf("tar containerd invalid name: %s", header.Name)
 		}
+		if err = o.limits.check(header, files+int64(len(dirs)), bytes); err != nil {
+			o.logger.Error("Extract failed.", "name", header.Name, "error", err)
+			return err
+		}
 
 		target := filepath.Join(dst, header.Name)
+		if !within(filepath.Clean(dst), target) {
+			return fmt.Errorf("tar contained name %s outside the destination directory", header.Name)
+		}
+		if err = checkParent(realDst, dst, target); err != nil {
+			o.logger.Error("Extract failed.", "name", header.Name, "error", err)
+			return err
+		}
+		// Any other type would replace the destination directory itself.
+		if target == filepath.Clean(dst) && header.Typeflag != tar.TypeDir {
+			return fmt.Errorf("tar contained the destination directory %s as a non-directory", header.Name)
+		}
 
 		switch header.Typeflag {
 		// If it's a directory and does not exist, then create it with 0755 permission.
 		case tar.TypeDir:
-			if _, err := os.Stat(target); err != nil {
-				if err := os.MkdirAll(target, 0755); err != nil {
-					glog.Errorf("MkdirAll(%s, 0755) failed: %v", target, err)
-					return err
-				}
+			if err := removeUnless(target, fs.FileInfo.IsDir); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(target, 0755); err != nil {
+				o.logger.Error("Create directory failed.", "dir", target, "error", err)
+				return err
 			}
+			dirs = append(dirs, header)
+			continue
 		// If it's a file, create it with same permission.
 		case tar.TypeReg:
-			fileToWrite, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
+			// The other types are replaced by the rename.
+			if err := removeUnless(target, func(fi fs.FileInfo) bool { return !fi.IsDir() }); err != nil {
+				return err
+			}
+			n, err := writeFile(target, tarReader)
 			if err != nil {
-				glog.Errorf("Open file %s failed. Error: %v", target, err)
+				o.logger.Error("Write file failed.", "path", target, "error", err)
 				return err
 			}
-			if _, err := io.Copy(fileToWrite, tarReader); err != nil {
-				glog.Errorf("Write file %+v failed. Error: %v", fileToWrite, err)
+			bytes += n
+		case tar.TypeSymlink:
+			if err := removeUnless(target, nil); err != nil {
 				return err
 			}
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				o.logger.Error("Create symlink failed.", "path", target, "link", header.Linkname, "error", err)
+				return err
+			}
+		case tar.TypeLink:
+			oldname, err := linkTarget(realDst, dst, header.Linkname)
+			if err != nil {
+				o.logger.Error("Create hardlink failed.", "name", header.Name, "error", err)
+				return err
+			}
+			if err := removeUnless(target, nil); err != nil {
+				return err
+			}
+			if err := os.Link(oldname, target); err != nil {
+				o.logger.Error("Create hardlink failed.", "path", target, "link", oldname, "error", err)
+				return err
+			}
+		case tar.TypeFifo:
+			if err := removeUnless(target, nil); err != nil {
+				return err
+			}
+			if err := syscall.Mkfifo(target, uint32(header.FileInfo().Mode().Perm())); err != nil {
+				o.logger.Error("Create fifo failed.", "path", target, "error", err)
+				return err
+			}
+		case tar.TypeChar, tar.TypeBlock:
+			o.logger.Error("Tar contained device file.", "name", header.Name)
+			return fmt.Errorf("tar contained device file: %s", header.Name)
+		default:
+			o.logger.Warn("Skip the entry of unsupported type.", "name", header.Name, "type", string(header.Typeflag))
+		}
 
-			// Manually close here after each file operation. defering would cause each file
-			// close to wait until all operations have completed.
-			fileToWrite.Close()
+		if err = restoreMetadata(target, header, o); err != nil {
+			return err
+		}
+
+		files++
+		if o.progress != nil {
+			o.progress(files, bytes)
+		}
+	}
+
+	// The inner directories first, so the outer ones are not modified afterwards.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		target := filepath.Join(dst, dirs[i].Name)
+		// The directory may be replaced by a later entry, e.g. a symlink pointing outside,
+		// whose target must never get the metadata.
+		if !extractedDir(realDst, dst, target) {
+			o.logger.Warn("Skip the metadata of the replaced directory.", "name", dirs[i].Name)
+		} else if err := restoreMetadata(target, dirs[i], o); err != nil {
+			return err
+		}
+		files++
+		if o.progress != nil {
+			o.progress(files, bytes)
 		}
 	}
 
 	return nil
 }
 
+// resolve returns the absolute path of p with the symlinks evaluated.
+func resolve(p string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(resolved)
+}
+
+// within reports whether path is dir or inside it. Both are cleaned absolute paths.
+func within(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// checkParent makes sure the parent directory of target resolves within realDst,
+// so the entries are never written through the symlinks pointing outside.
+func checkParent(realDst string, dst string, target string) error {
+	if target == filepath.Clean(dst) {
+		return nil
+	}
+	// The missing directories are created inside the nearest existing one.
+	dir := filepath.Dir(target)
+	for {
+		if _, err := os.Lstat(dir); err == nil {
+			break
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		dir = filepath.Dir(dir)
+	}
+	resolved, err := resolve(dir)
+	if err != nil {
+		return err
+	}
+	if !within(realDst, resolved) {
+		return fmt.Errorf("%s resolves to %s outside the destination directory", dir, resolved)
+	}
+	return nil
+}
+
+// CheckTarget makes sure target is inside dst, and its parent directory is not reached through a symlink resolving
+// outside dst, which is checked for every extracted entry. It is shared by the other restores into a directory,
+// e.g. the snapshots, so they write the entries the same way.
+func CheckTarget(dst string, target string) error {
+	if !within(filepath.Clean(dst), target) {
+		return fmt.Errorf("%s is outside the destination directory", target)
+	}
+	realDst, err := resolve(dst)
+	if err != nil {
+		return err
+	}
+	return checkParent(realDst, dst, target)
+}
+
+// extractedDir reports whether target is still a directory within realDst, neither replaced by another type
+// nor reached through a symlink.
+func extractedDir(realDst string, dst string, target string) bool {
+	if checkParent(realDst, dst, target) != nil {
+		return false
+	}
+	info, err := os.Lstat(target)
+	return err == nil && info.IsDir()
+}
+
+// linkTarget returns the existing regular file of the hardlink within dst.
+func linkTarget(realDst string, dst string, linkname string) (string, error) {
+	if !validRelPath(linkname) {
+		return "", fmt.Errorf("invalid hardlink target %s", linkname)
+	}
+	resolved, err := resolve(filepath.Join(dst, linkname))
+	if err != nil {
+		return "", err
+	}
+	if !within(realDst, resolved) {
+		return "", fmt.Errorf("hardlink target %s resolves to %s outside the destination directory", linkname, resolved)
+	}
+	if info, err := os.Lstat(resolved); err != nil || !info.Mode().IsRegular() {
+		return "", fmt.Errorf("hardlink target %s is not a regular file", linkname)
+	}
+	return resolved, nil
+}
+
+// writeFile writes the content to a temporary file in the directory of target, and renames it to target.
+func writeFile(target string, content io.Reader) (int64, error) {
+	f, err := os.CreateTemp(filepath.Dir(target), ".webide-extract-*")
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), target)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return n, err
+}
+
+// removeUnless removes the existing target if keep returns false for it, e.g. a symlink where a file is extracted.
+// keep nil removes any existing target.
+func removeUnless(target string, keep func(fs.FileInfo) bool) error {
+	info, err := os.Lstat(target)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if keep != nil && keep(info) {
+		return nil
+	}
+	if err = os.RemoveAll(target); err != nil {
+		return fmt.Errorf("remove existing %s: %w", target, err)
+	}
+	return nil
+}
+
+// restoreMetadata restores the owner, mode and mtime of the extracted entry.
+func restoreMetadata(target string, header *tar.Header, o *options) error {
+	switch header.Typeflag {
+	case tar.TypeLink:
+		// The metadata belongs to the linked file.
+		return nil
+	case tar.TypeDir, tar.TypeReg, tar.TypeSymlink, tar.TypeFifo:
+	default:
+		return nil
+	}
+
+	// The owner is changed first, the mode is restored afterwards.
+	if o.owner {
+		if err := os.Lchown(target, header.Uid, header.Gid); err != nil {
+			o.logger.Warn("Change owner failed.", "path", target, "uid", header.Uid, "gid", header.Gid, "error", err)
+		}
+	}
+
+	mtime := unix.NsecToTimespec(header.ModTime.UnixNano())
+	if header.Typeflag == tar.TypeSymlink {
+		// The mode of symlinks is not used on linux, only the mtime is restored.
+		err := unix.UtimesNanoAt(unix.AT_FDCWD, target, []unix.Timespec{mtime, mtime}, unix.AT_SYMLINK_NOFOLLOW)
+		if err != nil {
+			o.logger.Warn("Change mtime of symlink failed.", "path", target, "error", err)
+		}
+		return nil
+	}
+
+	if err := os.Chmod(target, header.FileInfo().Mode()&modeMask); err != nil {
+		o.logger.Error("Change mode failed.", "path", target, "error", err)
+		return err
+	}
+	if err := os.Chtimes(target, header.ModTime, header.ModTime); err != nil {
+		o.logger.Error("Change mtime failed.", "path", target, "error", err)
+		return err
+	}
+	return nil
+}
+
 // Compress a file or directory as tar.gz and write to the destination io stream.
 // src is the source of the file or directory.
 // dst is the destination of the io stream.
-func TarGz(src string, dst io.Writer) error {
-	gzipWriter := gzip.NewWriter(dst)
-	tarWriter := tar.NewWriter(gzipWriter)
+// The codec is chosen by WithCompression, and WithExclude and WithSkipped apply to the entries in the directory.
+func TarGz(src string, dst io.Writer, opts ...Option) error {
+	o := newOptions(opts)
+	compressor, err := newCompressor(dst, o.codec, o.level)
+	if err != nil {
+		o.logger.Error("New compressor failed.", "codec", o.codec, "error", err)
+		return err
+	}
+	tarWriter := tar.NewWriter(compressor)
 
 	fi, err := os.Stat(src)
 	if err != nil {
-		glog.Errorf("Stat %s failed. Error: %v", src, err)
+		o.logger.Error("Stat failed.", "path", src, "error", err)
 		return err
 	}
 	mode := fi.Mode()
 	if mode.IsRegular() { // handle regular file
 		header, err := tar.FileInfoHeader(fi, src)
 		if err != nil {
-			glog.Errorf("Get %s file info failed: %v", src, err)
+			o.logger.Error("Get file info header failed.", "path", src, "error", err)
 			return err
 		}
 		if err := tarWriter.WriteHeader(header); err != nil {
-			glog.Errorf("Write file header failed: %v", err)
+			o.logger.Error("Write tar header failed.", "path", src, "error", err)
 			return err
 		}
 		data, err := os.Open(src)
 		if err != nil {
-			glog.Errorf("Open file %s failed: %v", src, err)
+			o.logger.Error("Open file failed.", "path", src, "error", err)
 			return err
 		}
+		defer data.Close()
 		if _, err := io.Copy(tarWriter, data); err != nil {
-			glog.Errorf("Write tar failed: %v", err)
+			o.logger.Error("Write tar stream failed.", "path", src, "error", err)
 			return err
 		}
 	} else if mode.IsDir() { // handle directory
-		filepath.Walk(src, func(path string, info fs.FileInfo, err error) error {
-			// Generate the tar header.
-			header, err := tar.FileInfoHeader(info, path)
+		// The first archived path of the files having multiple links, which the other links are archived as hardlinks to.
+		links := map[inode]string{}
+		err = filepath.Walk(src, func(path string, info fs.FileInfo, err error) error {
 			if err != nil {
-				glog.Errorf("Get %s file info header failed: %v", path, err)
+				o.logger.Error("Walk failed.", "path", path, "error", err)
 				return err
 			}
 
-			header.Name, err = filepath.Rel(src, path)
+			name, err := filepath.Rel(src, path)
+			if err != nil {
+				o.logger.Error("Get relative path failed.", "base", src, "path", path, "error", err)
+				return err
+			}
+			name = filepath.ToSlash(name)
+			if o.exclude != nil && name != "." && o.exclude(name, info.IsDir()) {
+				if o.skipped != nil {
+					files, bytes := usage(path)
+					o.skipped(name, files, bytes)
+				}
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			// The symlinks are archived as they are, which is not followed by Walk.
+			var link string
+			mode := info.Mode()
+			switch {
+			case mode&fs.ModeSymlink != 0:
+				if link, err = os.Readlink(path); err != nil {
+					o.logger.Error("Read symlink failed.", "path", path, "error", err)
+					return err
+				}
+			case mode&(fs.ModeSocket|fs.ModeDevice) != 0:
+				o.logger.Warn("Skip the file of unsupported type.", "path", path, "type", mode.Type().String())
+				return nil
+			}
+
+			// Generate the tar header.
+			header, err := tar.FileInfoHeader(info, link)
 			if err != nil {
-				glog.Errorf("Get relative path failed. Base path: %s Target path: %s Error: %v", src, path, err)
+				o.logger.Error("Get file info header failed.", "path", path, "error", err)
 				return err
 			}
 
+			header.Name = name
+
+			if mode.IsRegular() {
+				if ino, ok := fileInode(info); ok {
+					if first, ok := links[ino]; ok {
+						header.Typeflag, header.Linkname, header.Size = tar.TypeLink, first, 0
+					} else {
+						links[ino] = header.Name
+					}
+				}
+			}
+
 			// Write tar header.
 			if err := tarWriter.WriteHeader(header); err != nil {
-				glog.Errorf("Write tar header failed: %v", err)
+				o.logger.Error("Write tar header failed.", "path", path, "error", err)
 				return err
 			}
 
 			// Write regular file.
-			if !info.IsDir() {
+			if header.Typeflag == tar.TypeReg {
 				data, err := os.Open(path)
 				if err != nil {
-					glog.Errorf("Open %s file failed: %v", path, err)
+					o.logger.Error("Open file failed.", "path", path, "error", err)
 					return err
 				}
-				if _, err := io.Copy(tarWriter, data); err != nil {
-					glog.Errorf("Write tar stream failed: %v", err)
+				_, err = io.Copy(tarWriter, data)
+				data.Close()
+				if err != nil {
+					o.logger.Error("Write tar stream failed.", "path", path, "error", err)
 					return err
 				}
 			}
 
 			return nil
 		})
+		if err != nil {
+			return err
+		}
 	} else {
-		glog.Errorf("File type not supported: %s", mode.String())
+		o.logger.Error("File type not supported.", "path", src, "mode", mode.String())
 		return fmt.Errorf("unsupported file type: %s", mode.String())
 	}
 
 	if err := tarWriter.Close(); err != nil {
-		glog.Errorf("Close tar writer failed: %v", err)
+		o.logger.Error("Close tar writer failed.", "error", err)
 		return err
 	}
 
-	if err := gzipWriter.Close(); err != nil {
-		glog.Errorf("Close gzip writer failed: %v", err)
+	if err := compressor.Close(); err != nil {
+		o.logger.Error("Close compressor failed.", "codec", o.codec, "error", err)
 		return err
 	}
 
 	return nil
 }
+
+// usage returns the number and the total size of the regular files in path, or of path itself if it is a file.
+// The errors are ignored, the usage is only reported.
+func usage(path string) (files int64, bytes int64) {
+	filepath.Walk(path, func(_ string, info fs.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			files++
+			bytes += info.Size()
+		}
+		return nil
+	})
+	return files, bytes
+}
+
+// inode identifies a file on the file systems.
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+// fileInode returns the inode of the file if it has multiple links.
+func fileInode(info fs.FileInfo) (inode, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 {
+		return inode{}, false
+	}
+	return inode{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
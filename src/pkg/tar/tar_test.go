@@ -3,13 +3,17 @@ package tar
 import (
 	"archive/tar"
 	"bytes"
+	"errors"
+	"io"
 	"io/fs"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
-	//gzip "github.com/klauspost/pgzip"
 	"compress/gzip"
 )
 
@@ -176,3 +180,448 @@ func TestExtracTarGz(t *testing.T) {
 		}
 	}
 }
+
+func TestExtractTarGzProgress(t *testing.T) {
+	var (
+		buf = bytes.NewBuffer(nil)
+		gw  = gzip.NewWriter(buf)
+		tw  = tar.NewWriter(gw)
+	)
+	tw.WriteHeader(&tar.Header{Name: "dir", Mode: 0755, Typeflag: tar.TypeDir})
+	for _, name := range []string{"dir/file1.txt", "dir/file2.txt"} {
+		tw.WriteHeader(&tar.Header{Name: name, Size: 100, Mode: 0644, Typeflag: tar.TypeReg})
+		tw.Write(make([]byte, 100))
+	}
+	tw.Close()
+	gw.Close()
+
+	dst, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Fatalf("unable to create temporary dir: %v", err)
+	}
+	defer os.RemoveAll(dst)
+
+	var files, bytes int64
+	err = ExtractTarGz(buf, dst, WithProgress(func(f int64, b int64) {
+		files, bytes = f, b
+	}))
+	if err != nil {
+		t.Fatalf("cannot extract tar.gz content: %v", err)
+	}
+	if files != 3 || bytes != 200 {
+		t.Fatalf("expected 3 entries and 200 bytes, but got %d entries and %d bytes", files, bytes)
+	}
+}
+
+func TestTarGzLinks(t *testing.T) {
+	root, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Fatalf("unable to create temporary dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	// Like a python venv: the links inside the directory, to the outside, and the read-only directories.
+	src := filepath.Join(root, "src")
+	mtime := time.Date(2022, 5, 1, 8, 0, 0, 0, time.UTC)
+	steps := []func() error{
+		func() error { return os.MkdirAll(filepath.Join(src, "venv/bin"), 0755) },
+		func() error { return os.WriteFile(filepath.Join(src, "venv/bin/activate"), []byte("activate"), 0700) },
+		func() error {
+			return os.Link(filepath.Join(src, "venv/bin/activate"), filepath.Join(src, "venv/bin/activate.link"))
+		},
+		func() error { return os.Symlink("activate", filepath.Join(src, "venv/bin/activate.sh")) },
+		func() error { return os.Symlink("/usr/bin/python3", filepath.Join(src, "venv/bin/python")) },
+		func() error { return os.Symlink("venv/bin", filepath.Join(src, "bin")) },
+		func() error { return syscall.Mkfifo(filepath.Join(src, "fifo"), 0600) },
+		func() error { return os.Chtimes(filepath.Join(src, "venv/bin/activate"), mtime, mtime) },
+		func() error { return os.MkdirAll(filepath.Join(src, "readonly"), 0755) },
+		func() error { return os.WriteFile(filepath.Join(src, "readonly/file"), []byte("file"), 0444) },
+		func() error { return os.Chmod(filepath.Join(src, "readonly"), 0555) },
+	}
+	for _, step := range steps {
+		if err = step(); err != nil {
+			t.Fatalf("unable to prepare the files: %v", err)
+		}
+	}
+	defer os.Chmod(filepath.Join(src, "readonly"), 0755)
+
+	var buf bytes.Buffer
+	if err = TarGz(src, &buf); err != nil {
+		t.Fatalf("unable to archive: %v", err)
+	}
+	dst := filepath.Join(root, "dst")
+	if err = ExtractTarGz(&buf, dst); err != nil {
+		t.Fatalf("unable to extract: %v", err)
+	}
+	defer os.Chmod(filepath.Join(dst, "readonly"), 0755)
+
+	for name, expected := range map[string]string{
+		"venv/bin/activate.sh": "activate",
+		"venv/bin/python":      "/usr/bin/python3",
+		"bin":                  "venv/bin",
+	} {
+		if link, err := os.Readlink(filepath.Join(dst, name)); err != nil || link != expected {
+			t.Fatalf("expected symlink %s -> %s, but got %s, error: %v", name, expected, link, err)
+		}
+	}
+	original, _ := os.Stat(filepath.Join(dst, "venv/bin/activate"))
+	link, _ := os.Stat(filepath.Join(dst, "venv/bin/activate.link"))
+	if original == nil || link == nil || !os.SameFile(original, link) {
+		t.Fatalf("expected the hardlink restored")
+	}
+	if original.Mode().Perm() != 0700 || !original.ModTime().Equal(mtime) {
+		t.Fatalf("expected mode 0700 and mtime %s, but got %s and %s", mtime, original.Mode(), original.ModTime())
+	}
+	if info, err := os.Lstat(filepath.Join(dst, "fifo")); err != nil || info.Mode()&fs.ModeNamedPipe == 0 {
+		t.Fatalf("expected the fifo restored, error: %v", err)
+	}
+	// The mtime is rounded to seconds in the archive.
+	for name, expected := range map[string]fs.FileMode{"readonly": fs.ModeDir | 0555, "readonly/file": 0444} {
+		srcInfo, _ := os.Stat(filepath.Join(src, name))
+		info, err := os.Stat(filepath.Join(dst, name))
+		if err != nil || info.Mode() != expected || !info.ModTime().Equal(srcInfo.ModTime().Round(time.Second)) {
+			t.Fatalf("unexpected %s: %v, error: %v", name, info, err)
+		}
+	}
+}
+
+func TestExtractTarGzLinkEscape(t *testing.T) {
+	root, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Fatalf("unable to create temporary dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	outside := filepath.Join(root, "outside")
+	if err = os.MkdirAll(outside, 0755); err != nil {
+		t.Fatalf("unable to create dir: %v", err)
+	}
+	if err = os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+
+	reg := func(name string) *tar.Header {
+		return &tar.Header{Name: name, Mode: 0644, Size: 4, Typeflag: tar.TypeReg}
+	}
+	cases := []struct {
+		name    string
+		headers []*tar.Header
+	}{
+		{"write through absolute symlink", []*tar.Header{
+			{Name: "a", Linkname: outside, Typeflag: tar.TypeSymlink}, reg("a/evil"),
+		}},
+		{"write through relative symlink", []*tar.Header{
+			{Name: "dir", Mode: 0755, Typeflag: tar.TypeDir},
+			{Name: "dir/up", Linkname: "../..", Typeflag: tar.TypeSymlink}, reg("dir/up/outside/evil"),
+		}},
+		{"hardlink outside", []*tar.Header{
+			{Name: "link", Linkname: "../outside/secret", Typeflag: tar.TypeLink},
+		}},
+		{"hardlink through symlink", []*tar.Header{
+			{Name: "s", Linkname: filepath.Join(outside, "secret"), Typeflag: tar.TypeSymlink},
+			{Name: "link", Linkname: "s", Typeflag: tar.TypeLink}, reg("link"),
+		}},
+	}
+	for _, c := range cases {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gw)
+		for _, h := range c.headers {
+			tw.WriteHeader(h)
+			if h.Typeflag == tar.TypeReg {
+				tw.Write([]byte("evil"))
+			}
+		}
+		tw.Close()
+		gw.Close()
+
+		dst := filepath.Join(root, "dst")
+		if err = ExtractTarGz(&buf, dst); err == nil {
+			t.Fatalf("%s: expected the extraction failed", c.name)
+		}
+		if entries, _ := os.ReadDir(outside); len(entries) != 1 {
+			t.Fatalf("%s: expected nothing written outside, but got %v", c.name, entries)
+		}
+		if data, _ := os.ReadFile(filepath.Join(outside, "secret")); string(data) != "secret" {
+			t.Fatalf("%s: expected the outside file untouched, but got %q", c.name, data)
+		}
+		os.RemoveAll(dst)
+	}
+
+	// The existing symlink is replaced by the extracted file, instead of writing through it.
+	dst := filepath.Join(root, "dst")
+	os.MkdirAll(dst, 0755)
+	if err = os.Symlink(filepath.Join(outside, "secret"), filepath.Join(dst, "file")); err != nil {
+		t.Fatalf("unable to create symlink: %v", err)
+	}
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	tw.WriteHeader(reg("file"))
+	tw.Write([]byte("file"))
+	tw.Close()
+	gw.Close()
+	if err = ExtractTarGz(&buf, dst); err != nil {
+		t.Fatalf("unable to extract: %v", err)
+	}
+	if info, err := os.Lstat(filepath.Join(dst, "file")); err != nil || !info.Mode().IsRegular() {
+		t.Fatalf("expected the regular file, error: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(outside, "secret")); string(data) != "secret" {
+		t.Fatalf("expected the outside file untouched, but got %q", data)
+	}
+
+	// The metadata of a directory replaced by a symlink is not applied to the symlink target.
+	before, err := os.Stat(outside)
+	if err != nil {
+		t.Fatalf("unable to stat: %v", err)
+	}
+	buf.Reset()
+	gw = gzip.NewWriter(&buf)
+	tw = tar.NewWriter(gw)
+	tw.WriteHeader(&tar.Header{Name: "replaced", Mode: 0777, ModTime: time.Unix(1000, 0), Typeflag: tar.TypeDir})
+	tw.WriteHeader(&tar.Header{Name: "replaced", Linkname: outside, Typeflag: tar.TypeSymlink})
+	tw.Close()
+	gw.Close()
+	if err = ExtractTarGz(&buf, dst); err != nil {
+		t.Fatalf("unable to extract: %v", err)
+	}
+	after, err := os.Stat(outside)
+	if err != nil || after.Mode() != before.Mode() || !after.ModTime().Equal(before.ModTime()) {
+		t.Fatalf("expected the outside directory untouched, but got %v %v, error: %v", after.Mode(), after.ModTime(), err)
+	}
+}
+
+func TestTarGzExclude(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(root, "src")
+	files := map[string]string{
+		"main.go":                     "package main",
+		"node_modules/react/index.js": "react",
+		"node_modules/react/lib.js":   "library",
+		"web/debug.log":               "debug",
+		"web/index.html":              "html",
+	}
+	for name, content := range files {
+		p := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("unable to create dir: %v", err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatalf("unable to write file: %v", err)
+		}
+	}
+
+	var excluded []string
+	skipped := map[string][2]int64{}
+	exclude := func(path string, isDir bool) bool {
+		excluded = append(excluded, path)
+		return (path == "node_modules" && isDir) || filepath.Ext(path) == ".log"
+	}
+	var buf bytes.Buffer
+	err := TarGz(src, &buf, WithExclude(exclude), WithSkipped(func(path string, files int64, bytes int64) {
+		skipped[path] = [2]int64{files, bytes}
+	}))
+	if err != nil {
+		t.Fatalf("unable to archive: %v", err)
+	}
+	expected := map[string][2]int64{"node_modules": {2, 12}, "web/debug.log": {1, 5}}
+	if len(skipped) != len(expected) || skipped["node_modules"] != expected["node_modules"] || skipped["web/debug.log"] != expected["web/debug.log"] {
+		t.Fatalf("expected skipped %v, but got %v", expected, skipped)
+	}
+	for _, path := range excluded {
+		if filepath.Dir(path) == "node_modules" || path == "." {
+			t.Fatalf("expected %s not checked", path)
+		}
+	}
+
+	dst := filepath.Join(root, "dst")
+	if err = ExtractTarGz(&buf, dst); err != nil {
+		t.Fatalf("unable to extract: %v", err)
+	}
+	for name := range files {
+		_, err := os.Stat(filepath.Join(dst, name))
+		if ok := err == nil; ok != (name == "main.go" || name == "web/index.html") {
+			t.Fatalf("unexpected existence of %s: %v", name, err)
+		}
+	}
+}
+
+func TestTarGzCodecs(t *testing.T) {
+	src := t.TempDir()
+	content := bytes.Repeat([]byte("compressible content "), 1000)
+	for _, name := range []string{"a.txt", "dir/b.txt"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(src, name)), 0755); err != nil {
+			t.Fatalf("unable to create dir: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(src, name), content, 0644); err != nil {
+			t.Fatalf("unable to write file: %v", err)
+		}
+	}
+
+	cases := []struct {
+		codec string
+		level int
+		magic []byte
+	}{
+		{CodecGzip, 0, gzipMagic},
+		{CodecGzip, 9, gzipMagic},
+		{CodecPgzip, 0, gzipMagic},
+		{CodecPgzip, 1, gzipMagic},
+		{CodecZstd, 0, zstdMagic},
+		{CodecZstd, 19, zstdMagic},
+		{CodecNone, 0, nil},
+	}
+	for _, c := range cases {
+		var buf bytes.Buffer
+		if err := TarGz(src, &buf, WithCompression(c.codec, c.level)); err != nil {
+			t.Fatalf("%s %d: unable to archive: %v", c.codec, c.level, err)
+		}
+		if !bytes.HasPrefix(buf.Bytes(), c.magic) {
+			t.Fatalf("%s %d: unexpected header %x", c.codec, c.level, buf.Bytes()[:8])
+		}
+		if c.codec != CodecNone && buf.Len() > len(content) {
+			t.Fatalf("%s %d: expected compressed, but got %d bytes", c.codec, c.level, buf.Len())
+		}
+		dst := t.TempDir()
+		if err := ExtractTarGz(&buf, dst); err != nil {
+			t.Fatalf("%s %d: unable to extract: %v", c.codec, c.level, err)
+		}
+		if err := exec.Command("diff", "--recursive", src, dst).Run(); err != nil {
+			t.Fatalf("%s %d: the extracted directory is different: %v", c.codec, c.level, err)
+		}
+	}
+
+	// The default codec is readable by any gzip reader.
+	var buf bytes.Buffer
+	if err := TarGz(src, &buf); err != nil {
+		t.Fatalf("unable to archive: %v", err)
+	}
+	if _, err := gzip.NewReader(&buf); err != nil {
+		t.Fatalf("expected a gzip stream, but got %v", err)
+	}
+
+	for _, c := range []struct {
+		codec string
+		level int
+	}{{"lz4", 0}, {CodecGzip, 10}, {CodecZstd, -1}} {
+		if err := TarGz(src, io.Discard, WithCompression(c.codec, c.level)); err == nil {
+			t.Fatalf("%s %d: expected the invalid codec error", c.codec, c.level)
+		}
+	}
+	if err := ExtractTarGz(bytes.NewReader([]byte("not an archive")), t.TempDir()); err == nil {
+		t.Fatalf("expected the unknown format error")
+	}
+	if err := ExtractTarGz(bytes.NewReader(nil), t.TempDir()); err != nil {
+		t.Fatalf("expected the empty source extracted, but got %v", err)
+	}
+}
+
+// newTarGz archives the headers, the regular files are filled with x up to their size.
+func newTarGz(t *testing.T, headers ...*tar.Header) *bytes.Buffer {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, h := range headers {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatalf("unable to write header %s: %v", h.Name, err)
+		}
+		if h.Typeflag == tar.TypeReg {
+			tw.Write(bytes.Repeat([]byte("x"), int(h.Size)))
+		}
+	}
+	tw.Close()
+	gw.Close()
+	return &buf
+}
+
+func TestExtractTarGzHardened(t *testing.T) {
+	reg := func(name string, size int64) *tar.Header {
+		return &tar.Header{Name: name, Mode: 0644, Size: size, Typeflag: tar.TypeReg}
+	}
+
+	// The names escaping dst, the device files and the archives exceeding the limits are rejected.
+	cases := []struct {
+		name    string
+		headers []*tar.Header
+		limits  Limits
+	}{
+		{"parent", []*tar.Header{reg("..", 1)}, Limits{}},
+		{"trailing parent", []*tar.Header{reg("a/../..", 1)}, Limits{}},
+		{"inner parent", []*tar.Header{reg("a/../../evil", 1)}, Limits{}},
+		{"absolute", []*tar.Header{reg("/tmp/evil", 1)}, Limits{}},
+		{"backslash", []*tar.Header{reg(`..\evil`, 1)}, Limits{}},
+		{"char device", []*tar.Header{{Name: "null", Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3}}, Limits{}},
+		{"block device", []*tar.Header{{Name: "sda", Typeflag: tar.TypeBlock, Devmajor: 8}}, Limits{}},
+		{"max files", []*tar.Header{{Name: "dir", Mode: 0755, Typeflag: tar.TypeDir}, reg("dir/a", 1), reg("dir/b", 1)}, Limits{MaxFiles: 2}},
+		{"max file size", []*tar.Header{reg("a", 10), reg("b", 11)}, Limits{MaxFileSize: 10}},
+		{"max bytes", []*tar.Header{reg("a", 10), reg("b", 10), reg("c", 1)}, Limits{MaxBytes: 20}},
+	}
+	root := t.TempDir()
+	for _, c := range cases {
+		dst := filepath.Join(root, "dst", "workspace")
+		err := ExtractTarGz(newTarGz(t, c.headers...), dst, WithLimits(c.limits))
+		if err == nil {
+			t.Fatalf("%s: expected the extraction failed", c.name)
+		}
+		if (c.limits != Limits{}) && !errors.Is(err, ErrLimitExceeded) {
+			t.Fatalf("%s: expected ErrLimitExceeded, but got %v", c.name, err)
+		}
+		if entries, _ := os.ReadDir(filepath.Dir(dst)); len(entries) != 1 {
+			t.Fatalf("%s: expected nothing written outside, but got %v", c.name, entries)
+		}
+		os.RemoveAll(filepath.Join(root, "dst"))
+	}
+
+	// The destination directory is never replaced.
+	dst := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dst, "keep"), []byte("keep"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	for _, name := range []string{".", "./."} {
+		if err := ExtractTarGz(newTarGz(t, reg(name, 1)), dst); err == nil {
+			t.Fatalf("%q: expected the extraction failed", name)
+		}
+		if data, _ := os.ReadFile(filepath.Join(dst, "keep")); string(data) != "keep" {
+			t.Fatalf("%q: expected the destination directory kept, but got %q", name, data)
+		}
+	}
+
+	// The setuid and setgid bits are dropped.
+	setuid := &tar.Header{Name: "setuid", Mode: 06755, Typeflag: tar.TypeReg}
+	if err := ExtractTarGz(newTarGz(t, setuid), dst); err != nil {
+		t.Fatalf("unable to extract: %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(dst, "setuid")); err != nil || info.Mode() != 0755 {
+		t.Fatalf("expected mode 0755, but got %v, error: %v", info.Mode(), err)
+	}
+
+	// Within the limits.
+	dst = t.TempDir()
+	limits := Limits{MaxFiles: 2, MaxFileSize: 10, MaxBytes: 20}
+	if err := ExtractTarGz(newTarGz(t, reg("a", 10), reg("b", 10)), dst, WithLimits(limits)); err != nil {
+		t.Fatalf("unable to extract: %v", err)
+	}
+
+	// The existing files are replaced as a whole, so a shorter file leaves no stale bytes,
+	// and the other links of an existing hardlink are untouched.
+	if err := os.WriteFile(filepath.Join(dst, "long"), []byte("a much longer content"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	if err := os.Link(filepath.Join(dst, "long"), filepath.Join(dst, "linked")); err != nil {
+		t.Fatalf("unable to link: %v", err)
+	}
+	if err := ExtractTarGz(newTarGz(t, reg("long", 3), reg("linked", 2)), dst); err != nil {
+		t.Fatalf("unable to extract: %v", err)
+	}
+	for name, expected := range map[string]string{"long": "xxx", "linked": "xx"} {
+		if data, _ := os.ReadFile(filepath.Join(dst, name)); string(data) != expected {
+			t.Fatalf("expected %s to be %q, but got %q", name, expected, data)
+		}
+	}
+	entries, _ := os.ReadDir(dst)
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".webide-extract-") {
+			t.Fatalf("unexpected temporary file %s", e.Name())
+		}
+	}
+}
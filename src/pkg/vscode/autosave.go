@@ -0,0 +1,216 @@
+package vscode
+
+import (
+	"aliyun/serverless/webide-server/pkg/logging"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Autosaver saves the vscode server data and the workspace data in the background,
+// so the data is not lost if the instance is killed without the pre-stop callback.
+// A save is triggered every Interval, and Debounce after the last change in the workspace directory.
+type Autosaver struct {
+	Logger      *slog.Logger
+	Interval    time.Duration // period of the saves, 0 disables the periodic saves
+	Debounce    time.Duration // quiet time after the last workspace change before saving, 0 disables watching
+	MaxInFlight int           // max concurrent saves, the triggers are skipped when reached
+
+	save    func() error
+	dir     string // the watched directory
+	watcher *fsnotify.Watcher
+	sem     chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+
+	mu          sync.Mutex
+	started     bool
+	stopped     bool
+	lastSuccess time.Time
+	lastErr     error
+}
+
+// AutosaveStatus reports the result of the background saves.
+type AutosaveStatus struct {
+	LastSuccess time.Time `json:"lastSuccess,omitempty"` // time of the last successful save, zero if none
+	LastError   string    `json:"lastError,omitempty"`   // error of the last save, empty if it succeeded
+	InFlight    int       `json:"inFlight"`              // number of the on-going saves
+}
+
+// NewAutosaver creates the autosaver which calls save in the background and watches dir for changes.
+func NewAutosaver(save func() error, dir string, interval, debounce time.Duration, maxInFlight int) *Autosaver {
+	if maxInFlight <= 0 {
+		maxInFlight = 1
+	}
+	return &Autosaver{
+		Interval:    interval,
+		Debounce:    debounce,
+		MaxInFlight: maxInFlight,
+		Logger:      slog.Default(),
+		save:        save,
+		dir:         dir,
+		sem:         make(chan struct{}, maxInFlight),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// Start starts the background loop. It does nothing if the autosaver is started or stopped.
+func (a *Autosaver) Start() {
+	a.mu.Lock()
+	if a.started || a.stopped {
+		a.mu.Unlock()
+		return
+	}
+	a.started = true
+	a.mu.Unlock()
+
+	if a.Debounce > 0 {
+		if err := a.watch(); err != nil {
+			// Fall back to the periodic saves only.
+			a.Logger.Error("Watch directory for autosave failed.", "dir", a.dir, "error", err)
+		}
+	}
+	go a.run()
+	a.Logger.Info("Autosave started.", "interval", a.Interval.String(), "debounce", a.Debounce.String(), "maxInFlight", a.MaxInFlight)
+}
+
+// Stop stops the background loop and waits for the on-going saves.
+// The autosaver can not be started again after Stop.
+func (a *Autosaver) Stop() {
+	a.mu.Lock()
+	started, stopped := a.started, a.stopped
+	a.stopped = true
+	a.mu.Unlock()
+	if !started || stopped {
+		return
+	}
+
+	close(a.stop)
+	<-a.done
+	a.wg.Wait()
+	if a.watcher != nil {
+		a.watcher.Close()
+	}
+	a.Logger.Info("Autosave stopped.")
+}
+
+// Status returns the result of the background saves.
+func (a *Autosaver) Status() AutosaveStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	status := AutosaveStatus{LastSuccess: a.lastSuccess, InFlight: len(a.sem)}
+	if a.lastErr != nil {
+		status.LastError = a.lastErr.Error()
+	}
+	return status
+}
+
+// watch adds the directory and all its sub directories to the watcher.
+func (a *Autosaver) watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	a.watcher = watcher
+	return a.addRecursive(a.dir)
+}
+
+func (a *Autosaver) addRecursive(dir string) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return a.watcher.Add(p)
+		}
+		return nil
+	})
+}
+
+func (a *Autosaver) run() {
+	defer close(a.done)
+
+	var tick <-chan time.Time
+	if a.Interval > 0 {
+		ticker := time.NewTicker(a.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	var (
+		events <-chan fsnotify.Event
+		errs   <-chan error
+	)
+	if a.watcher != nil {
+		events, errs = a.watcher.Events, a.watcher.Errors
+	}
+	debounce := time.NewTimer(a.Debounce)
+	debounce.Stop()
+	defer debounce.Stop()
+
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-tick:
+			a.trigger("interval")
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			// Watch the new created directories.
+			if event.Op&fsnotify.Create != 0 {
+				a.addRecursive(event.Name)
+			}
+			if !debounce.Stop() {
+				select {
+				case <-debounce.C:
+				default:
+				}
+			}
+			debounce.Reset(a.Debounce)
+		case <-debounce.C:
+			a.trigger("change")
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			a.Logger.Error("Autosave watcher failed.", "error", err)
+		}
+	}
+}
+
+// trigger starts a save in the background unless MaxInFlight saves are on-going.
+func (a *Autosaver) trigger(reason string) {
+	select {
+	case a.sem <- struct{}{}:
+	default:
+		a.Logger.Info("Skip autosave, too many saves in flight.", "reason", reason, "inFlight", a.MaxInFlight)
+		return
+	}
+
+	a.wg.Add(1)
+	go func() {
+		defer func() { <-a.sem; a.wg.Done() }()
+		start := time.Now()
+		err := a.save()
+
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.lastErr = err
+		if err != nil {
+			a.Logger.Error("Autosave failed.", "reason", reason, logging.Duration(start), "error", err)
+			return
+		}
+		a.lastSuccess = time.Now()
+		a.Logger.Info("Autosave succeeded.", "reason", reason, logging.Duration(start))
+	}()
+}
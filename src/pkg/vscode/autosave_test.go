@@ -0,0 +1,73 @@
+package vscode
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAutosave(t *testing.T) {
+	dir, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Fatalf("unable to create temporary dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var saves int32
+	saved := make(chan struct{}, 10)
+	save := func() error {
+		atomic.AddInt32(&saves, 1)
+		saved <- struct{}{}
+		return nil
+	}
+
+	a := NewAutosaver(save, dir, 0, 50*time.Millisecond, 1)
+	a.Start()
+
+	// A burst of changes triggers a single save after the debounce time.
+	for i := 0; i < 5; i++ {
+		if err = os.WriteFile(filepath.Join(dir, "file.txt"), []byte{byte(i)}, 0644); err != nil {
+			t.Fatalf("unable to write file: %v", err)
+		}
+	}
+	select {
+	case <-saved:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected a save triggered by the workspace changes")
+	}
+	time.Sleep(200 * time.Millisecond)
+	a.Stop()
+
+	if n := atomic.LoadInt32(&saves); n != 1 {
+		t.Fatalf("expected 1 save, but got %d", n)
+	}
+	if status := a.Status(); status.LastSuccess.IsZero() || status.LastError != "" {
+		t.Fatalf("unexpected autosave status: %+v", status)
+	}
+}
+
+func TestAutosaveInterval(t *testing.T) {
+	failed := make(chan struct{}, 100)
+	save := func() error {
+		failed <- struct{}{}
+		return errors.New("storage unavailable")
+	}
+
+	a := NewAutosaver(save, "", 20*time.Millisecond, 0, 1)
+	a.Start()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-failed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the periodic saves")
+		}
+	}
+	a.Stop()
+
+	if status := a.Status(); !status.LastSuccess.IsZero() || status.LastError != "storage unavailable" {
+		t.Fatalf("unexpected autosave status: %+v", status)
+	}
+}
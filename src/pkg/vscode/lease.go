@@ -0,0 +1,284 @@
+package vscode
+
+import (
+	"aliyun/serverless/webide-server/pkg/storage"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// The modes deciding what a server does if the workspace is leased by another live instance when it starts.
+const (
+	LeaseModeReadOnly = "readonly" // serve the workspace without saving it, until the lease is released or expired
+	LeaseModeTakeover = "takeover" // take the lease over, the previous owner stops saving at its next renewal
+)
+
+// leaseRecord is the content of the lease object.
+type leaseRecord struct {
+	Owner     string    `json:"owner"`
+	Heartbeat time.Time `json:"heartbeat"` // when the lease was acquired or renewed last
+	Expiry    time.Time `json:"expiry"`    // the lease is free after it, or once released
+}
+
+// Lease makes a single instance own the workspace at a time. The lease object is stored next to the workspace
+// object, and written by storage.Backend.PutIf, so only one of the racing instances acquires or renews it.
+// The owner renews the lease every RenewInterval in the background, and the other instances acquire it
+// once it is expired or released. An instance losing the lease stops saving, and the saves racing with
+// a lease change are caught by the conflict detection of the workspace saves.
+type Lease struct {
+	Logger        *slog.Logger
+	Storage       storage.Backend
+	Key           string        // the lease object
+	Owner         string        // unique id of this instance
+	Mode          string        // LeaseModeReadOnly or LeaseModeTakeover
+	TTL           time.Duration // the lease expires after TTL without renewal
+	RenewInterval time.Duration // period of the renewals, less than TTL
+
+	mu     sync.Mutex
+	held   bool
+	etag   string      // ETag of the lease object written by this instance
+	record leaseRecord // the lease seen last
+	err    error       // error of the last acquisition or renewal
+
+	started bool
+	stopped bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// LeaseStatus reports the lease of the workspace.
+type LeaseStatus struct {
+	Owner  string    `json:"owner"`            // this instance
+	Held   bool      `json:"held"`             // whether this instance owns the workspace and saves it
+	Holder string    `json:"holder,omitempty"` // owner of the lease seen last
+	Expiry time.Time `json:"expiry,omitempty"` // expiry of the lease seen last
+	Error  string    `json:"error,omitempty"`  // error of the last acquisition or renewal
+}
+
+// NewLease creates the lease of the object key. The renewal interval defaults to a third of ttl.
+func NewLease(backend storage.Backend, key string, owner string, mode string, ttl time.Duration, renewInterval time.Duration) (*Lease, error) {
+	if mode != LeaseModeReadOnly && mode != LeaseModeTakeover {
+		return nil, fmt.Errorf("unsupported lease mode: %s", mode)
+	}
+	if ttl <= 0 {
+		return nil, fmt.Errorf("lease ttl must be positive, but got %s", ttl)
+	}
+	if renewInterval <= 0 {
+		renewInterval = ttl / 3
+	}
+	if renewInterval >= ttl {
+		return nil, fmt.Errorf("lease renew interval %s must be less than the ttl %s", renewInterval, ttl)
+	}
+	return &Lease{
+		Logger:        slog.Default(),
+		Storage:       backend,
+		Key:           key,
+		Owner:         owner,
+		Mode:          mode,
+		TTL:           ttl,
+		RenewInterval: renewInterval,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}, nil
+}
+
+// leaseOwner returns a unique id of this instance, which tells the host for debugging.
+func leaseOwner() string {
+	host, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(suffix))
+}
+
+// Acquire acquires the lease if it is free or held by this instance, or takes it over in LeaseModeTakeover.
+// It returns nil if the lease is held by another instance, which is told by Held.
+func (l *Lease) Acquire() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.err = l.acquire(l.Mode == LeaseModeTakeover)
+	return l.err
+}
+
+// Held reports whether this instance holds the lease, so it may save the workspace.
+func (l *Lease) Held() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.held
+}
+
+// Start starts renewing the lease in the background, and acquiring it while it is held by another instance.
+// It does nothing if the renewal is started or the lease is released.
+func (l *Lease) Start() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.started || l.stopped {
+		return
+	}
+	l.started = true
+	go l.run()
+}
+
+// Release stops the renewal, and releases the lease if it is held, so another instance may acquire it right away.
+func (l *Lease) Release() error {
+	l.mu.Lock()
+	started, stopped := l.started, l.stopped
+	l.stopped = true
+	l.mu.Unlock()
+	if started && !stopped {
+		close(l.stop)
+		<-l.done
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.held {
+		return nil
+	}
+	// The lease is expired rather than deleted, which is not conditional.
+	now := time.Now()
+	_, err := l.put(leaseRecord{Owner: l.Owner, Heartbeat: now, Expiry: now}, l.etag)
+	l.held = false
+	if err != nil {
+		l.Logger.Error("Release lease failed, it is freed when expired.", "key", l.Key, "error", err)
+		return err
+	}
+	l.Logger.Info("Release lease succeeded.", "key", l.Key, "owner", l.Owner)
+	return nil
+}
+
+// Status returns the state of the lease.
+func (l *Lease) Status() LeaseStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	status := LeaseStatus{Owner: l.Owner, Held: l.held, Holder: l.record.Owner, Expiry: l.record.Expiry}
+	if l.err != nil {
+		status.Error = l.err.Error()
+	}
+	return status
+}
+
+func (l *Lease) run() {
+	defer close(l.done)
+	ticker := time.NewTicker(l.RenewInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			l.renew()
+		}
+	}
+}
+
+// renew extends the held lease, or acquires the lease if it is not held.
+func (l *Lease) renew() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.held {
+		l.err = l.acquire(false)
+		return
+	}
+
+	record, err := l.write(l.etag)
+	l.err = err
+	if errors.Is(err, storage.ErrPreconditionFailed) {
+		l.held = false
+		l.Logger.Error("Lease is taken over by another instance, stop saving the workspace.", "key", l.Key)
+	} else if err != nil && time.Now().After(l.record.Expiry) {
+		// Another instance may acquire the expired lease, the workspace is not saved until it is acquired again.
+		l.held = false
+		l.Logger.Error("Lease is expired without renewal, stop saving the workspace.", "key", l.Key, "error", err)
+	} else if err != nil {
+		l.Logger.Warn("Renew lease failed, retry later.", "key", l.Key, "retryIn", l.RenewInterval.String(), "error", err)
+	} else {
+		l.record = record
+	}
+}
+
+// acquire writes the lease if it is free, held by this instance, or takeover is true.
+func (l *Lease) acquire(takeover bool) error {
+	// The ETag is taken before the lease is read, so a change in between fails the write rather than being lost.
+	etag := ""
+	info, err := l.Storage.Stat(l.Key)
+	if err == nil {
+		etag = info.ETag
+		if l.record, err = l.read(); err != nil {
+			return err
+		}
+		if l.record.Owner != l.Owner && time.Now().Before(l.record.Expiry) && !takeover {
+			l.held = false
+			return nil
+		}
+	} else if errors.Is(err, storage.ErrNotFound) {
+		l.record = leaseRecord{}
+	} else {
+		return err
+	}
+
+	previous := l.record
+	record, err := l.write(etag)
+	if errors.Is(err, storage.ErrPreconditionFailed) {
+		// Acquired by another instance in between.
+		l.held = false
+		return nil
+	} else if err != nil {
+		return err
+	}
+	l.held, l.record = true, record
+	if previous.Owner != "" && previous.Owner != l.Owner && time.Now().Before(previous.Expiry) {
+		l.Logger.Warn("Take over lease.", "key", l.Key, "previousOwner", previous.Owner, "owner", l.Owner)
+	} else {
+		l.Logger.Info("Acquire lease succeeded.", "key", l.Key, "owner", l.Owner, "expiry", record.Expiry)
+	}
+	return nil
+}
+
+// write writes the lease of this instance expiring after TTL, if the lease object has the ETag etag.
+func (l *Lease) write(etag string) (leaseRecord, error) {
+	now := time.Now()
+	record := leaseRecord{Owner: l.Owner, Heartbeat: now, Expiry: now.Add(l.TTL)}
+	newETag, err := l.put(record, etag)
+	if err != nil {
+		return leaseRecord{}, err
+	}
+	l.etag = newETag
+	return record, nil
+}
+
+func (l *Lease) put(record leaseRecord, etag string) (string, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return "", err
+	}
+	return l.Storage.PutIf(l.Key, bytes.NewReader(data), etag)
+}
+
+// read reads the lease object. A lease which can not be decoded is free.
+func (l *Lease) read() (leaseRecord, error) {
+	record := leaseRecord{}
+	body, err := l.Storage.Get(l.Key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return record, nil
+	} else if err != nil {
+		return record, err
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return record, err
+	}
+	if err = json.Unmarshal(data, &record); err != nil {
+		l.Logger.Warn("Decode lease failed, it is taken as free.", "key", l.Key, "error", err)
+		return leaseRecord{}, nil
+	}
+	return record, nil
+}
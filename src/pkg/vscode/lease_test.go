@@ -0,0 +1,189 @@
+package vscode
+
+import (
+	"aliyun/serverless/webide-server/pkg/storage"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLease(t *testing.T) {
+	backend, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatalf("unable to create local backend: %v", err)
+	}
+	newLease := func(owner string, mode string, ttl time.Duration) *Lease {
+		l, err := NewLease(backend, "workspace.tar.gz.lease", owner, mode, ttl, 0)
+		if err != nil {
+			t.Fatalf("unable to create lease: %v", err)
+		}
+		if err = l.Acquire(); err != nil {
+			t.Fatalf("unable to acquire lease: %v", err)
+		}
+		return l
+	}
+
+	a := newLease("a", LeaseModeReadOnly, time.Hour)
+	b := newLease("b", LeaseModeReadOnly, time.Hour)
+	if !a.Held() || b.Held() {
+		t.Fatalf("expected the lease held by a only")
+	}
+	if status := b.Status(); status.Owner != "b" || status.Holder != "a" || !status.Expiry.After(time.Now()) {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+	a.renew()
+	b.renew()
+	if !a.Held() || b.Held() {
+		t.Fatalf("expected the lease still held by a only")
+	}
+
+	// Taken over, the previous owner finds it at the renewal.
+	c := newLease("c", LeaseModeTakeover, time.Hour)
+	if !c.Held() {
+		t.Fatalf("expected the lease taken over by c")
+	}
+	a.renew()
+	if a.Held() {
+		t.Fatalf("expected the lease lost by a")
+	}
+
+	// Released, another instance acquires it at the next attempt.
+	if err = c.Release(); err != nil || c.Held() {
+		t.Fatalf("unable to release lease: %v", err)
+	}
+	b.renew()
+	if !b.Held() {
+		t.Fatalf("expected the released lease acquired by b")
+	}
+	if err = b.Release(); err != nil {
+		t.Fatalf("unable to release lease: %v", err)
+	}
+
+	// Expired without renewal.
+	d := newLease("d", LeaseModeReadOnly, 100*time.Millisecond)
+	e := newLease("e", LeaseModeReadOnly, time.Hour)
+	if !d.Held() || e.Held() {
+		t.Fatalf("expected the lease held by d only")
+	}
+	time.Sleep(150 * time.Millisecond)
+	e.renew()
+	if !e.Held() {
+		t.Fatalf("expected the expired lease acquired by e")
+	}
+	d.renew()
+	if d.Held() {
+		t.Fatalf("expected the lease lost by d")
+	}
+	if err = e.Release(); err != nil {
+		t.Fatalf("unable to release lease: %v", err)
+	}
+
+	// Renewed in the background beyond the ttl.
+	f, err := NewLease(backend, "workspace.tar.gz.lease", "f", LeaseModeReadOnly, 200*time.Millisecond, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("unable to create lease: %v", err)
+	}
+	f.Start()
+	time.Sleep(100 * time.Millisecond)
+	if !f.Held() {
+		t.Fatalf("expected the lease acquired in the background")
+	}
+	time.Sleep(300 * time.Millisecond)
+	g := newLease("g", LeaseModeReadOnly, time.Hour)
+	if !f.Held() || g.Held() {
+		t.Fatalf("expected the lease renewed by f")
+	}
+	if err = f.Release(); err != nil {
+		t.Fatalf("unable to release lease: %v", err)
+	}
+	if err = g.Acquire(); err != nil || !g.Held() {
+		t.Fatalf("expected the released lease acquired by g, error: %v", err)
+	}
+
+	for _, c := range []struct {
+		mode  string
+		ttl   time.Duration
+		renew time.Duration
+	}{
+		{"exclusive", time.Minute, 0},
+		{LeaseModeReadOnly, 0, 0},
+		{LeaseModeReadOnly, time.Minute, time.Minute},
+	} {
+		if _, err = NewLease(backend, "lease", "h", c.mode, c.ttl, c.renew); err == nil {
+			t.Fatalf("expected the invalid lease %+v refused", c)
+		}
+	}
+}
+
+func TestSaveWorkspaceLeased(t *testing.T) {
+	root := t.TempDir()
+	backend, err := storage.NewLocal(filepath.Join(root, "storage"))
+	if err != nil {
+		t.Fatalf("unable to create local backend: %v", err)
+	}
+	newServer := func(owner string, mode string) *Server {
+		lease, err := NewLease(backend, "workspace.tar.gz.lease", owner, mode, time.Hour, 0)
+		if err != nil {
+			t.Fatalf("unable to create lease: %v", err)
+		}
+		s := &Server{
+			VscodeDataDir:     filepath.Join(root, owner+"-data"),
+			VscodeDataOssPath: owner + "-data.tar.gz",
+			WorkspaceDir:      filepath.Join(root, owner),
+			WorkspaceOssPath:  "workspace.tar.gz",
+			WorkspaceSyncMode: SyncModeArchive,
+			Storage:           backend,
+			WorkspaceProgress: newLoadProgress(),
+			Lease:             lease,
+		}
+		if err = lease.Acquire(); err != nil {
+			t.Fatalf("unable to acquire lease: %v", err)
+		}
+		writeFiles(t, s.VscodeDataDir, map[string]string{"settings.json": "{}"})
+		s.workspaceLock.Lock()
+		s.loadWorkspace()
+		return s
+	}
+
+	a := newServer("a", LeaseModeReadOnly)
+	writeFiles(t, a.WorkspaceDir, map[string]string{"a.txt": "a"})
+	if err = a.saveWorkspace(); err != nil {
+		t.Fatalf("unable to save workspace: %v", err)
+	}
+
+	b := newServer("b", LeaseModeReadOnly)
+	if err = b.saveWorkspace(); err == nil || !strings.Contains(err.Error(), "leased by a") {
+		t.Fatalf("expected the save refused, but got %v", err)
+	}
+	if err = b.saveData(); err == nil || !strings.Contains(err.Error(), "leased by a") {
+		t.Fatalf("expected the data save refused, but got %v", err)
+	}
+	if status := b.Status(); status.Lease == nil || status.Lease.Held || status.Lease.Holder != "a" {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+
+	// Taken over, the previous owner stops saving.
+	c := newServer("c", LeaseModeTakeover)
+	assertFiles(t, c.WorkspaceDir, map[string]string{"a.txt": "a"})
+	if err = c.saveWorkspace(); err != nil {
+		t.Fatalf("unable to save workspace: %v", err)
+	}
+	a.Lease.renew()
+	if err = a.saveWorkspace(); err == nil {
+		t.Fatalf("expected the save refused")
+	}
+	if err = a.saveData(); err == nil {
+		t.Fatalf("expected the data save refused")
+	}
+
+	// Released on shutdown.
+	c.Shutdown()
+	b.Lease.renew()
+	if !b.Lease.Held() {
+		t.Fatalf("expected the released lease acquired")
+	}
+	for _, s := range []*Server{a, b} {
+		s.Lease.Release()
+	}
+}
@@ -0,0 +1,153 @@
+package vscode
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	LoadStatePending = "pending" // the loading is not started
+	LoadStateLoading = "loading" // the data is being extracted
+	LoadStateDone    = "done"    // the data is loaded completely
+	LoadStateFailed  = "failed"  // the loading failed, see Error
+)
+
+// LoadProgress tracks the workspace loading, which runs in the background after vscode server is launched.
+// The loading is aborted by abort, e.g. when the init fails after the loading is started.
+type LoadProgress struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu         sync.Mutex
+	state      string
+	totalBytes int64 // estimated total bytes, 0 if unknown
+	bytes      int64 // processed bytes, comparable to totalBytes
+	files      int64
+	startTime  time.Time
+	endTime    time.Time
+	err        error
+}
+
+// LoadProgressStatus is the snapshot of the loading progress, which is reported to the users.
+type LoadProgressStatus struct {
+	State      string    `json:"state"`
+	TotalBytes int64     `json:"totalBytes"`
+	Bytes      int64     `json:"bytes"`
+	Files      int64     `json:"files"`
+	StartTime  time.Time `json:"startTime,omitempty"`
+	EndTime    time.Time `json:"endTime,omitempty"`
+	ETASeconds float64   `json:"etaSeconds"` // estimated remaining seconds, -1 if unknown
+	Error      string    `json:"error,omitempty"`
+}
+
+func newLoadProgress() *LoadProgress {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &LoadProgress{ctx: ctx, cancel: cancel, state: LoadStatePending}
+}
+
+// context returns the context canceled by abort, which never ends if p is nil.
+func (p *LoadProgress) context() context.Context {
+	if p == nil {
+		return context.Background()
+	}
+	return p.ctx
+}
+
+// abort cancels the loading, which fails with context.Canceled.
+func (p *LoadProgress) abort() {
+	p.cancel()
+}
+
+func (p *LoadProgress) start(totalBytes int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.state = LoadStateLoading
+	p.totalBytes = totalBytes
+	p.bytes, p.files = 0, 0
+	p.startTime = time.Now()
+	p.err = nil
+}
+
+func (p *LoadProgress) update(files int64, bytes int64, totalBytes int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if files >= 0 {
+		p.files = files
+	}
+	if bytes >= 0 {
+		p.bytes = bytes
+	}
+	if totalBytes > 0 {
+		p.totalBytes = totalBytes
+	}
+}
+
+func (p *LoadProgress) finish(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.endTime = time.Now()
+	p.err = err
+	if err != nil {
+		p.state = LoadStateFailed
+		return
+	}
+	p.state = LoadStateDone
+	if p.totalBytes > 0 {
+		p.bytes = p.totalBytes
+	}
+}
+
+// Status returns the current loading progress.
+func (p *LoadProgress) Status() LoadProgressStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := LoadProgressStatus{
+		State:      p.state,
+		TotalBytes: p.totalBytes,
+		Bytes:      p.bytes,
+		Files:      p.files,
+		StartTime:  p.startTime,
+		EndTime:    p.endTime,
+		ETASeconds: -1,
+	}
+	if p.err != nil {
+		status.Error = p.err.Error()
+	}
+	switch {
+	case p.state == LoadStateDone:
+		status.ETASeconds = 0
+	case p.state == LoadStateLoading && p.bytes > 0 && p.totalBytes >= p.bytes:
+		elapsed := time.Since(p.startTime).Seconds()
+		status.ETASeconds = elapsed * float64(p.totalBytes-p.bytes) / float64(p.bytes)
+	}
+	return status
+}
+
+// countingReader reports the number of bytes read from the underlying reader.
+type countingReader struct {
+	r     io.Reader
+	n     int64
+	count func(n int64)
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	c.count(c.n)
+	return n, err
+}
+
+// contextReader fails the reads after the context is done, which aborts the extraction reading from it.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(b []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(b)
+}
@@ -0,0 +1,247 @@
+package vscode
+
+import (
+	"aliyun/serverless/webide-server/pkg/storage"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// restoreDir in the workspace directory holds the staging directory of a restore. It exists only while the
+// workspace is being restored, so it is left by an interrupted restore, and the workspace is not saved until
+// the next restore recovers it.
+const restoreDir = ".webide-restore"
+
+// The markers in restoreDir, which tell how far an interrupted restore went.
+const (
+	completeMarker = "complete" // the staged workspace is complete, the swap is rolled forward; it holds the loading start time
+	swappedMarker  = "swapped"  // the entries of the workspace are moved to old, only the staged ones are left to move
+)
+
+// restoreWorkspace loads the object src into a staging directory, and swaps it with the content of the workspace
+// directory after the loading completes, so a failed or interrupted loading never leaves a half-populated workspace.
+// The files of a snapshot which are up to date in the workspace are copied rather than downloaded, and the files
+// changed in the workspace during the loading are kept over the loaded ones, see keepNewer.
+// The local workspace is kept if there is no object stored yet.
+func (s *Server) restoreWorkspace(src string, p *LoadProgress) error {
+	root := filepath.Join(s.WorkspaceDir, restoreDir)
+	staging := filepath.Join(root, "staging")
+	if err := s.recoverRestore(); err != nil {
+		// restoreDir is kept, so the workspace is not saved.
+		s.logger().Error("Recover the interrupted restore failed.", "dir", root, "error", err)
+		return err
+	}
+	if _, err := s.Storage.Stat(src); errors.Is(err, storage.ErrNotFound) {
+		s.logger().Info("No workspace data, keep the local workspace.", "key", src, "dir", s.WorkspaceDir)
+		return os.MkdirAll(s.WorkspaceDir, 0755)
+	}
+
+	since := time.Now()
+	if err := os.MkdirAll(staging, 0755); err != nil {
+		s.logger().Error("Create staging directory failed.", "dir", staging, "error", err)
+		return err
+	}
+	if err := s.loadWithProgress(src, staging, s.WorkspaceDir, p); err != nil {
+		os.RemoveAll(root)
+		return err
+	}
+	// The completion marker tells the staged workspace is complete, in case the swap is interrupted.
+	marker := []byte(since.UTC().Format(time.RFC3339Nano))
+	if err := os.WriteFile(filepath.Join(root, completeMarker), marker, 0644); err != nil {
+		os.RemoveAll(root)
+		return err
+	}
+	if err := s.swapRestored(); err != nil {
+		return err
+	}
+	s.logger().Info("Restore workspace succeeded.", "dir", s.WorkspaceDir, "key", src)
+	return nil
+}
+
+// recoverRestore finishes the restore left by an interrupted one according to the markers in restoreDir.
+// A complete staged workspace is swapped in, otherwise the entries already moved to old are moved back,
+// so the entries of the workspace are never deleted unless they are replaced by a complete one.
+func (s *Server) recoverRestore() error {
+	root := filepath.Join(s.WorkspaceDir, restoreDir)
+	if _, err := os.Lstat(root); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	_, err := os.Stat(filepath.Join(root, completeMarker))
+	if err == nil {
+		s.logger().Warn("Roll forward the interrupted restore.", "dir", s.WorkspaceDir)
+		return s.swapRestored()
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	s.logger().Warn("Roll back the interrupted restore.", "dir", s.WorkspaceDir)
+	old := filepath.Join(root, "old")
+	if err = moveEntries(old, s.WorkspaceDir); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return os.RemoveAll(root)
+}
+
+// swapRestored swaps the complete staged workspace with the content of the workspace directory, keeps the entries
+// changed since the loading started and the excluded ones, and removes restoreDir. It resumes the swap interrupted at any step.
+func (s *Server) swapRestored() error {
+	root := filepath.Join(s.WorkspaceDir, restoreDir)
+	old := filepath.Join(root, "old")
+	marker, err := os.ReadFile(filepath.Join(root, completeMarker))
+	if err != nil {
+		return err
+	}
+	since, err := time.Parse(time.RFC3339Nano, string(marker))
+	if err != nil {
+		return fmt.Errorf("invalid restore marker: %w", err)
+	}
+	if err = s.swapContents(s.WorkspaceDir, filepath.Join(root, "staging"), old); err != nil {
+		// The workspace may be mixed, restoreDir is kept so it is not saved.
+		s.logger().Error("Swap the restored workspace failed.", "dir", s.WorkspaceDir, "error", err)
+		return err
+	}
+	// The excludes of the restored workspace, which are not saved, so the local ones are kept.
+	kept, err := s.keepNewer(old, s.WorkspaceDir, since, s.workspaceExclude().Match)
+	if err != nil {
+		s.logger().Error("Keep the workspace changes during the restore failed.", "dir", s.WorkspaceDir, "error", err)
+		return err
+	}
+	if len(kept) > 0 {
+		s.logger().Info("Kept the workspace changes during the restore.", "paths", kept)
+	}
+	if err := os.RemoveAll(root); err != nil {
+		s.logger().Error("Remove restore directory failed.", "dir", root, "error", err)
+		return err
+	}
+	return nil
+}
+
+// restoring reports whether a restore of the workspace is on-going or was interrupted.
+func (s *Server) restoring() bool {
+	_, err := os.Lstat(filepath.Join(s.WorkspaceDir, restoreDir))
+	return !errors.Is(err, fs.ErrNotExist)
+}
+
+// swapContents moves the entries of dir except restoreDir to old, then the entries of staging to dir.
+// The entries are renamed without copying, and dir itself is kept, which may be a mount point or opened by
+// vscode server, so the swap is a series of renames instead of a single one.
+// swappedMarker is written in the parent of old between the two steps, so an interrupted swap can be resumed
+// by calling swapContents again, which does not move the staged entries to old.
+func (s *Server) swapContents(dir string, staging string, old string) error {
+	marker := filepath.Join(filepath.Dir(old), swappedMarker)
+	if _, err := os.Stat(marker); errors.Is(err, fs.ErrNotExist) {
+		if err = os.MkdirAll(old, 0755); err != nil {
+			return err
+		}
+		if err = moveEntries(dir, old); err != nil {
+			return err
+		}
+		if err = os.WriteFile(marker, nil, 0644); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(staging)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() == restoreDir {
+			s.logger().Warn("Skip the reserved entry in the restored workspace.", "name", restoreDir)
+			continue
+		}
+		if err = os.Rename(filepath.Join(staging, entry.Name()), filepath.Join(dir, entry.Name())); err != nil {
+			return fmt.Errorf("move %s into the workspace: %w", entry.Name(), err)
+		}
+	}
+	return nil
+}
+
+// keepNewer moves the entries in old modified after since back to dir, which are changed while the workspace is
+// being loaded, so the swap does not lose them. The entries matched by exclude are never saved, so they are
+// moved back as well unless restored, e.g. node_modules. A directory which is new to dir is moved as a whole.
+// An entry conflicting with the restored ones, e.g. a file where a directory is restored, is dropped with a warning.
+// It returns the paths of the kept entries relative to dir.
+func (s *Server) keepNewer(old string, dir string, since time.Time, exclude func(path string, isDir bool) bool) ([]string, error) {
+	var kept []string
+	keep := func(p string, rel string) {
+		target := filepath.Join(dir, rel)
+		err := os.MkdirAll(filepath.Dir(target), 0755)
+		if err == nil {
+			err = os.Rename(p, target)
+		}
+		if err != nil {
+			s.logger().Warn("Drop the workspace change conflicting with the restored workspace.", "path", rel, "error", err)
+			return
+		}
+		kept = append(kept, filepath.ToSlash(rel))
+	}
+	err := filepath.WalkDir(old, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == old {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(old, p)
+		existing, statErr := os.Lstat(filepath.Join(dir, rel))
+		missing := errors.Is(statErr, fs.ErrNotExist) && excluded(exclude, rel, d.IsDir())
+		if d.IsDir() {
+			// The changed files in an existing directory are kept one by one.
+			if errors.Is(statErr, fs.ErrNotExist) && (info.ModTime().After(since) || missing) {
+				keep(p, rel)
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.ModTime().After(since) && !missing {
+			return nil
+		}
+		if statErr == nil && existing.IsDir() {
+			s.logger().Warn("Drop the workspace change conflicting with the restored workspace.", "path", rel)
+			return nil
+		}
+		keep(p, rel)
+		return nil
+	})
+	return kept, err
+}
+
+// excluded reports whether the path relative to the workspace, or any of its parent directories, is matched by exclude.
+func excluded(exclude func(path string, isDir bool) bool, rel string, isDir bool) bool {
+	for p := filepath.ToSlash(rel); p != "."; p, isDir = path.Dir(p), true {
+		if exclude(p, isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// moveEntries renames the entries of src except restoreDir into dst. An entry which exists in both fails the move.
+func moveEntries(src string, dst string) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() == restoreDir {
+			continue
+		}
+		target := filepath.Join(dst, entry.Name())
+		if _, err = os.Lstat(target); err == nil {
+			return fmt.Errorf("move %s to %s: %w", entry.Name(), dst, fs.ErrExist)
+		}
+		if err = os.Rename(filepath.Join(src, entry.Name()), target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package vscode
+
+import (
+	"aliyun/serverless/webide-server/pkg/snapshot"
+	"aliyun/serverless/webide-server/pkg/storage"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRestoreWorkspace(t *testing.T) {
+	root := t.TempDir()
+	backend, err := storage.NewLocal(filepath.Join(root, "storage"))
+	if err != nil {
+		t.Fatalf("unable to create local backend: %v", err)
+	}
+	vserver := &Server{
+		WorkspaceDir:      filepath.Join(root, "workspace"),
+		WorkspaceOssPath:  "workspace.tar.gz",
+		WorkspaceSyncMode: SyncModeArchive,
+		Storage:           backend,
+		WorkspaceProgress: newLoadProgress(),
+	}
+	load := func() {
+		vserver.workspaceLock.Lock()
+		vserver.loadWorkspace()
+	}
+	local := map[string]string{"local.txt": "local", "dir/local.txt": "local"}
+	writeFiles(t, vserver.WorkspaceDir, local)
+
+	// Nothing stored yet, the local workspace is kept.
+	load()
+	if !vserver.workspaceLoaded {
+		t.Fatalf("expected the workspace loaded")
+	}
+	assertFiles(t, vserver.WorkspaceDir, local)
+
+	// A broken archive fails the loading before touching the workspace, which is not saved afterwards.
+	vserver.workspaceLoaded = false
+	if err = backend.Put(vserver.WorkspaceOssPath, bytes.NewReader(archive(t, map[string]string{"stored.txt": "stored"})[:20])); err != nil {
+		t.Fatalf("unable to put the archive: %v", err)
+	}
+	load()
+	if vserver.workspaceLoaded || vserver.restoring() {
+		t.Fatalf("expected the loading failed and cleaned up")
+	}
+	assertFiles(t, vserver.WorkspaceDir, local)
+	if err = vserver.saveWorkspace(); err == nil {
+		t.Fatalf("expected the save refused")
+	}
+
+	// An interrupted restore refuses the saves until the next restore completes.
+	stored := map[string]string{"stored.txt": "stored", "dir/stored.txt": "stored"}
+	if err = backend.Put(vserver.WorkspaceOssPath, bytes.NewReader(archive(t, stored))); err != nil {
+		t.Fatalf("unable to put the archive: %v", err)
+	}
+	writeFiles(t, filepath.Join(vserver.WorkspaceDir, restoreDir, "staging"), map[string]string{"partial.txt": "partial"})
+	vserver.workspaceLoaded = true
+	if err = vserver.saveWorkspace(); err == nil {
+		t.Fatalf("expected the save refused")
+	}
+	load()
+	if !vserver.workspaceLoaded || vserver.restoring() {
+		t.Fatalf("expected the workspace loaded")
+	}
+	// The workspace is replaced as a whole.
+	assertFiles(t, vserver.WorkspaceDir, stored)
+	if err = vserver.saveWorkspace(); err != nil {
+		t.Fatalf("unable to save workspace: %v", err)
+	}
+
+	// The excluded files are not saved, so they are kept by the loading even if older than it.
+	vserver.Exclude = []string{"node_modules/", "*.log"}
+	writeFiles(t, vserver.WorkspaceDir, map[string]string{
+		"node_modules/pkg/index.js": "module", "dir/debug.log": "log", "local.txt": "local",
+	})
+	old := time.Now().Add(-time.Hour)
+	for _, name := range []string{"node_modules/pkg/index.js", "node_modules/pkg", "node_modules", "dir/debug.log", "local.txt"} {
+		if err = os.Chtimes(filepath.Join(vserver.WorkspaceDir, name), old, old); err != nil {
+			t.Fatalf("unable to change times: %v", err)
+		}
+	}
+	load()
+	if !vserver.workspaceLoaded || vserver.restoring() {
+		t.Fatalf("expected the workspace loaded")
+	}
+	assertFiles(t, vserver.WorkspaceDir, map[string]string{
+		"stored.txt": "stored", "dir/stored.txt": "stored", "node_modules/pkg/index.js": "module", "dir/debug.log": "log",
+	})
+}
+
+func TestRecoverRestore(t *testing.T) {
+	// The loading started before or after the local files are written.
+	changed := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339Nano)
+	unchanged := time.Now().Add(time.Hour).UTC().Format(time.RFC3339Nano)
+	cases := []struct {
+		name     string
+		files    map[string]string // the workspace left by the interrupted restore, relative to the workspace
+		expected map[string]string
+	}{
+		{
+			name: "loading interrupted",
+			files: map[string]string{
+				"local.txt": "local", restoreDir + "/staging/partial.txt": "partial",
+			},
+			expected: map[string]string{"local.txt": "local"},
+		},
+		{
+			name: "loading interrupted with old entries",
+			files: map[string]string{
+				"a.txt": "local", restoreDir + "/old/b.txt": "local", restoreDir + "/old/dir/c.txt": "local",
+				restoreDir + "/staging/partial.txt": "partial",
+			},
+			expected: map[string]string{"a.txt": "local", "b.txt": "local", "dir/c.txt": "local"},
+		},
+		{
+			name: "moving to old interrupted",
+			files: map[string]string{
+				"a.txt": "local", restoreDir + "/old/b.txt": "local", restoreDir + "/" + completeMarker: unchanged,
+				restoreDir + "/staging/stored.txt": "stored", restoreDir + "/staging/dir/stored.txt": "stored",
+			},
+			expected: map[string]string{"stored.txt": "stored", "dir/stored.txt": "stored"},
+		},
+		{
+			name: "moving into workspace interrupted",
+			files: map[string]string{
+				"stored.txt": "stored", restoreDir + "/old/a.txt": "local",
+				restoreDir + "/" + completeMarker: unchanged, restoreDir + "/" + swappedMarker: "",
+				restoreDir + "/staging/dir/stored.txt": "stored",
+			},
+			expected: map[string]string{"stored.txt": "stored", "dir/stored.txt": "stored"},
+		},
+		{
+			name: "changed during loading",
+			files: map[string]string{
+				"stored.txt": "stored", restoreDir + "/" + completeMarker: changed, restoreDir + "/" + swappedMarker: "",
+				restoreDir + "/old/a.txt": "local", restoreDir + "/old/dir/stored.txt": "edited",
+				restoreDir + "/old/new/a.txt": "local", restoreDir + "/old/conflict": "local",
+				restoreDir + "/staging/dir/stored.txt": "stored", restoreDir + "/staging/conflict/stored.txt": "stored",
+			},
+			expected: map[string]string{
+				"stored.txt": "stored", "a.txt": "local", "dir/stored.txt": "edited", "new/a.txt": "local",
+				"conflict/stored.txt": "stored",
+			},
+		},
+	}
+	for _, c := range cases {
+		root := t.TempDir()
+		backend, err := storage.NewLocal(filepath.Join(root, "storage"))
+		if err != nil {
+			t.Fatalf("unable to create local backend: %v", err)
+		}
+		vserver := &Server{
+			WorkspaceDir:      filepath.Join(root, "workspace"),
+			WorkspaceOssPath:  "workspace.tar.gz",
+			WorkspaceSyncMode: SyncModeArchive,
+			Storage:           backend,
+			WorkspaceProgress: newLoadProgress(),
+		}
+		writeFiles(t, vserver.WorkspaceDir, c.files)
+
+		// Nothing stored, so the workspace is what the recovery leaves.
+		vserver.workspaceLock.Lock()
+		vserver.loadWorkspace()
+		if !vserver.workspaceLoaded || vserver.restoring() {
+			t.Fatalf("%s: expected the workspace recovered and loaded", c.name)
+		}
+		assertFiles(t, vserver.WorkspaceDir, c.expected)
+	}
+}
+
+// countingGet counts the Get calls of the keys with the prefix.
+type countingGet struct {
+	storage.Backend
+	prefix string
+
+	mu    sync.Mutex
+	count int
+}
+
+func (c *countingGet) Get(key string) (io.ReadCloser, error) {
+	if strings.HasPrefix(key, c.prefix) {
+		c.mu.Lock()
+		c.count++
+		c.mu.Unlock()
+	}
+	return c.Backend.Get(key)
+}
+
+func TestRestoreSnapshotFromWorkspace(t *testing.T) {
+	root := t.TempDir()
+	local, err := storage.NewLocal(filepath.Join(root, "storage"))
+	if err != nil {
+		t.Fatalf("unable to create local backend: %v", err)
+	}
+	backend := &countingGet{Backend: local, prefix: snapshot.BlobPrefix("workspace.tar.gz")}
+	vserver := &Server{
+		WorkspaceDir:      filepath.Join(root, "workspace"),
+		WorkspaceOssPath:  "workspace.tar.gz",
+		WorkspaceSyncMode: SyncModeIncremental,
+		Storage:           backend,
+		Syncer:            snapshot.NewSyncer(backend, 2),
+		WorkspaceProgress: newLoadProgress(),
+	}
+	stored := map[string]string{"a.txt": "a", "dir/b.txt": "b", "dir/c.txt": "c"}
+	writeFiles(t, filepath.Join(root, "src"), stored)
+	if _, err = vserver.Syncer.Save(filepath.Join(root, "src"), vserver.WorkspaceOssPath); err != nil {
+		t.Fatalf("unable to save the snapshot: %v", err)
+	}
+
+	// Only the files which differ from the workspace are downloaded, and the local only ones are removed.
+	writeFiles(t, vserver.WorkspaceDir, map[string]string{"a.txt": "a", "dir/b.txt": "local", "local.txt": "local"})
+	vserver.workspaceLock.Lock()
+	vserver.loadWorkspace()
+	if !vserver.workspaceLoaded {
+		t.Fatalf("expected the workspace loaded, but got %+v", vserver.WorkspaceProgress.Status())
+	}
+	assertFiles(t, vserver.WorkspaceDir, stored)
+	if backend.count != 2 {
+		t.Fatalf("expected 2 blobs downloaded, but got %d", backend.count)
+	}
+}
+
+// assertFiles checks the regular files in dir are exactly the files.
+func assertFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	actual := map[string]string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		data, err := os.ReadFile(path)
+		actual[filepath.ToSlash(rel)] = string(data)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("unable to walk %s: %v", dir, err)
+	}
+	if len(actual) != len(files) {
+		t.Fatalf("expected files %v, but got %v", files, actual)
+	}
+	for name, content := range files {
+		if actual[name] != content {
+			t.Fatalf("expected files %v, but got %v", files, actual)
+		}
+	}
+}
@@ -2,43 +2,188 @@ package vscode
 
 import (
 	"aliyun/serverless/webide-server/pkg/context"
+	"aliyun/serverless/webide-server/pkg/encryption"
+	"aliyun/serverless/webide-server/pkg/ignore"
+	"aliyun/serverless/webide-server/pkg/logging"
+	"aliyun/serverless/webide-server/pkg/metrics"
+	"aliyun/serverless/webide-server/pkg/snapshot"
+	"aliyun/serverless/webide-server/pkg/storage"
 	"aliyun/serverless/webide-server/pkg/tar"
-	"bytes"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"net"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/aliyun/aliyun-oss-go-sdk/oss"
-	"github.com/golang/glog"
 	"github.com/mitchellh/go-homedir"
 	"github.com/spf13/viper"
 )
 
 type (
 	Server struct {
-		Host              string // vscode server host
-		Port              string // vscode server port
-		VscodeDataDir     string // vscode server directory to store the user, server and extension data
-		VscodeBinaryDir   string // the directory where vscode binary is
-		WorkspaceDir      string // the workspace directory
-		OssBucketName     string // oss bucket to persist the whole data
-		VscodeDataOssPath string // oss path where store the vscode server data
-		WorkspaceOssPath  string // oss path where store the user workspace data
-		OssClient         *oss.Client
+		Logger            *slog.Logger    // the logger of this server, slog.Default() if nil
+		User              string          // the user served by this server in multi-user mode, empty in single user mode
+		ConnectionToken   Secret          // the token required by vscode server, empty to launch without connection token
+		Host              string          // vscode server host
+		Port              string          // vscode server port
+		VscodeDataDir     string          // vscode server directory to store the user, server and extension data
+		VscodeBinaryDir   string          // the directory where vscode binary is
+		WorkspaceDir      string          // the workspace directory
+		VscodeDataOssPath string          // oss path where store the vscode server data
+		WorkspaceOssPath  string          // oss path where store the user workspace data
+		WorkspaceSyncMode string          // how to save the workspace data, SyncModeArchive or SyncModeIncremental
+		SnapshotKeep      int             // number of the workspace snapshots to keep, 0 disables the snapshots
+		SnapshotMaxAge    time.Duration   // snapshots older than this are deleted, 0 means no limit
+		PreserveOwner     bool            // whether to restore the uid and gid of the archived files, which requires the root privilege
+		Exclude           []string        // gitignore-style patterns of the workspace files not to save, before the ones in IgnoreFile
+		Include           []string        // patterns of the workspace files to save even if excluded by Exclude or IgnoreFile
+		Codec             string          // compression codec of the archives, see tar.ValidateCodec
+		CodecLevel        int             // compression level of the codec, 0 is the default level
+		Limits            tar.Limits      // bounds the extraction of the archives
+		Storage           storage.Backend // the storage backend to persist the whole data
+		Syncer            *snapshot.Syncer
+		Autosaver         *Autosaver    // saves the data in the background, nil if disabled
+		Lease             *Lease        // makes this instance the single writer of the workspace and the data, nil if disabled
+		WorkspaceProgress *LoadProgress // progress of the workspace loading
+		Process           *Supervisor   // supervises the vscode server process, nil before launched
+		StartTimeout      time.Duration // max time waiting for vscode server listening after launched
+		StopTimeout       time.Duration // max time waiting for vscode server exiting after SIGTERM before killing it
+		RestartBackoff    time.Duration // delay before restarting the crashed vscode server, doubled for the consecutive crashes
+		MaxRestartBackoff time.Duration // max delay before restarting the crashed vscode server
+
+		// workspaceLock is held while the workspace is being loaded or saved,
+		// so a half-extracted workspace is never archived.
+		workspaceLock   sync.Mutex
+		workspaceLoaded bool          // whether the workspace is loaded completely
+		workspaceETag   string        // ETag of the workspace object loaded or saved last, empty if it did not exist
+		workspaceDone   chan struct{} // closed when the background loading of the workspace exits
+
+		// dataLock is held while the vscode server data is being saved.
+		dataLock sync.Mutex
+		dataETag string // ETag of the vscode server data object loaded or saved last, empty if it did not exist
+
+		tokenFile string // the file passing the connection token to vscode server
+
+		// The states reported by Status.
+		dataLoad      operation
+		dataSave      operation
+		workspaceSave operation
+		excluded      exclusion
+		conflicted    conflict
 	}
 	ServerOption func(*Server)
+
+	// Secret is a string which is masked when formatted, so it is not printed in the logs.
+	Secret string
+)
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return "******"
+}
+
+func (s Secret) GoString() string {
+	return s.String()
+}
+
+// String describes the configuration of the server. The storage backend, which holds the credentials,
+// and the connection token are left out, so the server is safe to be printed in the logs and the errors.
+func (s *Server) String() string {
+	return fmt.Sprintf("{User:%s Host:%s Port:%s VscodeDataDir:%s WorkspaceDir:%s VscodeDataOssPath:%s WorkspaceOssPath:%s WorkspaceSyncMode:%s}",
+		s.User, s.Host, s.Port, s.VscodeDataDir, s.WorkspaceDir, s.VscodeDataOssPath, s.WorkspaceOssPath, s.WorkspaceSyncMode)
+}
+
+func (s *Server) GoString() string {
+	return s.String()
+}
+
+// LogValue logs the configuration of the server like String.
+func (s *Server) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("user", s.User),
+		slog.String("host", s.Host),
+		slog.String("port", s.Port),
+		slog.String("vscodeDataDir", s.VscodeDataDir),
+		slog.String("workspaceDir", s.WorkspaceDir),
+		slog.String("vscodeDataOssPath", s.VscodeDataOssPath),
+		slog.String("workspaceOssPath", s.WorkspaceOssPath),
+		slog.String("syncMode", s.WorkspaceSyncMode),
+	)
+}
+
+// WithUser isolates the server for the user in multi-user mode.
+// The data directories and the storage paths are separated by the user id.
+func WithUser(user string) ServerOption {
+	return func(s *Server) {
+		s.User = user
+		s.VscodeDataDir = filepath.Join(s.VscodeDataDir, user)
+		s.WorkspaceDir = filepath.Join(s.WorkspaceDir, user)
+		s.VscodeDataOssPath = userOssPath(s.VscodeDataOssPath, user)
+		s.WorkspaceOssPath = userOssPath(s.WorkspaceOssPath, user)
+	}
+}
+
+// WithLogger logs the server by l, e.g. the logger carrying the request id of the init request.
+func WithLogger(l *slog.Logger) ServerOption {
+	return func(s *Server) {
+		s.Logger = l
+	}
+}
+
+// WithConnectionToken requires the token in the requests to vscode server.
+func WithConnectionToken(token string) ServerOption {
+	return func(s *Server) {
+		s.ConnectionToken = Secret(token)
+	}
+}
+
+// WithPort overrides the port which vscode server listens on.
+func WithPort(port string) ServerOption {
+	return func(s *Server) {
+		s.Port = port
+	}
+}
+
+// logger returns the logger of the server, which falls back to the default logger.
+func (s *Server) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return slog.Default()
+}
+
+// userOssPath inserts the user directory before the object name, e.g. a/b.tar.gz -> a/users/<user>/b.tar.gz
+func userOssPath(p string, user string) string {
+	return path.Join(path.Dir(p), "users", user, path.Base(p))
+}
+
+const (
+	SyncModeArchive     = "archive"     // save the workspace as a single tar.gz object
+	SyncModeIncremental = "incremental" // save the workspace as a content-addressed snapshot, only changed files are uploaded
+
+	// IgnoreFile in the workspace root lists the gitignore-style patterns of the files not to archive.
+	IgnoreFile = ".webideignore"
 )
 
 // NewServer creates the vscode server.
 // ctx contains info, such as the ak_id/secret credential info, that is generated at runtime.
 // configFilePath is the config file where store the configuration for vscode server running.
-func NewServer(ctx *context.Context) (*Server, error) {
+// opts customize the server after the configuration is read.
+func NewServer(ctx *context.Context, opts ...ServerOption) (*Server, error) {
 	// Read the configurations from the specified file.
 	// err := viper.ReadInConfig()
 	// if err != nil {
-	// 	glog.Errorf("Failed to read vscode server config file. Error: %v", err)
+	// 	slog.Error("Failed to read vscode server config file.", "error", err)
 	// 	return nil, err
 	// }
 
@@ -48,9 +193,32 @@ func NewServer(ctx *context.Context) (*Server, error) {
 	viper.SetDefault("vscode.dataDirectory", "~/.config/vscode-server")
 	viper.SetDefault("vscode.binaryDirectory", "")
 	viper.SetDefault("vscode.dataOssPath", "")
+	viper.SetDefault("vscode.startTimeout", "60s")
+	viper.SetDefault("vscode.stopTimeout", "10s")
+	viper.SetDefault("vscode.restartBackoff", "1s")
+	viper.SetDefault("vscode.maxRestartBackoff", "1m")
 	viper.SetDefault("workspace.directory", "/workspace")
 	viper.SetDefault("workspace.ossPath", "")
-	viper.SetDefault("ossBucketName", "")
+	viper.SetDefault("workspace.syncMode", SyncModeArchive)
+	viper.SetDefault("workspace.syncParallel", 8)
+	viper.SetDefault("workspace.snapshots.keep", 0)
+	viper.SetDefault("workspace.snapshots.maxAge", "0")
+	viper.SetDefault("workspace.preserveOwner", false)
+	viper.SetDefault("workspace.exclude", []string{})
+	viper.SetDefault("workspace.include", []string{})
+	viper.SetDefault("archive.codec", tar.DefaultCodec)
+	viper.SetDefault("archive.level", 0)
+	viper.SetDefault("archive.maxBytes", "16GB")
+	viper.SetDefault("archive.maxFiles", 2000000)
+	viper.SetDefault("archive.maxFileSize", "4GB")
+	viper.SetDefault("autosave.interval", "5m")
+	viper.SetDefault("autosave.debounce", "30s")
+	viper.SetDefault("autosave.maxInFlight", 1)
+	viper.SetDefault("lease.enabled", false)
+	viper.SetDefault("lease.mode", LeaseModeReadOnly)
+	viper.SetDefault("lease.owner", "")
+	viper.SetDefault("lease.ttl", "60s")
+	viper.SetDefault("lease.renewInterval", "0")
 
 	s := &Server{}
 	s.Host = viper.GetString("vscode.host")
@@ -58,162 +226,565 @@ func NewServer(ctx *context.Context) (*Server, error) {
 	s.VscodeDataDir, _ = homedir.Expand(viper.GetString("vscode.dataDirectory"))
 	s.VscodeBinaryDir, _ = homedir.Expand(viper.GetString("vscode.binaryDirectory"))
 	s.VscodeDataOssPath = viper.GetString("vscode.dataOssPath")
+	s.StartTimeout = viper.GetDuration("vscode.startTimeout")
+	s.StopTimeout = viper.GetDuration("vscode.stopTimeout")
+	s.RestartBackoff = viper.GetDuration("vscode.restartBackoff")
+	s.MaxRestartBackoff = viper.GetDuration("vscode.maxRestartBackoff")
 	s.WorkspaceDir, _ = homedir.Expand(viper.GetString("workspace.directory"))
 	s.WorkspaceOssPath = viper.GetString("workspace.ossPath")
-	s.OssBucketName = viper.GetString("ossBucketName")
-
-	// high priority env
-	OssBucketName := os.Getenv("OSS_BUCKET_NAME")
-	if OssBucketName != "" {
-		s.OssBucketName = OssBucketName
+	s.WorkspaceSyncMode = viper.GetString("workspace.syncMode")
+	if s.WorkspaceSyncMode != SyncModeArchive && s.WorkspaceSyncMode != SyncModeIncremental {
+		return nil, fmt.Errorf("unsupported workspace sync mode: %s", s.WorkspaceSyncMode)
+	}
+	s.SnapshotKeep = viper.GetInt("workspace.snapshots.keep")
+	s.SnapshotMaxAge = viper.GetDuration("workspace.snapshots.maxAge")
+	s.PreserveOwner = viper.GetBool("workspace.preserveOwner")
+	s.Exclude = viper.GetStringSlice("workspace.exclude")
+	s.Include = viper.GetStringSlice("workspace.include")
+	s.Codec = viper.GetString("archive.codec")
+	s.CodecLevel = viper.GetInt("archive.level")
+	if err := tar.ValidateCodec(s.Codec, s.CodecLevel); err != nil {
+		return nil, err
+	}
+	s.Limits = tar.Limits{
+		MaxBytes:    int64(viper.GetSizeInBytes("archive.maxBytes")),
+		MaxFiles:    viper.GetInt64("archive.maxFiles"),
+		MaxFileSize: int64(viper.GetSizeInBytes("archive.maxFileSize")),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.User != "" {
+		s.Logger = s.logger().With("user", s.User)
 	}
 
-	glog.Infof("Read vscode server config succeeded. Server config: %+v", *s)
+	s.logger().Info("Read vscode server config succeeded.", "server", s)
 
-	ossEndpoint := "https://oss-" + ctx.Region + ".aliyuncs.com"
-	c, err := oss.New(ossEndpoint, ctx.AccessKeyId, ctx.AccessKeySecret, oss.SecurityToken(ctx.SecurityToken))
+	backend, err := storage.New(ctx)
 	if err != nil {
-		glog.Errorf("Create oss client failed. Context: %+v Error: %v", ctx, err)
+		s.logger().Error("Create storage backend failed.", "context", ctx, "error", err)
 		return nil, err
 	}
-	s.OssClient = c
+	s.Storage = backend
+	s.Syncer = snapshot.NewSyncer(backend, viper.GetInt("workspace.syncParallel"))
+	s.Syncer.Logger = s.logger()
+	s.WorkspaceProgress = newLoadProgress()
 
+	// The autosave is started after the init succeeds and the workspace is loaded.
+	interval := viper.GetDuration("autosave.interval")
+	debounce := viper.GetDuration("autosave.debounce")
+	if interval > 0 || debounce > 0 {
+		s.Autosaver = NewAutosaver(s.saveAll, s.WorkspaceDir, interval, debounce, viper.GetInt("autosave.maxInFlight"))
+		s.Autosaver.Logger = s.logger()
+	}
+
+	// The lease is stored next to the workspace object, which is known after the options are applied.
+	if viper.GetBool("lease.enabled") {
+		owner := viper.GetString("lease.owner")
+		if owner == "" {
+			owner = leaseOwner()
+		}
+		s.Lease, err = NewLease(backend, s.WorkspaceOssPath+".lease", owner, viper.GetString("lease.mode"),
+			viper.GetDuration("lease.ttl"), viper.GetDuration("lease.renewInterval"))
+		if err != nil {
+			return nil, err
+		}
+		s.Lease.Logger = s.logger()
+	}
+
+	start := time.Now()
 	if err = s.init(); err != nil {
-		glog.Errorf("Init vscode server failed. Error: %v", err)
+		s.logger().Error("Init vscode server failed.", logging.Duration(start), "error", err)
+		if s.Lease != nil {
+			s.Lease.Release()
+		}
 		return nil, err
 	}
 
-	glog.Infof("Init vscode server succeeded.")
+	s.logger().Info("Init vscode server succeeded.", logging.Duration(start))
+
+	if s.Autosaver != nil {
+		go func() {
+			<-s.workspaceDone
+			if s.WorkspaceProgress.Status().State == LoadStateDone {
+				s.Autosaver.Start()
+			}
+		}()
+	}
 
 	return s, nil
 }
 
 // init the vscode server.
-func (s *Server) init() error {
-	// Load workspace from oss.
-	workspaceLoadingResult := make(chan error)
+// Vscode server is launched without waiting for the workspace loading, which continues in the background.
+// The progress is reported by WorkspaceProgress. If the init fails, the loading is aborted and waited for,
+// so nothing is left running in the background.
+func (s *Server) init() (err error) {
+	// The workspace directory is opened by vscode server, make sure it exists before launching.
+	if err := os.MkdirAll(s.WorkspaceDir, 0755); err != nil {
+		s.logger().Error("Create workspace directory failed.", "dir", s.WorkspaceDir, "error", err)
+		return err
+	}
+
+	// The lease is acquired before the workspace is loaded, so the loaded workspace is the latest one saved
+	// by the previous owner. A server without the lease serves the workspace read-only.
+	if s.Lease != nil {
+		if err := s.Lease.Acquire(); err != nil {
+			s.logger().Error("Acquire lease failed, the workspace is not saved until acquired.", "key", s.Lease.Key, "error", err)
+		} else if !s.Lease.Held() {
+			s.logger().Warn("Workspace is leased by another instance, it is not saved until the lease is released or expired.",
+				"holder", s.Lease.Status().Holder)
+		}
+		s.Lease.Start()
+	}
+
+	// Load workspace from storage. Hold the workspace lock before returning,
+	// so the saves issued right after init wait for the loading.
+	s.workspaceLock.Lock()
+	s.workspaceDone = make(chan struct{})
 	go func() {
-		err := s.load(s.WorkspaceOssPath, s.WorkspaceDir)
-		workspaceLoadingResult <- err
+		defer close(s.workspaceDone)
+		s.loadWorkspace()
+	}()
+	defer func() {
+		if err != nil {
+			s.WorkspaceProgress.abort()
+			<-s.workspaceDone
+		}
 	}()
 
-	// Load vscode server data from oss.
-	if err := s.load(s.VscodeDataOssPath, s.VscodeDataDir); err != nil {
-		glog.Errorf("Load vscode server data from oss failed. Vscode server: %+v Error: %v", *s, err)
+	// Load vscode server data from storage. The ETag is taken before the object is read, like the workspace.
+	start := time.Now()
+	s.dataETag = ""
+	if info, err := s.Storage.Stat(s.VscodeDataOssPath); err == nil {
+		s.dataETag = info.ETag
+	}
+	err = s.load(s.VscodeDataOssPath, s.VscodeDataDir)
+	s.dataLoad.record(start, 0, err)
+	metrics.ObservePersistence(metrics.OperationLoad, metrics.TargetData, start, err)
+	if err != nil {
+		s.logger().Error("Load vscode server data from storage failed.", "phase", metrics.PhaseDataLoad,
+			"key", s.VscodeDataOssPath, "dir", s.VscodeDataDir, logging.Duration(start), "error", err)
 		return err
 	}
-	glog.Infof("Load vscode server data from oss succeeded.")
-
-	// Make sure vscode server is ready for recive the requests.
+	metrics.ObserveInitPhase(metrics.PhaseDataLoad, start)
+	s.logger().Info("Load vscode server data from storage succeeded.", "phase", metrics.PhaseDataLoad, logging.Duration(start))
 
 	// Launch the vscode server.
 	// Make sure the openvscode-server binary in the system path.
 	userDataDir := filepath.Join(s.VscodeDataDir, "user-data")
 	serverDataDir := filepath.Join(s.VscodeDataDir, "server-data")
 	extensionsDir := filepath.Join(s.VscodeDataDir, "extensions")
-	// if use token auth, "--connection-token=<my token>"
-	cmd := exec.Command(
-		filepath.Join(s.VscodeBinaryDir, "openvscode-server"),
-		"--host="+s.Host, "--port="+s.Port,
-		"--user-data-dir="+userDataDir, "--server-data-dir="+serverDataDir, "--extensions-dir="+extensionsDir,
-		"--without-connection-token", "--start-server", "--telemetry-level=off", "--default-folder="+s.WorkspaceDir)
-	err := cmd.Start()
+	tokenArg, err := s.connectionTokenArg()
 	if err != nil {
-		glog.Errorf("Launch vscode server failed. cmd: %s error: %v", cmd.String(), err)
+		s.logger().Error("Write vscode server connection token failed.", "error", err)
 		return err
 	}
-	glog.Infof("Launch vscode server succeeded. Cmd: %s", cmd.String())
-
-	for {
-		if _, err := net.Dial("tcp", s.Host+":"+s.Port); err == nil {
-			glog.Infof("Vscode server ready for recive requests.")
-			break
-		} else {
-			glog.Infof("Waiting for vscode server ready: %v", err)
-			time.Sleep(30 * time.Millisecond)
-		}
+	command := func() *exec.Cmd {
+		return exec.Command(
+			filepath.Join(s.VscodeBinaryDir, "openvscode-server"),
+			"--host="+s.Host, "--port="+s.Port,
+			"--user-data-dir="+userDataDir, "--server-data-dir="+serverDataDir, "--extensions-dir="+extensionsDir,
+			tokenArg, "--start-server", "--telemetry-level=off", "--default-folder="+s.WorkspaceDir)
 	}
-
-	// Wait for the workspace loading goroutine done.
-	// Ideally, vscode server launching should not be blocked by workspace loading.
-	// User should see vscode in browser very quickly and an on-going workspace loading in vscode web ide, like what did in vscode.dev for loading github project.
-	// TODO: Optimize out the waiting for workspace loading.
-	err = <-workspaceLoadingResult
-	if err != nil {
+	start = time.Now()
+	s.Process = NewSupervisor("vscode server", command, s.RestartBackoff, s.MaxRestartBackoff)
+	s.Process.StopTimeout = s.StopTimeout
+	s.Process.Logger = s.logger()
+	if err = s.Process.Start(); err != nil {
+		s.stopProcess()
 		return err
 	}
 
-	glog.Infof("Load workspace data from oss succeeded.")
+	// Make sure vscode server is ready for recive the requests.
+	addr := net.JoinHostPort(s.Host, s.Port)
+	if err = waitListening(addr, s.StartTimeout); err != nil {
+		s.logger().Error("Vscode server is not listening.", "phase", metrics.PhaseVscodeReady, "addr", addr,
+			"timeout", s.StartTimeout.String(), "error", err)
+		s.stopProcess()
+		return fmt.Errorf("vscode server is not ready after %s: %w", s.StartTimeout, err)
+	}
+	metrics.ObserveInitPhase(metrics.PhaseVscodeReady, start)
+	s.logger().Info("Vscode server ready for recive requests.", "phase", metrics.PhaseVscodeReady, logging.Duration(start))
 
 	return nil
 }
 
+// loadWorkspace loads the workspace from storage with the workspace lock held, which is acquired by the caller.
+func (s *Server) loadWorkspace() {
+	defer s.workspaceLock.Unlock()
+
+	start := time.Now()
+	// The ETag is taken before the object is read, so a change in between is a conflict rather than a lost update.
+	var totalBytes int64
+	s.workspaceETag = ""
+	s.conflicted.record(nil)
+	info, err := s.Storage.Stat(s.WorkspaceOssPath)
+	if err == nil {
+		totalBytes = info.Size
+		s.workspaceETag = info.ETag
+	}
+	s.WorkspaceProgress.start(totalBytes)
+
+	// The stored workspace is unknown if it can not be stat, the loading fails rather than keeping the local one.
+	if err == nil || errors.Is(err, storage.ErrNotFound) {
+		err = s.restoreWorkspace(s.WorkspaceOssPath, s.WorkspaceProgress)
+	}
+	s.WorkspaceProgress.finish(err)
+	metrics.ObservePersistence(metrics.OperationLoad, metrics.TargetWorkspace, start, err)
+	if err != nil {
+		s.logger().Error("Load workspace data from storage failed.", "phase", metrics.PhaseWorkspaceLoad,
+			"key", s.WorkspaceOssPath, logging.Duration(start), "error", err)
+		return
+	}
+	metrics.ObserveInitPhase(metrics.PhaseWorkspaceLoad, start)
+	s.workspaceLoaded = true
+	s.logger().Info("Load workspace data from storage succeeded.", "phase", metrics.PhaseWorkspaceLoad, logging.Duration(start))
+}
+
 // Shutdown shut down the vscode server.
+// Vscode server is terminated before the final save, so the data it writes on exit is saved.
 func (s *Server) Shutdown() {
-	// Save the vscode server data to oss.
-	err := s.save(s.VscodeDataDir, s.VscodeDataOssPath)
+	// Stop the background saves, the final save is done below.
+	if s.Autosaver != nil {
+		s.Autosaver.Stop()
+	}
+
+	s.stopProcess()
+	s.saveAll()
+	if s.Lease != nil {
+		s.Lease.Release()
+	}
+}
+
+// connectionTokenArg returns the vscode server argument of the connection token.
+// The token is passed by a file, so it is not visible in the process list and the logs.
+// The file is not in VscodeDataDir, which is saved to storage.
+func (s *Server) connectionTokenArg() (string, error) {
+	if s.ConnectionToken == "" {
+		return "--without-connection-token", nil
+	}
+	f, err := os.CreateTemp("", "vscode-connection-token-")
 	if err != nil {
-		glog.Errorf("Save vscode server data failed. Vscode server: %+v. Error: %v", *s, err)
+		return "", err
+	}
+	defer f.Close()
+	if _, err = f.WriteString(string(s.ConnectionToken)); err != nil {
+		os.Remove(f.Name())
+		return "", err
 	}
+	s.tokenFile = f.Name()
+	return "--connection-token-file=" + s.tokenFile, nil
+}
 
-	// Save the workspace data to oss.
-	err = s.save(s.WorkspaceDir, s.WorkspaceOssPath)
+// stopProcess kills the vscode server process and waits for it to exit.
+func (s *Server) stopProcess() {
+	if s.Process != nil {
+		s.Process.Stop()
+	}
+	if s.tokenFile != "" {
+		os.Remove(s.tokenFile)
+	}
+}
+
+// saveAll saves the vscode server data and the workspace data to storage.
+// It returns the first error, but always tries to save both.
+func (s *Server) saveAll() error {
+	// Save the vscode server data to storage.
+	start := time.Now()
+	dataErr := s.saveData()
+	if dataErr != nil {
+		s.logger().Error("Save vscode server data failed.", "key", s.VscodeDataOssPath, "dir", s.VscodeDataDir,
+			logging.Duration(start), "error", dataErr)
+	}
+
+	// Save the workspace data to storage.
+	start = time.Now()
+	err := s.saveWorkspace()
 	if err != nil {
-		glog.Errorf("Save workspace data failed. Vscode server: %+v. Error: %v", *s, err)
+		s.logger().Error("Save workspace data failed.", "key", s.WorkspaceOssPath, "dir", s.WorkspaceDir,
+			logging.Duration(start), "error", err)
+	}
+
+	if dataErr != nil {
+		return dataErr
 	}
+	return err
 }
 
-// load Load tar.gz from oss and extract to local directory.
-// src The source oss object path.
-// dst The destination local directory.
-func (s *Server) load(src string, dst string) error {
-	bucket, err := s.OssClient.Bucket(s.OssBucketName)
+// saveData saves the vscode server data to storage. Like the workspace, it refuses to save if the lease is held
+// by others, and the object is written only if it is not changed by others since loaded or saved last.
+func (s *Server) saveData() (err error) {
+	s.dataLock.Lock()
+	defer s.dataLock.Unlock()
+	start := time.Now()
+	var size int64
+	defer func() {
+		s.dataSave.record(start, size, err)
+		metrics.ObservePersistence(metrics.OperationSave, metrics.TargetData, start, err)
+	}()
+	if s.Lease != nil && !s.Lease.Held() {
+		return fmt.Errorf("vscode server data %s is leased by %s, refuse to save it", s.VscodeDataOssPath, s.Lease.Status().Holder)
+	}
+
+	etag, size, err := s.saveIf(s.VscodeDataDir, s.VscodeDataOssPath, s.dataETag)
+	if errors.Is(err, storage.ErrPreconditionFailed) {
+		return fmt.Errorf("vscode server data %s is changed by others since loaded, refuse to save it: %w", s.VscodeDataOssPath, err)
+	}
 	if err != nil {
-		glog.Errorf("Get oss bucket failed. Vscode server: %+v", *s)
 		return err
 	}
+	s.dataETag = etag
+	return nil
+}
 
-	body, err := bucket.GetObject(src)
-	if err != nil {
-		srvErr := err.(oss.ServiceError)
-		if srvErr.Code == "NoSuchKey" && srvErr.StatusCode == 404 {
-			// No workspace data. Just create workspace directory and return.
-			if err = os.MkdirAll(dst, 0755); err != nil {
-				glog.Errorf("Create local directory %s failed. Error: %v", dst, err)
-				return err
-			}
-			return nil
-		} else {
-			glog.Errorf("Get oss object %s failed. Error: %v", src, err)
-			return err
+// saveWorkspace saves the workspace data to storage according to the workspace sync mode.
+// It waits for the on-going workspace loading, and refuses to save if the loading failed,
+// otherwise the stored workspace would be overwritten by a partial one.
+func (s *Server) saveWorkspace() (err error) {
+	s.workspaceLock.Lock()
+	defer s.workspaceLock.Unlock()
+	start := time.Now()
+	var size int64
+	defer func() {
+		s.workspaceSave.record(start, size, err)
+		metrics.ObservePersistence(metrics.OperationSave, metrics.TargetWorkspace, start, err)
+	}()
+	if !s.workspaceLoaded {
+		return fmt.Errorf("workspace is not loaded completely, refuse to save it")
+	}
+	if s.restoring() {
+		return fmt.Errorf("the last restore of workspace %s did not complete, refuse to save it", s.WorkspaceDir)
+	}
+	if s.Lease != nil && !s.Lease.Held() {
+		return fmt.Errorf("workspace %s is leased by %s, refuse to save it", s.WorkspaceOssPath, s.Lease.Status().Holder)
+	}
+
+	if c := s.conflicted.Status(); c != nil {
+		return s.saveConflict(c)
+	}
+
+	// The workspace is written only if it is not changed by others since loaded or saved last.
+	var etag string
+	if s.WorkspaceSyncMode == SyncModeIncremental {
+		etag, size, err = s.saveIncremental()
+	} else {
+		etag, size, err = s.saveArchive()
+	}
+	if errors.Is(err, storage.ErrPreconditionFailed) {
+		c := &ConflictStatus{
+			Time: time.Now(),
+			Key:  s.conflictPrefix() + time.Now().UTC().Format(snapshotTimeFormat),
+			ETag: s.workspaceETag,
 		}
+		s.conflicted.record(c)
+		return s.saveConflict(c)
 	}
-	err = tar.ExtractTarGz(body, dst)
 	if err != nil {
-		glog.Errorf("Extract tar gz failed. Local directory: %s Error: %v", dst, err)
 		return err
 	}
-	glog.Infof("Load succeeded. Oss path: %s Local directory: %s", src, dst)
+	s.workspaceETag = etag
+
+	// The workspace is saved, a failed snapshot does not fail the save.
+	if err = s.takeSnapshot(); err != nil {
+		s.logger().Error("Take workspace snapshot failed.", "error", err)
+	}
 	return nil
 }
 
-// save Archive the local directory and save to the oss.
-// src The source local directory.
-// dst The destination oss object path.
-func (s *Server) save(src string, dst string) error {
-	bucket, err := s.OssClient.Bucket(s.OssBucketName)
+// saveArchive archives the workspace without the excluded files, and reports them.
+// The archive is written only if the stored one has the ETag workspaceETag, and its new ETag and size are returned.
+func (s *Server) saveArchive() (string, int64, error) {
+	exclude := s.workspaceExclude()
+	if exclude.Empty() {
+		s.excluded.record(nil)
+		return s.saveIf(s.WorkspaceDir, s.WorkspaceOssPath, s.workspaceETag)
+	}
+
+	report := &ExcludeStatus{}
+	etag, size, err := s.saveIf(s.WorkspaceDir, s.WorkspaceOssPath, s.workspaceETag,
+		tar.WithExclude(exclude.Match), tar.WithSkipped(report.add))
+	if err != nil {
+		return "", 0, err
+	}
+	s.excluded.record(report)
+	s.logger().Info("Excluded files from the workspace archive.", "files", report.Files, "bytes", report.Bytes, "paths", report.Paths)
+	return etag, size, nil
+}
+
+// conflictPrefix returns the prefix of the workspace saves kept aside on conflicts, which are stored next to
+// the workspace object.
+func (s *Server) conflictPrefix() string {
+	return s.WorkspaceOssPath + ".conflicts/"
+}
+
+// saveConflict archives the workspace to the conflict object instead of the stored workspace changed by others,
+// and returns the error telling the conflict. The archive is self-contained in either sync mode, and it can be
+// restored like a snapshot.
+func (s *Server) saveConflict(c *ConflictStatus) error {
+	err := s.save(s.WorkspaceDir, c.Key, tar.WithExclude(s.workspaceExclude().Match))
 	if err != nil {
-		glog.Errorf("Get oss bucket failed. Vscode server: %+v Error: %v", *s, err)
+		return fmt.Errorf("workspace %s is changed by others, and saving it aside to %s failed: %w", s.WorkspaceOssPath, c.Key, err)
+	}
+	s.logger().Warn("Workspace is changed by others since loaded, saved it aside.", "key", s.WorkspaceOssPath, "conflictKey", c.Key)
+	return fmt.Errorf("workspace %s is changed by others since loaded, saved it aside to %s: %w",
+		s.WorkspaceOssPath, c.Key, storage.ErrPreconditionFailed)
+}
+
+// saveIncremental saves the snapshot of the workspace without the excluded files, and reports them.
+// The manifest is written only if the stored one has the ETag workspaceETag, and its new ETag and the total size
+// of the snapshot files are returned.
+func (s *Server) saveIncremental() (string, int64, error) {
+	exclude := s.workspaceExclude()
+	var opts []snapshot.Option
+	report := &ExcludeStatus{}
+	if !exclude.Empty() {
+		opts = append(opts, snapshot.WithExclude(exclude.Match), snapshot.WithSkipped(report.add))
+	}
+	stats, etag, err := s.Syncer.SaveIf(s.WorkspaceDir, s.WorkspaceOssPath, s.workspaceETag, opts...)
+	if err != nil {
+		return "", 0, err
+	}
+	metrics.ArchiveSize.WithLabelValues(metrics.OperationSave).Observe(float64(stats.Bytes))
+	if exclude.Empty() {
+		s.excluded.record(nil)
+		return etag, stats.Bytes, nil
+	}
+	s.excluded.record(report)
+	s.logger().Info("Excluded files from the workspace snapshot.", "files", report.Files, "bytes", report.Bytes, "paths", report.Paths)
+	return etag, stats.Bytes, nil
+}
+
+// workspaceExclude returns the matcher of the workspace files not to save. The patterns are read from Exclude,
+// IgnoreFile in the workspace and Include in order, so the later ones take precedence.
+// An unreadable IgnoreFile is logged and skipped rather than failing the save.
+func (s *Server) workspaceExclude() *ignore.Matcher {
+	patterns := append([]string{}, s.Exclude...)
+	lines, err := ignore.ReadFile(filepath.Join(s.WorkspaceDir, IgnoreFile))
+	if err != nil {
+		s.logger().Warn("Read ignore file failed, its patterns are not applied.", "file", IgnoreFile, "error", err)
+	}
+	patterns = append(patterns, lines...)
+	for _, p := range s.Include {
+		patterns = append(patterns, "!"+p)
+	}
+	return ignore.New(patterns)
+}
+
+// load Load tar.gz or snapshot from the storage and extract to local directory.
+// The format is detected from the object content, so the data saved in either sync mode can be loaded.
+// The encrypted objects are decrypted by the storage backend, see storage.Encrypted.
+// src The source object path.
+// dst The destination local directory.
+func (s *Server) load(src string, dst string) error {
+	return s.loadWithProgress(src, dst, "", nil)
+}
+
+// loadWithProgress is load which reports the progress to p if it is not nil.
+// The snapshot files up to date in the local directory base are copied rather than downloaded if base is not empty.
+func (s *Server) loadWithProgress(src string, dst string, base string, p *LoadProgress) error {
+	body, err := s.Storage.Get(src)
+	if errors.Is(err, storage.ErrNotFound) {
+		// No workspace data. Just create workspace directory and return.
+		if err = os.MkdirAll(dst, 0755); err != nil {
+			s.logger().Error("Create local directory failed.", "dir", dst, "error", err)
+			return err
+		}
+		return nil
+	} else if err != nil {
+		s.logger().Error("Get object failed.", "key", src, "error", err)
 		return err
 	}
+	defer body.Close()
 
-	buf := bytes.NewBuffer(nil)
-	tar.TarGz(src, buf)
-	err = bucket.PutObject(dst, buf)
+	opts := []tar.Option{tar.WithLimits(s.Limits), tar.WithLogger(s.logger())}
+	if s.PreserveOwner {
+		opts = append(opts, tar.WithOwner())
+	}
+	var progress snapshot.ProgressFunc
+	ctx := p.context()
+	in := &countingReader{r: &contextReader{ctx: ctx, r: body}, count: func(int64) {}}
+	if p != nil {
+		// The archive progress is measured by the compressed bytes, which is comparable to the object size.
+		in.count = func(n int64) { p.update(-1, n, -1) }
+		opts = append(opts, tar.WithProgress(func(files int64, bytes int64) { p.update(files, -1, -1) }))
+		progress = p.update
+	}
+
+	r := bufio.NewReader(in)
+	header, _ := r.Peek(len(encryption.Magic))
+	if encryption.IsEncrypted(header) {
+		// The encrypted objects are decrypted by the storage if the encryption is enabled.
+		err = fmt.Errorf("object %s is encrypted, but the encryption is not enabled", src)
+		s.logger().Error("Load failed.", "key", src, "error", err)
+		return err
+	}
+	if snapshot.IsManifest(header) {
+		// The snapshots of the workspace share its blobs.
+		key := src
+		if strings.HasPrefix(src, s.snapshotPrefix()) {
+			key = s.WorkspaceOssPath
+		}
+		stats, err := s.Syncer.Load(ctx, r, key, dst, base, progress)
+		if err != nil {
+			s.logger().Error("Load snapshot failed.", "key", src, "dir", dst, "error", err)
+			return err
+		}
+		metrics.ArchiveSize.WithLabelValues(metrics.OperationLoad).Observe(float64(stats.Bytes))
+		s.logger().Info("Load succeeded.", "key", src, "dir", dst, "bytes", stats.Bytes)
+		return nil
+	}
+
+	err = tar.ExtractTarGz(r, dst, opts...)
 	if err != nil {
-		glog.Errorf("Put oss bucket %s failed. Error: %v", dst, err)
+		s.logger().Error("Extract tar gz failed.", "key", src, "dir", dst, "error", err)
 		return err
 	}
-	glog.Infof("Save succeeded. Local directory:%s Oss path: %s", src, dst)
+	metrics.ArchiveSize.WithLabelValues(metrics.OperationLoad).Observe(float64(in.n))
+	s.logger().Info("Load succeeded.", "key", src, "dir", dst, "bytes", in.n)
 	return nil
 }
+
+// save Archive the local directory and save to the storage.
+// The archive is streamed to the storage through a pipe, so it is never buffered in memory as a whole.
+// src The source local directory.
+// dst The destination object path.
+// opts The archive options.
+func (s *Server) save(src string, dst string, opts ...tar.Option) error {
+	_, _, err := s.upload(src, dst, func(r io.Reader) (string, error) {
+		return "", s.Storage.Put(dst, r)
+	}, opts...)
+	return err
+}
+
+// saveIf is save which writes the object only if it is not changed since it had the ETag etag,
+// or does not exist if etag is empty, see storage.Backend.PutIf. It returns the ETag and the size of the saved object.
+func (s *Server) saveIf(src string, dst string, etag string, opts ...tar.Option) (string, int64, error) {
+	return s.upload(src, dst, func(r io.Reader) (string, error) {
+		return s.Storage.PutIf(dst, r, etag)
+	}, opts...)
+}
+
+// upload archives src and streams the archive to put. It returns the ETag from put and the size of the archive.
+func (s *Server) upload(src string, dst string, put func(r io.Reader) (string, error), opts ...tar.Option) (string, int64, error) {
+	opts = append(opts, tar.WithLogger(s.logger()))
+	if s.Codec != "" {
+		opts = append(opts, tar.WithCompression(s.Codec, s.CodecLevel))
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		// The archiving error is returned to the storage by the pipe reader, which aborts the upload.
+		pw.CloseWithError(tar.TarGz(src, pw, opts...))
+	}()
+	counted := &countingReader{r: pr, count: func(int64) {}}
+	etag, err := put(counted)
+	// Unblock the archiving goroutine if the upload failed before reading all the data.
+	pr.CloseWithError(err)
+	if err != nil {
+		s.logger().Error("Put object failed.", "key", dst, "error", err)
+		return "", 0, err
+	}
+	metrics.ArchiveSize.WithLabelValues(metrics.OperationSave).Observe(float64(counted.n))
+	s.logger().Info("Save succeeded.", "dir", src, "key", dst, "bytes", counted.n)
+	return etag, counted.n, nil
+}
@@ -2,140 +2,826 @@ package vscode
 
 import (
 	"aliyun/serverless/webide-server/pkg/context"
-	"io/ioutil"
+	"aliyun/serverless/webide-server/pkg/encryption"
+	"aliyun/serverless/webide-server/pkg/logging"
+	"aliyun/serverless/webide-server/pkg/snapshot"
+	"aliyun/serverless/webide-server/pkg/storage"
+	"aliyun/serverless/webide-server/pkg/storage/osstest"
+	"aliyun/serverless/webide-server/pkg/tar"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
-	"path"
+	"os/signal"
 	"path/filepath"
-	"runtime"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
-	"github.com/aliyun/aliyun-oss-go-sdk/oss"
 	"github.com/spf13/viper"
 )
 
-// To run the tests, please config the following items in configs/test.yaml
-// 1. ossBucketName
-// 2. vscode.dataDirectory
-// 3. vscode.binaryDirectory
-// 4. vscode.dataOssPath
-// 5. workspace.directory
-// 6. workspace.ossPath
+// The tests run against the fake oss server in osstest and the fake vscode server below,
+// so neither the cloud credentials nor the openvscode-server binary are required.
 
-// Setup the test cases. Make sure the working dir is the project root directory.
-func chdir() {
-	_, filename, _, _ := runtime.Caller(0)
-	dir := path.Join(path.Dir(filename), "../..")
-	err := os.Chdir(dir)
-	if err != nil {
-		panic(err)
+const (
+	testAccessKeyId = "test-id"
+	// fakeVscodeServerEnv makes the test binary run as the fake vscode server.
+	fakeVscodeServerEnv = "WEBIDE_FAKE_VSCODE_SERVER"
+)
+
+func TestMain(m *testing.M) {
+	if os.Getenv(fakeVscodeServerEnv) == "1" {
+		fakeVscodeServer(os.Args[1:])
+		return
 	}
+	os.Exit(m.Run())
 }
 
-func TestLoadEmptyWorkspace(t *testing.T) {
-	chdir()
+// fakeVscodeServer accepts the arguments of openvscode-server, and serves "openvscode-server"
+// to the requests with the connection token. On SIGTERM it writes user-data-dir/exit.log and exits,
+// like vscode server flushing its state on exit.
+func fakeVscodeServer(args []string) {
+	flags := map[string]string{}
+	for _, arg := range args {
+		kv := strings.SplitN(strings.TrimPrefix(arg, "--"), "=", 2)
+		if len(kv) == 2 {
+			flags[kv[0]] = kv[1]
+		}
+	}
+	var token string
+	if file := flags["connection-token-file"]; file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "read connection token file failed: %v\n", err)
+			os.Exit(1)
+		}
+		token = string(data)
+	}
 
-	ctx, err := context.NewFromEnvVars()
+	listener, err := net.Listen("tcp", net.JoinHostPort(flags["host"], flags["port"]))
 	if err != nil {
-		t.Fatalf("%v", err)
+		fmt.Fprintf(os.Stderr, "listen failed: %v\n", err)
+		os.Exit(1)
 	}
+	fmt.Println("Web UI available at http://" + listener.Addr().String())
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" && r.URL.Query().Get("tkn") != token {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, "openvscode-server")
+	}))
 
-	// The tests must run in the project root directory.
-	viper.SetConfigFile("configs/test.yaml")
-	viper.ReadInConfig()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM)
+	<-signals
+	os.MkdirAll(flags["user-data-dir"], 0755)
+	os.WriteFile(filepath.Join(flags["user-data-dir"], "exit.log"), []byte("exited"), 0644)
+}
 
-	vserver, err := NewServer(ctx)
+// fakeVscodeBinary writes the openvscode-server script running the fake vscode server,
+// and returns the directory of the script.
+func fakeVscodeBinary(t *testing.T) string {
+	exe, err := os.Executable()
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("unable to get the test binary: %v", err)
+	}
+	dir := t.TempDir()
+	script := fmt.Sprintf("#!/bin/sh\nexport %s=1\nexec '%s' \"$@\"\n", fakeVscodeServerEnv, exe)
+	if err = os.WriteFile(filepath.Join(dir, "openvscode-server"), []byte(script), 0755); err != nil {
+		t.Fatalf("unable to write the fake vscode server: %v", err)
+	}
+	return dir
+}
+
+// setupOss starts the fake oss server, and configures the oss storage driver to use it.
+// It returns the context with the credentials accepted by the server.
+func setupOss(t *testing.T) (*osstest.Server, *context.Context) {
+	server := osstest.NewServer("webide")
+	server.AccessKeyId = testAccessKeyId
+	t.Cleanup(server.Close)
+
+	viper.Set("storage.driver", storage.DriverOss)
+	viper.Set("storage.oss.endpoint", server.Endpoint())
+	viper.Set("ossBucketName", server.Bucket)
+	t.Cleanup(viper.Reset)
+
+	return server, newTestContext(testAccessKeyId)
+}
+
+func newTestContext(accessKeyId string) *context.Context {
+	return &context.Context{
+		Source: context.SourceEnv,
+		Region: "cn-hangzhou",
+		Credentials: context.NewCredentialCache(&context.StaticProvider{
+			Credentials: context.Credentials{AccessKeyId: accessKeyId, AccessKeySecret: "secret"},
+		}, 0),
+	}
+}
+
+// writeFiles creates the files with the contents under dir.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("unable to create dir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("unable to write file %s: %v", path, err)
+		}
+	}
+}
+
+// archive returns the tar.gz of the files.
+func archive(t *testing.T, files map[string]string) []byte {
+	dir := t.TempDir()
+	writeFiles(t, dir, files)
+	var buf bytes.Buffer
+	if err := tar.TarGz(dir, &buf); err != nil {
+		t.Fatalf("unable to archive: %v", err)
 	}
-	vserver.OssBucketName = viper.GetString("ossBucketName")
-	ossEndpoint := "https://oss-" + ctx.Region + ".aliyuncs.com"
-	c, err := oss.New(ossEndpoint, ctx.AccessKeyId, ctx.AccessKeySecret, oss.SecurityToken(ctx.SecurityToken))
+	return buf.Bytes()
+}
+
+// freePort returns a port which is not listened.
+func freePort(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
-		t.Fatalf("Create oss client failed. Context: %v Error: %v", ctx, err)
+		t.Fatalf("unable to listen: %v", err)
 	}
-	vserver.OssClient = c
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return port
+}
 
-	// Load workspace from oss and extract data to local directory.
-	vserver.WorkspaceDir, err = os.MkdirTemp("", "")
-	defer os.RemoveAll(vserver.WorkspaceDir)
+func TestLoadEmptyWorkspace(t *testing.T) {
+	server, ctx := setupOss(t)
+	backend, err := storage.New(ctx)
 	if err != nil {
-		t.Fatalf("unable to create temporary dir: %s", vserver.WorkspaceDir)
+		t.Fatalf("Create storage backend failed. Error: %v", err)
 	}
+	vserver := &Server{Storage: backend}
+
+	// Load the missing workspace, the local directory is created.
+	vserver.WorkspaceDir = filepath.Join(t.TempDir(), "workspace")
 	vserver.WorkspaceOssPath = "dummy"
 	if err = vserver.load(vserver.WorkspaceOssPath, vserver.WorkspaceDir); err != nil {
 		t.Fatalf("unable to load workspace. error: %v", err)
 	}
 
 	// Expect the local directory is empty.
-	dir, _ := ioutil.ReadDir(vserver.WorkspaceDir)
-	if len(dir) != 0 {
-		t.Fatalf("expect empty directory, but got %v", dir)
+	dir, err := os.ReadDir(vserver.WorkspaceDir)
+	if err != nil || len(dir) != 0 {
+		t.Fatalf("expect empty directory, but got %v, error: %v", dir, err)
+	}
+	if n := server.Requests("GetObject"); n != 1 {
+		t.Fatalf("expected 1 GetObject request, but got %d", n)
 	}
 }
 
 func TestWorkspace(t *testing.T) {
-	ctx, err := context.NewFromEnvVars()
+	server, ctx := setupOss(t)
+	viper.Set("storage.partSize", storage.MinPartSize)
+
+	vserver := &Server{WorkspaceOssPath: "tests/vscode-server/workspace.tar.gz"}
+	var err error
+	vserver.Storage, err = storage.New(ctx)
 	if err != nil {
-		t.Fatalf("%v", err)
+		t.Fatalf("Create storage backend failed. Error: %v", err)
+	}
+
+	// Prepare the mock workspace data. The random file is larger than a part, so the archive is uploaded in parts.
+	srcTemp := t.TempDir()
+	writeFiles(t, srcTemp, map[string]string{
+		"file1.txt":       "this is file1.",
+		"file2/file2.txt": "this is file2.",
+	})
+	large := make([]byte, storage.MinPartSize+1)
+	rand.Read(large)
+	if err = os.WriteFile(filepath.Join(srcTemp, "large.bin"), large, 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+
+	// Save workspace data to oss.
+	if err = vserver.save(srcTemp, vserver.WorkspaceOssPath); err != nil {
+		t.Fatalf("unable to save workspace. error: %v", err)
+	}
+	if server.Requests("UploadPart") < 2 || server.Requests("CompleteMultipartUpload") != 1 {
+		t.Fatalf("expected the multipart upload, but got %d parts", server.Requests("UploadPart"))
 	}
 
-	// The tests must run in the project root directory.
-	viper.SetConfigFile("configs/test.yaml")
-	viper.ReadInConfig()
+	// Load workspace data from oss.
+	dstTemp := t.TempDir()
+	if err = vserver.load(vserver.WorkspaceOssPath, dstTemp); err != nil {
+		t.Fatalf("unable to load workspace. error: %v", err)
+	}
 
-	vserver := &Server{}
-	vserver.OssBucketName = viper.GetString("ossBucketName")
-	vserver.WorkspaceOssPath = viper.GetString("workspace.ossPath")
-	ossEndpoint := "https://oss-" + ctx.Region + ".aliyuncs.com"
-	c, err := oss.New(ossEndpoint, ctx.AccessKeyId, ctx.AccessKeySecret, oss.SecurityToken(ctx.SecurityToken))
+	// Verify the data.
+	cmd := exec.Command("diff", "--recursive", srcTemp, dstTemp)
+	if err = cmd.Run(); err != nil {
+		t.Fatalf("The two directories are not equal.\nSrc dir: %s\nDst dir: %s\nError: %v", srcTemp, dstTemp, err)
+	}
+}
+
+func TestWorkspaceExclude(t *testing.T) {
+	for _, mode := range []string{SyncModeArchive, SyncModeIncremental} {
+		testWorkspaceExclude(t, mode)
+	}
+}
+
+func testWorkspaceExclude(t *testing.T, mode string) {
+	backend, err := storage.NewLocal(t.TempDir())
 	if err != nil {
-		t.Fatalf("Create oss client failed. Context: %v Error: %v", ctx, err)
+		t.Fatalf("unable to create local backend: %v", err)
+	}
+	workspace := t.TempDir()
+	writeFiles(t, workspace, map[string]string{
+		IgnoreFile:                    "# dependencies\nnode_modules/\n*.log\n",
+		"main.go":                     "package main",
+		"node_modules/react/index.js": "react",
+		"target/app.jar":              "jar",
+		"logs/error.log":              "error",
+		"logs/keep.log":               "keep",
+	})
+	vserver := &Server{
+		WorkspaceDir:      workspace,
+		WorkspaceOssPath:  "workspace.tar.gz",
+		WorkspaceSyncMode: mode,
+		Exclude:           []string{"/target"},
+		Include:           []string{"keep.log"},
+		Storage:           backend,
+		Syncer:            snapshot.NewSyncer(backend, 2),
+		WorkspaceProgress: newLoadProgress(),
+		workspaceLoaded:   true,
+	}
+	if err = vserver.saveWorkspace(); err != nil {
+		t.Fatalf("%s: unable to save workspace: %v", mode, err)
+	}
+
+	dst := t.TempDir()
+	if err = vserver.load(vserver.WorkspaceOssPath, dst); err != nil {
+		t.Fatalf("%s: unable to load workspace: %v", mode, err)
+	}
+	for name, saved := range map[string]bool{
+		IgnoreFile: true, "main.go": true, "logs/keep.log": true,
+		"node_modules": false, "target": false, "logs/error.log": false,
+	} {
+		if _, err := os.Stat(filepath.Join(dst, name)); (err == nil) != saved {
+			t.Fatalf("%s: expected %s saved: %v, but got error %v", mode, name, saved, err)
+		}
+	}
+	status := vserver.Status()
+	if excluded := status.Excluded; excluded == nil || excluded.Files != 3 || excluded.Bytes != 13 || len(excluded.Paths) != 3 {
+		t.Fatalf("%s: unexpected excluded status: %+v", mode, excluded)
+	}
+	if status.WorkspaceSave.Bytes <= 0 {
+		t.Fatalf("%s: expected the saved bytes, but got %+v", mode, status.WorkspaceSave)
+	}
+}
+
+func TestLoadDenied(t *testing.T) {
+	cases := []struct {
+		name        string
+		accessKeyId string
+		deny        string
+	}{
+		{"access denied", testAccessKeyId, "tests/"},
+		{"invalid access key", "invalid", ""},
+	}
+	for _, c := range cases {
+		server, _ := setupOss(t)
+		server.PutObject("tests/workspace.tar.gz", archive(t, map[string]string{"file.txt": "stored"}))
+		if c.deny != "" {
+			server.Deny(c.deny)
+		}
+		backend, err := storage.New(newTestContext(c.accessKeyId))
+		if err != nil {
+			t.Fatalf("%s: create storage backend failed. Error: %v", c.name, err)
+		}
+		vserver := &Server{
+			WorkspaceDir:      t.TempDir(),
+			WorkspaceOssPath:  "tests/workspace.tar.gz",
+			WorkspaceSyncMode: SyncModeArchive,
+			Storage:           backend,
+			WorkspaceProgress: newLoadProgress(),
+		}
+
+		// The denied workspace is not taken as a missing one, so the save is refused
+		// instead of overwriting the stored workspace with the empty one.
+		vserver.workspaceLock.Lock()
+		vserver.loadWorkspace()
+		if status := vserver.WorkspaceProgress.Status(); status.State != LoadStateFailed {
+			t.Fatalf("%s: expected the loading failed, but got %+v", c.name, status)
+		}
+		if err = vserver.saveWorkspace(); err == nil {
+			t.Fatalf("%s: expected the save refused", c.name)
+		}
+		server.Allow()
+		if server.Requests("PutObject") != 0 {
+			t.Fatalf("%s: expected no PutObject request", c.name)
+		}
+	}
+}
+
+// flakyStat fails the first Stat calls, like a transient storage error.
+type flakyStat struct {
+	storage.Backend
+	failures int
+}
+
+func (f *flakyStat) Stat(key string) (*storage.ObjectInfo, error) {
+	if f.failures > 0 {
+		f.failures--
+		return nil, errors.New("connection reset")
 	}
-	vserver.OssClient = c
+	return f.Backend.Stat(key)
+}
 
-	srcTemp, err := os.MkdirTemp("", "")
-	defer os.RemoveAll(srcTemp)
+func TestLoadStatFailed(t *testing.T) {
+	root := t.TempDir()
+	backend, err := storage.NewLocal(filepath.Join(root, "storage"))
 	if err != nil {
-		t.Fatalf("unable to create temporary dir: %s", srcTemp)
+		t.Fatalf("unable to create local backend: %v", err)
+	}
+	if err = backend.Put("workspace.tar.gz", bytes.NewReader(archive(t, map[string]string{"file.txt": "stored"}))); err != nil {
+		t.Fatalf("unable to put the archive: %v", err)
+	}
+	vserver := &Server{
+		WorkspaceDir:      filepath.Join(root, "workspace"),
+		WorkspaceOssPath:  "workspace.tar.gz",
+		WorkspaceSyncMode: SyncModeArchive,
+		Storage:           &flakyStat{Backend: backend, failures: 1},
+		WorkspaceProgress: newLoadProgress(),
 	}
 
-	// Prepare the mock workspace data.
-	vserver.WorkspaceDir = srcTemp
-	filePath := filepath.Join(vserver.WorkspaceDir, "file1.txt")
-	cmd := exec.Command("bash", "-c", "mkdir -p "+vserver.WorkspaceDir+"&&"+" echo \"this is file1.\" >> "+filePath)
-	err = cmd.Run()
+	// The ETag is unknown, so the loading fails rather than taking the workspace as a new one.
+	vserver.workspaceLock.Lock()
+	vserver.loadWorkspace()
+	if status := vserver.WorkspaceProgress.Status(); status.State != LoadStateFailed || vserver.workspaceLoaded {
+		t.Fatalf("expected the loading failed, but got %+v", status)
+	}
+
+	vserver.workspaceLock.Lock()
+	vserver.loadWorkspace()
+	if !vserver.workspaceLoaded || vserver.workspaceETag == "" {
+		t.Fatalf("expected the workspace loaded with its ETag, but got %q", vserver.workspaceETag)
+	}
+}
+
+func TestLoadEncrypted(t *testing.T) {
+	_, ctx := setupOss(t)
+	key := make([]byte, encryption.DataKeySize)
+	rand.Read(key)
+	viper.Set("encryption.enabled", true)
+	viper.Set("encryption.key", base64.StdEncoding.EncodeToString(key))
+	encrypted, err := storage.New(ctx)
 	if err != nil {
-		t.Fatalf("unable to create file %s. Error: %v", filePath, err)
+		t.Fatalf("Create storage backend failed. Error: %v", err)
 	}
-	subDir := filepath.Join(vserver.WorkspaceDir, "file2")
-	filePath = filepath.Join(subDir, "file2.txt")
-	cmd = exec.Command("bash", "-c", "mkdir -p "+subDir+"&&"+" echo \"this is file2.\" >> "+filePath)
-	err = cmd.Run()
+
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{".ssh/id_rsa": "private key"})
+	vserver := &Server{Storage: encrypted}
+	if err = vserver.save(src, "tests/workspace.tar.gz"); err != nil {
+		t.Fatalf("unable to save workspace: %v", err)
+	}
+	dst := t.TempDir()
+	if err = vserver.load("tests/workspace.tar.gz", dst); err != nil {
+		t.Fatalf("unable to load workspace: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dst, ".ssh/id_rsa")); err != nil || string(data) != "private key" {
+		t.Fatalf("unexpected loaded data %q, error: %v", data, err)
+	}
+
+	// The encrypted workspace can not be loaded without the encryption, and the local directory is untouched.
+	viper.Set("encryption.enabled", false)
+	vserver.Storage, err = storage.New(ctx)
 	if err != nil {
-		t.Fatalf("unable to create file %s. Error: %v", filePath, err)
+		t.Fatalf("Create storage backend failed. Error: %v", err)
 	}
+	if err = vserver.load("tests/workspace.tar.gz", t.TempDir()); err == nil || !strings.Contains(err.Error(), "encrypted") {
+		t.Fatalf("expected the encrypted error, but got %v", err)
+	}
+}
 
-	// Save workspace data to oss.
-	if err = vserver.save(vserver.WorkspaceDir, vserver.WorkspaceOssPath); err != nil {
-		t.Fatalf("unable to save workspace. error: %v", err)
+func TestServerLifecycle(t *testing.T) {
+	server, ctx := setupOss(t)
+	server.PutObject("tests/workspace.tar.gz", archive(t, map[string]string{"src/main.go": "package main"}))
+	server.PutObject("tests/vscode-server-data.tar.gz", archive(t, map[string]string{"user-data/User/settings.json": "{}"}))
+
+	root := t.TempDir()
+	viper.Set("vscode.binaryDirectory", fakeVscodeBinary(t))
+	viper.Set("vscode.dataDirectory", filepath.Join(root, "vscode-server"))
+	viper.Set("vscode.dataOssPath", "tests/vscode-server-data.tar.gz")
+	viper.Set("vscode.startTimeout", "10s")
+	viper.Set("workspace.directory", filepath.Join(root, "workspace"))
+	viper.Set("workspace.ossPath", "tests/workspace.tar.gz")
+	viper.Set("autosave.interval", "0")
+	viper.Set("autosave.debounce", "0")
+
+	port := freePort(t)
+	vserver, err := NewServer(ctx, WithPort(port), WithConnectionToken("test-token"))
+	if err != nil {
+		t.Fatalf("unable to create vscode server: %v", err)
 	}
+	defer vserver.stopProcess()
 
-	// Load workspace data from oss.
-	dstTemp, err := os.MkdirTemp("", "")
-	defer os.RemoveAll(dstTemp)
+	// The data is loaded.
+	deadline := time.Now().Add(5 * time.Second)
+	for vserver.WorkspaceProgress.Status().State != LoadStateDone {
+		if time.Now().After(deadline) {
+			t.Fatalf("workspace not loaded: %+v", vserver.WorkspaceProgress.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, file := range []string{
+		filepath.Join(vserver.WorkspaceDir, "src/main.go"),
+		filepath.Join(vserver.VscodeDataDir, "user-data/User/settings.json"),
+	} {
+		if _, err = os.Stat(file); err != nil {
+			t.Fatalf("expected %s loaded, but got %v", file, err)
+		}
+	}
+
+	// The vscode server is launched with the connection token.
+	for token, expected := range map[string]int{"test-token": http.StatusOK, "wrong": http.StatusForbidden} {
+		resp, err := http.Get("http://127.0.0.1:" + port + "/?tkn=" + token)
+		if err != nil {
+			t.Fatalf("unable to request vscode server: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != expected || (expected == http.StatusOK && string(body) != "openvscode-server") {
+			t.Fatalf("expected %d with token %s, but got %d %q", expected, token, resp.StatusCode, body)
+		}
+	}
+	if status := vserver.Status(); !status.Process.Running || status.DataLoad.Error != "" {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+
+	// Shutdown stops the vscode server before the final save, so the data written on exit is saved.
+	writeFiles(t, vserver.WorkspaceDir, map[string]string{"src/new.go": "package main"})
+	vserver.Shutdown()
+	if status := vserver.Status(); status.Process.Running || status.DataSave.Error != "" || status.WorkspaceSave.Error != "" {
+		t.Fatalf("unexpected status after shutdown: %+v", status)
+	}
+	for key, file := range map[string]string{
+		"tests/workspace.tar.gz":          "src/new.go",
+		"tests/vscode-server-data.tar.gz": "user-data/exit.log",
+	} {
+		dir := t.TempDir()
+		if err = vserver.load(key, dir); err != nil {
+			t.Fatalf("unable to load %s: %v", key, err)
+		}
+		if _, err = os.Stat(filepath.Join(dir, file)); err != nil {
+			t.Fatalf("expected %s saved in %s, but got %v", file, key, err)
+		}
+	}
+}
+
+func TestServerInitFailed(t *testing.T) {
+	cases := []struct {
+		name      string
+		binaryDir func(t *testing.T) string
+		deny      string
+	}{
+		{"data denied", fakeVscodeBinary, "tests/vscode-server-data"},
+		{"binary missing", func(t *testing.T) string { return t.TempDir() }, ""},
+	}
+	for _, c := range cases {
+		server, ctx := setupOss(t)
+		server.PutObject("tests/vscode-server-data.tar.gz", archive(t, map[string]string{"user-data/User/settings.json": "{}"}))
+		if c.deny != "" {
+			server.Deny(c.deny)
+		}
+
+		root := t.TempDir()
+		viper.Set("vscode.binaryDirectory", c.binaryDir(t))
+		viper.Set("vscode.dataDirectory", filepath.Join(root, "vscode-server"))
+		viper.Set("vscode.dataOssPath", "tests/vscode-server-data.tar.gz")
+		viper.Set("vscode.startTimeout", "10s")
+		viper.Set("workspace.directory", filepath.Join(root, "workspace"))
+		viper.Set("workspace.ossPath", "tests/workspace.tar.gz")
+		// The autosave would save the workspace right away if it were started.
+		viper.Set("autosave.interval", "10ms")
+		viper.Set("autosave.debounce", "0")
+
+		if _, err := NewServer(ctx, WithPort(freePort(t))); err == nil {
+			t.Fatalf("%s: expected the init failed", c.name)
+		}
+		if _, err := os.Lstat(filepath.Join(root, "workspace", restoreDir)); err == nil {
+			t.Fatalf("%s: expected the workspace loading exited", c.name)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if _, ok := server.GetObject("tests/workspace.tar.gz"); ok {
+			t.Fatalf("%s: expected nothing saved", c.name)
+		}
+	}
+}
+
+func TestSaveWorkspaceNotLoaded(t *testing.T) {
+	dir, err := os.MkdirTemp("", "")
 	if err != nil {
-		t.Fatalf("unable to create temporary dir: %s", dstTemp)
+		t.Fatalf("unable to create temporary dir: %v", err)
 	}
-	vserver.WorkspaceDir = dstTemp
-	if err = vserver.load(vserver.WorkspaceOssPath, vserver.WorkspaceDir); err != nil {
-		t.Fatalf("unable to load workspace. error: %v", err)
+	defer os.RemoveAll(dir)
+
+	backend, err := storage.NewLocal(dir)
+	if err != nil {
+		t.Fatalf("unable to create local backend: %v", err)
+	}
+	vserver := &Server{
+		WorkspaceDir:      dir,
+		WorkspaceOssPath:  "workspace.tar.gz",
+		WorkspaceSyncMode: SyncModeArchive,
+		Storage:           backend,
+		WorkspaceProgress: newLoadProgress(),
 	}
 
-	// Verify the data.
-	cmd = exec.Command("diff", "--recursive", srcTemp, dstTemp)
-	err = cmd.Run()
+	// The workspace loading failed, the save must not overwrite the stored workspace.
+	vserver.WorkspaceProgress.finish(errors.New("extract failed"))
+	if err = vserver.saveWorkspace(); err == nil {
+		t.Fatalf("expected the save refused")
+	}
+	if _, err = backend.Stat(vserver.WorkspaceOssPath); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("expected no workspace object, but got %v", err)
+	}
+	if status := vserver.WorkspaceProgress.Status(); status.State != LoadStateFailed || status.Error != "extract failed" {
+		t.Fatalf("unexpected progress: %+v", status)
+	}
+	if status := vserver.Status(); status.WorkspaceSave.Time.IsZero() || status.WorkspaceSave.Error == "" || status.Process.Running {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+}
+
+func TestSaveWorkspaceConflict(t *testing.T) {
+	for _, mode := range []string{SyncModeArchive, SyncModeIncremental} {
+		root := t.TempDir()
+		backend, err := storage.NewLocal(filepath.Join(root, "storage"))
+		if err != nil {
+			t.Fatalf("unable to create local backend: %v", err)
+		}
+		vserver := &Server{
+			WorkspaceDir:      filepath.Join(root, "workspace"),
+			WorkspaceOssPath:  "workspace.tar.gz",
+			WorkspaceSyncMode: mode,
+			Storage:           backend,
+			Syncer:            snapshot.NewSyncer(backend, 1),
+			WorkspaceProgress: newLoadProgress(),
+		}
+		load := func() {
+			vserver.workspaceLock.Lock()
+			vserver.loadWorkspace()
+			if !vserver.workspaceLoaded {
+				t.Fatalf("%s: expected the workspace loaded", mode)
+			}
+		}
+		// stored checks the content of the object key.
+		stored := func(key string, files map[string]string) {
+			t.Helper()
+			dir := filepath.Join(t.TempDir(), "check")
+			if err := vserver.load(key, dir); err != nil {
+				t.Fatalf("%s: unable to load %s: %v", mode, key, err)
+			}
+			assertFiles(t, dir, files)
+		}
+
+		if err = backend.Put(vserver.WorkspaceOssPath, bytes.NewReader(archive(t, map[string]string{"a.txt": "v1"}))); err != nil {
+			t.Fatalf("unable to put the archive: %v", err)
+		}
+		load()
+		// The consecutive saves of this server are not conflicts.
+		for i := 0; i < 2; i++ {
+			writeFiles(t, vserver.WorkspaceDir, map[string]string{"a.txt": fmt.Sprintf("local%d", i)})
+			if err = vserver.saveWorkspace(); err != nil {
+				t.Fatalf("%s: unable to save workspace: %v", mode, err)
+			}
+		}
+		stored(vserver.WorkspaceOssPath, map[string]string{"a.txt": "local1"})
+
+		// Saved by another server.
+		others := map[string]string{"a.txt": "others"}
+		if err = backend.Put(vserver.WorkspaceOssPath, bytes.NewReader(archive(t, others))); err != nil {
+			t.Fatalf("unable to put the archive: %v", err)
+		}
+		writeFiles(t, vserver.WorkspaceDir, map[string]string{"a.txt": "local2"})
+		if err = vserver.saveWorkspace(); !errors.Is(err, storage.ErrPreconditionFailed) {
+			t.Fatalf("%s: expected the conflict, but got %v", mode, err)
+		}
+		conflict := vserver.Status().Conflict
+		if conflict == nil || !strings.HasPrefix(conflict.Key, vserver.conflictPrefix()) || conflict.ETag == "" {
+			t.Fatalf("%s: unexpected conflict status: %+v", mode, conflict)
+		}
+		stored(vserver.WorkspaceOssPath, others)
+		stored(conflict.Key, map[string]string{"a.txt": "local2"})
+
+		// The later saves go aside as well, until the workspace is loaded again.
+		writeFiles(t, vserver.WorkspaceDir, map[string]string{"a.txt": "local3"})
+		if err = vserver.saveWorkspace(); !errors.Is(err, storage.ErrPreconditionFailed) {
+			t.Fatalf("%s: expected the conflict, but got %v", mode, err)
+		}
+		if status := vserver.Status(); status.Conflict == nil || status.Conflict.Key != conflict.Key || status.WorkspaceSave.Error == "" {
+			t.Fatalf("%s: unexpected status: %+v", mode, status)
+		}
+		stored(vserver.WorkspaceOssPath, others)
+		stored(conflict.Key, map[string]string{"a.txt": "local3"})
+
+		load()
+		assertFiles(t, vserver.WorkspaceDir, others)
+		if err = vserver.saveWorkspace(); err != nil || vserver.Status().Conflict != nil {
+			t.Fatalf("%s: expected the conflict resolved, error: %v", mode, err)
+		}
+	}
+}
+
+func TestSaveDataConflict(t *testing.T) {
+	root := t.TempDir()
+	backend, err := storage.NewLocal(filepath.Join(root, "storage"))
 	if err != nil {
-		t.Fatalf("The two directories are not equal.\nSrc dir: %s\nDst dir: %s\nError: %v", srcTemp, dstTemp, err)
+		t.Fatalf("unable to create local backend: %v", err)
+	}
+	vserver := &Server{
+		VscodeDataDir:     filepath.Join(root, "data"),
+		VscodeDataOssPath: "data.tar.gz",
+		Storage:           backend,
+		WorkspaceProgress: newLoadProgress(),
+	}
+	// The consecutive saves of this server are not conflicts.
+	for i := 0; i < 2; i++ {
+		writeFiles(t, vserver.VscodeDataDir, map[string]string{"settings.json": fmt.Sprintf("local%d", i)})
+		if err = vserver.saveData(); err != nil {
+			t.Fatalf("unable to save data: %v", err)
+		}
+	}
+
+	// Saved by another server, which is not overwritten.
+	others := map[string]string{"settings.json": "others"}
+	if err = backend.Put(vserver.VscodeDataOssPath, bytes.NewReader(archive(t, others))); err != nil {
+		t.Fatalf("unable to put the archive: %v", err)
+	}
+	if err = vserver.saveData(); !errors.Is(err, storage.ErrPreconditionFailed) {
+		t.Fatalf("expected the conflict, but got %v", err)
+	}
+	if status := vserver.Status(); status.DataSave.Error == "" {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+	dir := filepath.Join(root, "check")
+	if err = vserver.load(vserver.VscodeDataOssPath, dir); err != nil {
+		t.Fatalf("unable to load data: %v", err)
+	}
+	assertFiles(t, dir, others)
+}
+
+func TestWithUser(t *testing.T) {
+	s := &Server{
+		VscodeDataDir:     "/data/vscode-server",
+		WorkspaceDir:      "/data/workspace",
+		VscodeDataOssPath: "webide/vscode-server-data.tar.gz",
+		WorkspaceOssPath:  "webide/workspace.tar.gz",
+	}
+	WithUser("alice")(s)
+
+	expected := &Server{
+		User:              "alice",
+		VscodeDataDir:     "/data/vscode-server/alice",
+		WorkspaceDir:      "/data/workspace/alice",
+		VscodeDataOssPath: "webide/users/alice/vscode-server-data.tar.gz",
+		WorkspaceOssPath:  "webide/users/alice/workspace.tar.gz",
+	}
+	if s.User != expected.User || s.VscodeDataDir != expected.VscodeDataDir || s.WorkspaceDir != expected.WorkspaceDir ||
+		s.VscodeDataOssPath != expected.VscodeDataOssPath || s.WorkspaceOssPath != expected.WorkspaceOssPath {
+		t.Fatalf("expected %+v, but got %+v", expected, s)
+	}
+}
+
+// lockedBuffer collects the logs written by the goroutines of the server.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// TestRedaction runs the server through init, load, save and shutdown, including the failed ones,
+// and checks no credential is printed in the logs, the errors or the status.
+func TestRedaction(t *testing.T) {
+	const (
+		secret          = "redaction-test-access-key-secret"
+		securityToken   = "redaction-test-security-token"
+		connectionToken = "redaction-test-connection-token"
+	)
+	logs := &lockedBuffer{}
+	logger, err := logging.New(logs, logging.FormatJSON, slog.LevelDebug)
+	if err != nil {
+		t.Fatalf("unable to create logger: %v", err)
+	}
+	previous := slog.Default()
+	slog.SetDefault(logger)
+	defer slog.SetDefault(previous)
+
+	server, _ := setupOss(t)
+	server.PutObject("tests/workspace.tar.gz", archive(t, map[string]string{"src/main.go": "package main"}))
+	server.PutObject("tests/vscode-server-data.tar.gz", archive(t, map[string]string{"user-data/User/settings.json": "{}"}))
+	header := http.Header{}
+	header.Set("x-fc-access-key-id", testAccessKeyId)
+	header.Set("x-fc-access-key-secret", secret)
+	header.Set("x-fc-security-token", securityToken)
+	fc := &context.FcProvider{}
+	fc.Update(header)
+	ctx := &context.Context{Source: context.SourceFc, Region: "cn-hangzhou", Credentials: context.NewCredentialCache(fc, 0), Fc: fc}
+
+	configure := func(root string) {
+		viper.Set("vscode.binaryDirectory", fakeVscodeBinary(t))
+		viper.Set("vscode.dataDirectory", filepath.Join(root, "vscode-server"))
+		viper.Set("vscode.dataOssPath", "tests/vscode-server-data.tar.gz")
+		viper.Set("vscode.startTimeout", "10s")
+		viper.Set("workspace.directory", filepath.Join(root, "workspace"))
+		viper.Set("workspace.ossPath", "tests/workspace.tar.gz")
+		viper.Set("autosave.interval", "0")
+		viper.Set("autosave.debounce", "0")
+	}
+
+	var printed []string
+	// The init fails while the data is denied, which aborts the workspace loading in the background.
+	configure(t.TempDir())
+	server.Deny("tests/vscode-server-data")
+	if _, err = NewServer(ctx, WithPort(freePort(t)), WithConnectionToken(connectionToken)); err == nil {
+		t.Fatalf("expected the init failed")
+	}
+	printed = append(printed, err.Error())
+	server.Allow()
+
+	configure(t.TempDir())
+
+	vserver, err := NewServer(ctx, WithPort(freePort(t)), WithConnectionToken(connectionToken))
+	if err != nil {
+		t.Fatalf("unable to create vscode server: %v", err)
+	}
+	defer vserver.stopProcess()
+	deadline := time.Now().Add(5 * time.Second)
+	for vserver.WorkspaceProgress.Status().State != LoadStateDone {
+		if time.Now().After(deadline) {
+			t.Fatalf("workspace not loaded: %+v", vserver.WorkspaceProgress.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The save fails while the workspace is denied.
+	server.Deny("tests/workspace")
+	if err = vserver.saveAll(); err == nil {
+		t.Fatalf("expected the save failed")
+	}
+	printed = append(printed, err.Error())
+	server.Allow()
+
+	vserver.Shutdown()
+	status, err := json.Marshal(vserver.Status())
+	if err != nil {
+		t.Fatalf("unable to marshal status: %v", err)
+	}
+	logger.Info("Formatted.", "server", vserver, "context", ctx)
+	printed = append(printed, string(status), logs.String(),
+		fmt.Sprintf("%v %+v %#v %s", vserver, vserver, vserver, vserver),
+		fmt.Sprintf("%v %+v %#v %s", ctx, ctx, ctx, ctx),
+		fmt.Sprintf("%v %+v %#v %s", *ctx, ctx.Credentials, ctx.Fc, ctx.Fc))
+
+	for _, p := range printed {
+		for _, credential := range []string{secret, securityToken, connectionToken} {
+			if strings.Contains(p, credential) {
+				t.Fatalf("expected %s redacted, but got:\n%s", credential, p)
+			}
+		}
+	}
+	// The logs are written by the test logger, not redacted by accident.
+	for _, expected := range []string{
+		"Load workspace data from storage succeeded.",
+		"Save workspace data failed.",
+		`"workspaceOssPath":"tests/workspace.tar.gz"`,
+		`"region":"cn-hangzhou"`,
+	} {
+		if !strings.Contains(logs.String(), expected) {
+			t.Fatalf("expected %q in the logs:\n%s", expected, logs.String())
+		}
 	}
 }
@@ -0,0 +1,124 @@
+package vscode
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// snapshotTimeFormat is the format of the snapshot id, which sorts in time order.
+const snapshotTimeFormat = "20060102T150405.000Z"
+
+// Snapshot is a saved version of the workspace.
+type Snapshot struct {
+	Id   string    `json:"id"`
+	Key  string    `json:"key"`
+	Size int64     `json:"size"`
+	Time time.Time `json:"time"`
+}
+
+// snapshotPrefix returns the prefix of the workspace snapshots, which are stored next to the workspace object.
+func (s *Server) snapshotPrefix() string {
+	return s.WorkspaceOssPath + ".snapshots/"
+}
+
+// takeSnapshot copies the saved workspace object to a new timestamped snapshot and applies the retention policy.
+func (s *Server) takeSnapshot() error {
+	if s.SnapshotKeep <= 0 {
+		return nil
+	}
+
+	id := time.Now().UTC().Format(snapshotTimeFormat)
+	key := s.snapshotPrefix() + id
+	if err := s.Storage.Copy(s.WorkspaceOssPath, key); err != nil {
+		s.logger().Error("Copy workspace to snapshot failed.", "key", s.WorkspaceOssPath, "snapshot", key, "error", err)
+		return err
+	}
+	s.logger().Info("Take workspace snapshot succeeded.", "snapshot", key)
+
+	return s.pruneSnapshots()
+}
+
+// pruneSnapshots deletes the snapshots beyond the latest SnapshotKeep ones and the ones older than SnapshotMaxAge.
+// In incremental sync mode, the snapshots are manifests sharing the blobs of the workspace, so the blobs referenced
+// by neither the workspace nor the kept snapshots are deleted afterwards.
+func (s *Server) pruneSnapshots() error {
+	snapshots, err := s.ListSnapshots()
+	if err != nil {
+		return err
+	}
+	roots := []string{s.WorkspaceOssPath}
+	pruned := false
+	for i, snapshot := range snapshots {
+		expired := s.SnapshotMaxAge > 0 && time.Since(snapshot.Time) > s.SnapshotMaxAge
+		if i < s.SnapshotKeep && !expired {
+			roots = append(roots, snapshot.Key)
+			continue
+		}
+		if err = s.Storage.Delete(snapshot.Key); err != nil {
+			s.logger().Error("Delete snapshot failed.", "snapshot", snapshot.Key, "error", err)
+			return err
+		}
+		pruned = true
+		s.logger().Info("Delete snapshot succeeded.", "snapshot", snapshot.Key)
+	}
+
+	if pruned && s.WorkspaceSyncMode == SyncModeIncremental {
+		if _, err = s.Syncer.Collect(s.WorkspaceOssPath, roots); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListSnapshots returns the workspace snapshots, the latest first.
+func (s *Server) ListSnapshots() ([]Snapshot, error) {
+	prefix := s.snapshotPrefix()
+	objects, err := s.Storage.List(prefix)
+	if err != nil {
+		s.logger().Error("List snapshots failed.", "prefix", prefix, "error", err)
+		return nil, err
+	}
+
+	snapshots := []Snapshot{}
+	for _, obj := range objects {
+		id := strings.TrimPrefix(obj.Key, prefix)
+		t, err := time.Parse(snapshotTimeFormat, id)
+		if err != nil {
+			// Not a snapshot, e.g. created by others.
+			continue
+		}
+		snapshots = append(snapshots, Snapshot{Id: id, Key: obj.Key, Size: obj.Size, Time: t})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Id > snapshots[j].Id })
+	return snapshots, nil
+}
+
+// RestoreSnapshot replaces the content of the workspace directory with the snapshot.
+// The restored workspace is saved by the next save as usual.
+func (s *Server) RestoreSnapshot(id string) error {
+	if _, err := time.Parse(snapshotTimeFormat, id); err != nil {
+		return fmt.Errorf("invalid snapshot id: %s", id)
+	}
+	key := s.snapshotPrefix() + id
+
+	s.workspaceLock.Lock()
+	defer s.workspaceLock.Unlock()
+
+	if _, err := s.Storage.Stat(key); err != nil {
+		s.logger().Error("Stat snapshot failed.", "snapshot", key, "error", err)
+		return err
+	}
+
+	// Until the restore succeeds, the workspace may be mixed and must not be saved.
+	s.workspaceLoaded = false
+	if err := s.restoreWorkspace(key, nil); err != nil {
+		s.logger().Error("Restore snapshot failed.", "snapshot", key, "error", err)
+		return err
+	}
+	s.workspaceLoaded = true
+
+	s.logger().Info("Restore snapshot succeeded.", "snapshot", key, "dir", s.WorkspaceDir)
+	return nil
+}
@@ -0,0 +1,87 @@
+package vscode
+
+import (
+	"aliyun/serverless/webide-server/pkg/snapshot"
+	"aliyun/serverless/webide-server/pkg/storage"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshots(t *testing.T) {
+	for _, mode := range []string{SyncModeArchive, SyncModeIncremental} {
+		testSnapshots(t, mode)
+	}
+}
+
+func testSnapshots(t *testing.T, mode string) {
+	root, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Fatalf("unable to create temporary dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	backend, err := storage.NewLocal(filepath.Join(root, "storage"))
+	if err != nil {
+		t.Fatalf("unable to create local backend: %v", err)
+	}
+	vserver := &Server{
+		WorkspaceDir:      filepath.Join(root, "workspace"),
+		WorkspaceOssPath:  "tests/workspace.tar.gz",
+		WorkspaceSyncMode: mode,
+		SnapshotKeep:      2,
+		Storage:           backend,
+		Syncer:            snapshot.NewSyncer(backend, 2),
+		workspaceLoaded:   true,
+	}
+	vserver.Syncer.Grace = 0
+	os.MkdirAll(vserver.WorkspaceDir, 0755)
+	file := filepath.Join(vserver.WorkspaceDir, "file.txt")
+
+	// Save 3 versions, only the latest 2 are kept.
+	for _, content := range []string{"v1", "v2", "v3"} {
+		if err = os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatalf("unable to write file: %v", err)
+		}
+		if err = vserver.saveWorkspace(); err != nil {
+			t.Fatalf("unable to save workspace: %v", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	snapshots, err := vserver.ListSnapshots()
+	if err != nil {
+		t.Fatalf("unable to list snapshots: %v", err)
+	}
+	if len(snapshots) != 2 {
+		t.Fatalf("%s: expected 2 snapshots, but got %+v", mode, snapshots)
+	}
+	// The blob of v1 is referenced by neither the workspace nor the kept snapshots.
+	blobs, err := backend.List(snapshot.BlobPrefix(vserver.WorkspaceOssPath))
+	if err != nil {
+		t.Fatalf("unable to list blobs: %v", err)
+	}
+	if expected := map[string]int{SyncModeArchive: 0, SyncModeIncremental: 2}[mode]; len(blobs) != expected {
+		t.Fatalf("%s: expected %d blobs, but got %+v", mode, expected, blobs)
+	}
+
+	// An accidental rm, then restore the older snapshot.
+	os.Remove(file)
+	if err = os.WriteFile(filepath.Join(vserver.WorkspaceDir, "garbage.txt"), nil, 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	if err = vserver.RestoreSnapshot(snapshots[1].Id); err != nil {
+		t.Fatalf("%s: unable to restore snapshot: %v", mode, err)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil || string(data) != "v2" {
+		t.Fatalf("%s: expected v2, but got %q, error: %v", mode, data, err)
+	}
+	if _, err = os.Stat(filepath.Join(vserver.WorkspaceDir, "garbage.txt")); !os.IsNotExist(err) {
+		t.Fatalf("expected the files not in the snapshot removed, but got %v", err)
+	}
+
+	if err = vserver.RestoreSnapshot("../../etc/passwd"); err == nil {
+		t.Fatalf("expected invalid snapshot id error")
+	}
+}
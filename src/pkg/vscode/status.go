@@ -0,0 +1,160 @@
+package vscode
+
+import (
+	"sync"
+	"time"
+)
+
+// OperationStatus is the result of the last run of a load or save operation.
+type OperationStatus struct {
+	Time            time.Time `json:"time,omitempty"` // end time of the last run, zero if never run
+	DurationSeconds float64   `json:"durationSeconds"`
+	Error           string    `json:"error,omitempty"`
+	Bytes           int64     `json:"bytes,omitempty"` // size of the saved archive, or of the snapshot files in incremental mode
+}
+
+// operation records the result of the last run.
+type operation struct {
+	mu     sync.Mutex
+	status OperationStatus
+}
+
+func (o *operation) record(start time.Time, bytes int64, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.status = OperationStatus{Time: time.Now(), DurationSeconds: time.Since(start).Seconds(), Bytes: bytes}
+	if err != nil {
+		o.status.Error = err.Error()
+	}
+}
+
+func (o *operation) Status() OperationStatus {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.status
+}
+
+// maxExcludedPaths is the max number of the excluded paths reported, the files and bytes count all of them.
+const maxExcludedPaths = 100
+
+// ExcludeStatus reports the workspace files left out of the last archive save.
+type ExcludeStatus struct {
+	Paths     []string `json:"paths,omitempty"` // the excluded files and directories, at most maxExcludedPaths
+	Truncated bool     `json:"truncated,omitempty"`
+	Files     int64    `json:"files"` // number of the excluded regular files, including the ones in the excluded directories
+	Bytes     int64    `json:"bytes"` // total size of the excluded regular files, which are not saved
+}
+
+// add is the callback of tar.WithSkipped.
+func (e *ExcludeStatus) add(path string, files int64, bytes int64) {
+	if len(e.Paths) < maxExcludedPaths {
+		e.Paths = append(e.Paths, path)
+	} else {
+		e.Truncated = true
+	}
+	e.Files += files
+	e.Bytes += bytes
+}
+
+// exclusion records the files excluded by the last workspace save.
+type exclusion struct {
+	mu     sync.Mutex
+	status *ExcludeStatus
+}
+
+func (e *exclusion) record(status *ExcludeStatus) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.status = status
+}
+
+func (e *exclusion) Status() *ExcludeStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.status
+}
+
+// ConflictStatus reports the stored workspace is changed by others since it was loaded, so the saves are kept
+// aside in Key instead of overwriting it, until the workspace is loaded again.
+type ConflictStatus struct {
+	Time time.Time `json:"time"` // when the conflict was detected
+	Key  string    `json:"key"`  // the object where the workspace is saved instead
+	ETag string    `json:"etag"` // ETag of the workspace object when it was loaded, empty if it did not exist
+}
+
+// conflict records the conflict of the workspace saves.
+type conflict struct {
+	mu     sync.Mutex
+	status *ConflictStatus
+}
+
+func (c *conflict) record(status *ConflictStatus) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.status = status
+}
+
+func (c *conflict) Status() *ConflictStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status
+}
+
+// ProcessStatus is the state of the vscode server process.
+type ProcessStatus struct {
+	Pid       int       `json:"pid,omitempty"`
+	Running   bool      `json:"running"`
+	StartTime time.Time `json:"startTime,omitempty"`
+	ExitTime  time.Time `json:"exitTime,omitempty"`
+	ExitError string    `json:"exitError,omitempty"` // error of the last exit
+	Restarts  int       `json:"restarts"`            // number of the restarts after crashes
+}
+
+// ServerStatus reports the state of the vscode server, the workspace loading and the saves.
+type ServerStatus struct {
+	User          string             `json:"user,omitempty"`
+	Process       ProcessStatus      `json:"process"`
+	DataLoad      OperationStatus    `json:"dataLoad"`
+	WorkspaceLoad LoadProgressStatus `json:"workspaceLoad"`
+	DataSave      OperationStatus    `json:"dataSave"`
+	WorkspaceSave OperationStatus    `json:"workspaceSave"`
+	Excluded      *ExcludeStatus     `json:"excluded,omitempty"` // the workspace files excluded by the last workspace save
+	Conflict      *ConflictStatus    `json:"conflict,omitempty"` // set if the stored workspace is changed by others
+	Autosave      *AutosaveStatus    `json:"autosave,omitempty"`
+	Lease         *LeaseStatus       `json:"lease,omitempty"`
+}
+
+// Status returns the state of the server.
+func (s *Server) Status() ServerStatus {
+	status := ServerStatus{
+		User:          s.User,
+		Process:       s.processStatus(),
+		DataLoad:      s.dataLoad.Status(),
+		WorkspaceLoad: s.WorkspaceProgress.Status(),
+		DataSave:      s.dataSave.Status(),
+		WorkspaceSave: s.workspaceSave.Status(),
+		Excluded:      s.excluded.Status(),
+		Conflict:      s.conflicted.Status(),
+	}
+	if s.Autosaver != nil {
+		autosave := s.Autosaver.Status()
+		status.Autosave = &autosave
+	}
+	if s.Lease != nil {
+		lease := s.Lease.Status()
+		status.Lease = &lease
+	}
+	return status
+}
+
+// Running returns whether the vscode server process is running.
+func (s *Server) Running() bool {
+	return s.processStatus().Running
+}
+
+func (s *Server) processStatus() ProcessStatus {
+	if s.Process == nil {
+		return ProcessStatus{}
+	}
+	return s.Process.Status()
+}
@@ -0,0 +1,232 @@
+package vscode
+
+import (
+	"aliyun/serverless/webide-server/pkg/metrics"
+	"bytes"
+	"errors"
+	"log/slog"
+	"net"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// stableRunTime is how long the process must run before the restart backoff is reset.
+const stableRunTime = time.Minute
+
+// Supervisor runs a child process, reaps it when it exits, and restarts it with exponential backoff until stopped.
+// The stdout and stderr of the process are written to the logs line by line.
+type Supervisor struct {
+	Logger     *slog.Logger
+	Name       string        // the name of the process in the logs
+	Backoff    time.Duration // the delay before the first restart, doubled for the consecutive crashes
+	MaxBackoff time.Duration // the max delay before a restart
+	// StopTimeout is how long Stop waits for the process to exit after SIGTERM before killing it, 0 kills at once.
+	StopTimeout time.Duration
+
+	command func() *exec.Cmd // creates the command of each run
+
+	mu      sync.Mutex
+	cmd     *exec.Cmd
+	status  ProcessStatus
+	stopped bool
+	stop    chan struct{}
+	done    chan struct{} // closed when the supervision loop exits
+}
+
+// NewSupervisor creates the supervisor of the process created by command.
+func NewSupervisor(name string, command func() *exec.Cmd, backoff, maxBackoff time.Duration) *Supervisor {
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	if maxBackoff < backoff {
+		maxBackoff = backoff
+	}
+	return &Supervisor{
+		Logger:     slog.Default(),
+		Name:       name,
+		Backoff:    backoff,
+		MaxBackoff: maxBackoff,
+		command:    command,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// Start starts the process and the supervision loop. The error of the first start is returned,
+// and the process is not restarted in that case. Start must be called once.
+func (p *Supervisor) Start() error {
+	cmd, err := p.launch()
+	if err != nil {
+		close(p.done)
+		return err
+	}
+	go p.run(cmd)
+	return nil
+}
+
+// Stop terminates the process and waits for it to exit. The process is killed if it does not exit within StopTimeout.
+// The process is not restarted after Stop.
+func (p *Supervisor) Stop() {
+	p.mu.Lock()
+	if p.stopped {
+		p.mu.Unlock()
+		return
+	}
+	p.stopped = true
+	cmd := p.cmd
+	p.mu.Unlock()
+
+	close(p.stop)
+	if cmd != nil && cmd.Process != nil && p.StopTimeout > 0 {
+		signalGroup(cmd, syscall.SIGTERM)
+		select {
+		case <-p.done:
+			p.Logger.Info("Process stopped.", "process", p.Name)
+			return
+		case <-time.After(p.StopTimeout):
+			p.Logger.Warn("Process did not exit after SIGTERM, killing it.", "process", p.Name, "timeout", p.StopTimeout.String())
+		}
+	}
+	if cmd != nil && cmd.Process != nil {
+		signalGroup(cmd, syscall.SIGKILL)
+	}
+	<-p.done
+	p.Logger.Info("Process stopped.", "process", p.Name)
+}
+
+// Status returns the state of the process.
+func (p *Supervisor) Status() ProcessStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status
+}
+
+// launch starts a new run of the process.
+func (p *Supervisor) launch() (*exec.Cmd, error) {
+	cmd := p.command()
+	cmd.Stdout = newLineWriter(func(line string) { p.Logger.Info(line, "process", p.Name, "stream", "stdout") })
+	cmd.Stderr = newLineWriter(func(line string) { p.Logger.Warn(line, "process", p.Name, "stream", "stderr") })
+	// Run the process in its own group, so the children of the launcher script are killed together.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return nil, errors.New("supervisor is stopped")
+	}
+	if err := cmd.Start(); err != nil {
+		p.Logger.Error("Launch process failed.", "process", p.Name, "cmd", cmd.String(), "error", err)
+		return nil, err
+	}
+	p.cmd = cmd
+	p.status = ProcessStatus{Pid: cmd.Process.Pid, Running: true, StartTime: time.Now(), Restarts: p.status.Restarts}
+	p.Logger.Info("Launch process succeeded.", "process", p.Name, "pid", cmd.Process.Pid, "cmd", cmd.String())
+	return cmd, nil
+}
+
+// run waits for the process and restarts it until stopped.
+func (p *Supervisor) run(cmd *exec.Cmd) {
+	defer close(p.done)
+
+	backoff := p.Backoff
+	for {
+		start := time.Now()
+		err := cmd.Wait()
+		p.mu.Lock()
+		p.status.Running = false
+		p.status.ExitTime = time.Now()
+		p.status.ExitError = ""
+		if err != nil {
+			p.status.ExitError = err.Error()
+		}
+		stopped := p.stopped
+		p.mu.Unlock()
+		if stopped {
+			return
+		}
+		p.Logger.Error("Process exited unexpectedly.", "process", p.Name, "pid", cmd.Process.Pid, "error", err)
+
+		if time.Since(start) >= stableRunTime {
+			backoff = p.Backoff
+		}
+		for {
+			p.Logger.Info("Restarting process ...", "process", p.Name, "backoff", backoff.String())
+			select {
+			case <-p.stop:
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > p.MaxBackoff {
+				backoff = p.MaxBackoff
+			}
+
+			p.mu.Lock()
+			p.status.Restarts++
+			p.mu.Unlock()
+			metrics.ProcessRestarts.WithLabelValues(p.Name).Inc()
+			if cmd, err = p.launch(); err == nil {
+				break
+			}
+		}
+	}
+}
+
+// signalGroup sends sig to the process group of the command.
+func signalGroup(cmd *exec.Cmd, sig syscall.Signal) {
+	if err := syscall.Kill(-cmd.Process.Pid, sig); err != nil {
+		// Not a group leader, e.g. already exited.
+		cmd.Process.Signal(sig)
+	}
+}
+
+// waitListening waits until addr accepts tcp connections, or the timeout expires.
+func waitListening(addr string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(30 * time.Millisecond)
+	}
+}
+
+// lineWriter calls log for every complete line written, which is used to capture the process output.
+type lineWriter struct {
+	mu  sync.Mutex
+	buf []byte
+	log func(line string)
+}
+
+func newLineWriter(log func(line string)) *lineWriter {
+	return &lineWriter{log: log}
+}
+
+func (w *lineWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, b...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if line := bytes.TrimRight(w.buf[:i], "\r"); len(line) > 0 {
+			w.log(string(line))
+		}
+		w.buf = w.buf[i+1:]
+	}
+	// Flush a very long line without newline, so the buffer is bounded.
+	if len(w.buf) >= 64*1024 {
+		w.log(string(w.buf))
+		w.buf = nil
+	}
+	return len(b), nil
+}
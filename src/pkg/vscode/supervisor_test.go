@@ -0,0 +1,123 @@
+package vscode
+
+import (
+	"os/exec"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSupervisorRestart(t *testing.T) {
+	p := NewSupervisor("crash", func() *exec.Cmd {
+		return exec.Command("sh", "-c", "echo crashing; exit 1")
+	}, 10*time.Millisecond, 20*time.Millisecond)
+	if err := p.Start(); err != nil {
+		t.Fatalf("unable to start: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Status().Restarts < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected restarts, but got %+v", p.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	p.Stop()
+
+	status := p.Status()
+	restarts := status.Restarts
+	if status.Running || status.ExitError == "" {
+		t.Fatalf("unexpected status after stop: %+v", status)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if p.Status().Restarts != restarts {
+		t.Fatalf("expected no restart after stop, but got %+v", p.Status())
+	}
+}
+
+func TestSupervisorStop(t *testing.T) {
+	// The child of the shell is in the same process group, and killed by Stop too.
+	p := NewSupervisor("sleep", func() *exec.Cmd {
+		return exec.Command("sh", "-c", "sleep 60; sleep 60")
+	}, time.Second, time.Second)
+	if err := p.Start(); err != nil {
+		t.Fatalf("unable to start: %v", err)
+	}
+	if !p.Status().Running {
+		t.Fatalf("expected running, but got %+v", p.Status())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.Stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("stop timed out")
+	}
+	if status := p.Status(); status.Running || status.Restarts != 0 {
+		t.Fatalf("unexpected status after stop: %+v", status)
+	}
+}
+
+func TestSupervisorStopTimeout(t *testing.T) {
+	cases := []struct {
+		name     string
+		script   string
+		graceful bool
+	}{
+		{"graceful", "trap 'exit 0' TERM; while true; do sleep 0.05; done", true},
+		{"ignore SIGTERM", "trap '' TERM; while true; do sleep 0.05; done", false},
+	}
+	for _, c := range cases {
+		p := NewSupervisor(c.name, func() *exec.Cmd {
+			return exec.Command("sh", "-c", c.script)
+		}, time.Second, time.Second)
+		p.StopTimeout = 500 * time.Millisecond
+		if err := p.Start(); err != nil {
+			t.Fatalf("%s: unable to start: %v", c.name, err)
+		}
+		// Wait for the trap installed.
+		time.Sleep(100 * time.Millisecond)
+
+		start := time.Now()
+		p.Stop()
+		elapsed := time.Since(start)
+		if c.graceful && (elapsed >= p.StopTimeout || p.Status().ExitError != "") {
+			t.Fatalf("%s: expected graceful exit, but got %+v after %s", c.name, p.Status(), elapsed)
+		}
+		if !c.graceful && elapsed < p.StopTimeout {
+			t.Fatalf("%s: expected killed after %s, but stopped after %s", c.name, p.StopTimeout, elapsed)
+		}
+	}
+}
+
+func TestSupervisorStartError(t *testing.T) {
+	p := NewSupervisor("missing", func() *exec.Cmd {
+		return exec.Command("/nonexistent/openvscode-server")
+	}, time.Second, time.Second)
+	if err := p.Start(); err == nil {
+		t.Fatalf("expected start error")
+	}
+	// Stop does not block after a failed start.
+	p.Stop()
+}
+
+func TestLineWriter(t *testing.T) {
+	var lines []string
+	w := newLineWriter(func(line string) { lines = append(lines, line) })
+	for _, s := range []string{"first\nsec", "ond\r\n", "\n", "partial"} {
+		w.Write([]byte(s))
+	}
+	if expected := []string{"first", "second"}; !reflect.DeepEqual(lines, expected) {
+		t.Fatalf("expected %q, but got %q", expected, lines)
+	}
+}
+
+func TestWaitListening(t *testing.T) {
+	if err := waitListening("127.0.0.1:1", 50*time.Millisecond); err == nil {
+		t.Fatalf("expected timeout error")
+	}
+}